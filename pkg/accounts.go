@@ -0,0 +1,209 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	appcatalog "kmodules.xyz/custom-resources/apis/appcatalog/v1alpha1"
+)
+
+// getAccountCredentials reads the creds file of every account from the accounts secret
+func (opt *natsOptions) getAccountCredentials(appBinding *appcatalog.AppBinding) (map[string][]byte, error) {
+	secret, err := opt.kubeClient.CoreV1().Secrets(appBinding.Namespace).Get(opt.ctx, opt.accountsSecret, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if len(secret.Data) == 0 {
+		return nil, fmt.Errorf("no account found in secret %s/%s", appBinding.Namespace, opt.accountsSecret)
+	}
+	return secret.Data, nil
+}
+
+// selectAccounts returns the accounts listed in --accounts, or all the available accounts if none is listed
+func (opt *natsOptions) selectAccounts(available []string) ([]string, error) {
+	sort.Strings(available)
+	if len(opt.accounts) == 0 {
+		return available, nil
+	}
+	for _, account := range opt.accounts {
+		if !streamExists(account, available) {
+			return nil, fmt.Errorf("account %s not found", account)
+		}
+	}
+	return opt.accounts, nil
+}
+
+// newAccountSession connects to the server as the given account.
+// The account credentials replace the authentication settings of the app binding, while its TLS settings,
+// including the client certificate, are kept.
+func (opt *natsOptions) newAccountSession(appBinding *appcatalog.AppBinding, account string, creds []byte) (*sessionWrapper, error) {
+	session := opt.newSessionWrapper()
+
+	if err := opt.setNATSClientCertificate(session.sh, appBinding); err != nil {
+		return nil, err
+	}
+	credsFile := filepath.Join(opt.credentialsDir, fmt.Sprintf(NATSAccountCredsFile, account))
+	if err := writeCredentialFile(credsFile, creds); err != nil {
+		return nil, err
+	}
+	session.sh.SetEnv(EnvNATSCreds, credsFile)
+
+	if err := session.setNATSConnectionParameters(appBinding); err != nil {
+		return nil, err
+	}
+	if err := session.setTLSParameters(appBinding, opt.credentialsDir); err != nil {
+		return nil, err
+	}
+	if err := session.waitForNATSReady(opt.warningThreshold, opt.waitDuration()); err != nil {
+		return nil, fmt.Errorf("failed to connect as account %s: %w", account, err)
+	}
+	return session, nil
+}
+
+// accountOptions returns a copy of the options that stores the data of the account in its own directory
+func (opt *natsOptions) accountOptions(account string) *natsOptions {
+	accOpt := *opt
+	accOpt.interimDataDir = filepath.Join(opt.interimDataDir, NATSAccountsDir, account)
+	accOpt.resolvedStreams = nil
+	accOpt.account = account
+	return &accOpt
+}
+
+// recordResolvedStreams adds the streams resolved for an account to the output, prefixed by the account name
+func (opt *natsOptions) recordResolvedStreams(account string, accOpt *natsOptions) {
+	for _, stream := range accOpt.resolvedStreams {
+		opt.resolvedStreams = append(opt.resolvedStreams, account+"/"+stream)
+	}
+}
+
+// backupAccounts backs up every selected account of the accounts secret into a single snapshot.
+// The data of each account is stored under accounts/<account> of the interim data dir.
+func (opt *natsOptions) backupAccounts(appBinding *appcatalog.AppBinding, targetRef api_v1beta1.TargetRef) (*restic.BackupOutput, error) {
+	if opt.incremental || opt.streamToRestic {
+		return nil, fmt.Errorf("--accounts-secret can not be used along with --incremental or --stream-to-restic")
+	}
+
+	credentials, err := opt.getAccountCredentials(appBinding)
+	if err != nil {
+		return nil, err
+	}
+	available := make([]string, 0, len(credentials))
+	for account := range credentials {
+		available = append(available, account)
+	}
+	accounts, err := opt.selectAccounts(available)
+	if err != nil {
+		return nil, err
+	}
+
+	resticWrapper, err := opt.newResticWrapper()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, account := range accounts {
+		klog.Infoln("Backing up account: ", account)
+		session, err := opt.newAccountSession(appBinding, account, credentials[account])
+		if err != nil {
+			return nil, err
+		}
+		accOpt := opt.accountOptions(account)
+		if err := os.MkdirAll(accOpt.interimDataDir, os.ModePerm); err != nil {
+			session.close()
+			return nil, err
+		}
+		err = accOpt.resolveServerStreams(session)
+		if err == nil {
+			err = accOpt.dumpData(session, resticWrapper)
+		}
+		session.close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to backup account %s: %w", account, err)
+		}
+		opt.recordResolvedStreams(account, accOpt)
+	}
+
+	return opt.backupInterimData(resticWrapper, targetRef)
+}
+
+// restoreAccounts restores every selected account found in the snapshot using the credentials of the accounts secret
+func (opt *natsOptions) restoreAccounts(appBinding *appcatalog.AppBinding, rp *restorePoint, targetRef api_v1beta1.TargetRef) (*restic.RestoreOutput, error) {
+	if opt.streamFromRestic {
+		return nil, fmt.Errorf("--accounts-secret can not be used along with --stream-from-restic")
+	}
+
+	credentials, err := opt.getAccountCredentials(appBinding)
+	if err != nil {
+		return nil, err
+	}
+
+	// we will restore the desired data into the interim data dir before restoring the accounts
+	opt.restoreOptions.RestorePaths = []string{opt.interimDataDir}
+
+	resticWrapper, err := opt.newResticWrapper()
+	if err != nil {
+		return nil, err
+	}
+	restoreOutput, err := resticWrapper.RunRestore(opt.restoreOptions, targetRef)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(filepath.Join(opt.interimDataDir, NATSAccountsDir))
+	if err != nil {
+		return nil, fmt.Errorf("no account found in the snapshot: %w", err)
+	}
+	var available []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			available = append(available, entry.Name())
+		}
+	}
+	accounts, err := opt.selectAccounts(available)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, account := range accounts {
+		creds, ok := credentials[account]
+		if !ok {
+			return nil, fmt.Errorf("no credentials found for account %s in secret %s/%s", account, appBinding.Namespace, opt.accountsSecret)
+		}
+		klog.Infoln("Restoring account: ", account)
+		session, err := opt.newAccountSession(appBinding, account, creds)
+		if err != nil {
+			return nil, err
+		}
+		accOpt := opt.accountOptions(account)
+		err = accOpt.restoreData(session, rp)
+		session.close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore account %s: %w", account, err)
+		}
+		opt.recordResolvedStreams(account, accOpt)
+	}
+	return restoreOutput, nil
+}
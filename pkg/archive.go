@@ -0,0 +1,330 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/s2"
+)
+
+// Layout of a message record in a JetStream file store message block:
+//
+//	uint32 record length (highest bit is set when the message has headers)
+//	uint64 sequence (highest bits mark erased messages and tombstones)
+//	int64  timestamp in unix nanoseconds
+//	uint16 subject length
+//	subject
+//	uint32 header length and headers (only when the message has headers)
+//	payload
+//	8 bytes checksum
+const (
+	msgHdrSize   = 22
+	checksumSize = 8
+	hbit         = 1 << 31
+	ebit         = 1 << 63
+	tbit         = 1 << 62
+)
+
+// msgRecord is the header of a single record of a message block
+type msgRecord struct {
+	seq       uint64
+	ts        int64
+	size      int
+	erased    bool
+	tombstone bool
+}
+
+// blockScan is the result of scanning a message block against a restore point
+type blockScan struct {
+	index int
+	// cut is the offset of the first record beyond the restore point, or -1 if the whole block is kept
+	cut     int
+	msgs    uint64
+	bytes   uint64
+	lastSeq uint64
+	lastTs  int64
+}
+
+// truncateStreamSnapshot cuts the snapshot of a stream stored in dir at the restore point.
+// The records beyond the restore point are removed from the message blocks and the blocks
+// that follow them are dropped. The stream index is dropped too, so the server rebuilds the
+// stream state from the remaining blocks while restoring the snapshot.
+func truncateStreamSnapshot(dir string, rp *restorePoint, encryption *archiveEncryption) error {
+	scans, err := scanSnapshotBlocks(dir, rp, encryption)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot in %s: %v", dir, err)
+	}
+
+	var (
+		cutIndex = -1
+		total    blockScan
+		keep     = map[int]int{}
+	)
+	for _, scan := range scans {
+		if cutIndex >= 0 {
+			keep[scan.index] = 0
+			continue
+		}
+		keep[scan.index] = scan.cut
+		total.msgs += scan.msgs
+		total.bytes += scan.bytes
+		if scan.lastSeq > 0 {
+			total.lastSeq = scan.lastSeq
+			total.lastTs = scan.lastTs
+		}
+		if scan.cut >= 0 {
+			cutIndex = scan.index
+		}
+	}
+	if cutIndex < 0 {
+		// every message of the snapshot is within the restore point
+		return nil
+	}
+
+	if hasSnapshotBlocks(dir) {
+		if err := truncateSnapshotBlocks(filepath.Join(dir, NATSSnapshotBlocksDir), keep); err != nil {
+			return fmt.Errorf("failed to truncate snapshot in %s: %v", dir, err)
+		}
+		return updateSnapshotState(filepath.Join(dir, NATSSnapshotMetaFile), total)
+	}
+
+	src := filepath.Join(dir, NATSSnapshotDataFile)
+	tmp := src + ".tmp"
+	if err := rewriteSnapshot(src, tmp, keep, encryption); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to truncate snapshot %s: %v", src, err)
+	}
+	if err := os.Rename(tmp, src); err != nil {
+		return err
+	}
+	return updateSnapshotState(filepath.Join(dir, NATSSnapshotMetaFile), total)
+}
+
+// scanSnapshotBlocks returns the scan result of every message block of the snapshot stored in dir ordered by block index
+func scanSnapshotBlocks(dir string, rp *restorePoint, encryption *archiveEncryption) ([]blockScan, error) {
+	var scans []blockScan
+	err := forEachSnapshotEntry(dir, encryption, func(name string, r io.Reader) error {
+		if strings.HasSuffix(name, ".key") {
+			return fmt.Errorf("snapshot of an encrypted stream is not supported")
+		}
+		index, ok := msgBlockIndex(name)
+		if !ok {
+			return nil
+		}
+		buf, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		scan, err := scanMsgBlock(buf, rp)
+		if err != nil {
+			return fmt.Errorf("failed to parse message block %s: %v", name, err)
+		}
+		scan.index = index
+		scans = append(scans, *scan)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(scans, func(i, j int) bool {
+		return scans[i].index < scans[j].index
+	})
+	return scans, nil
+}
+
+// scanMsgBlock finds the first record of the block beyond the restore point and counts the messages before it.
+// The checksums of the records are not verified here, as they are keyed by the server. The records are kept
+// byte for byte, so the server still detects a corrupted record while restoring the snapshot.
+func scanMsgBlock(buf []byte, rp *restorePoint) (*blockScan, error) {
+	scan := &blockScan{cut: -1}
+	for offset := 0; offset < len(buf); {
+		rec, err := parseMsgRecord(buf[offset:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid record at offset %d, the block may be compressed or encrypted: %v", offset, err)
+		}
+		if rp.exceeded(rec) {
+			scan.cut = offset
+			return scan, nil
+		}
+		if !rec.erased && !rec.tombstone {
+			scan.msgs++
+			scan.bytes += uint64(rec.size)
+			scan.lastSeq = rec.seq
+			scan.lastTs = rec.ts
+		}
+		offset += rec.size
+	}
+	return scan, nil
+}
+
+func parseMsgRecord(buf []byte) (*msgRecord, error) {
+	if len(buf) < msgHdrSize {
+		return nil, fmt.Errorf("short record header")
+	}
+	le := binary.LittleEndian
+	rl := le.Uint32(buf[0:])
+	hasHeaders := rl&hbit != 0
+	rl &^= hbit
+	seq := le.Uint64(buf[4:])
+	slen := int(le.Uint16(buf[20:]))
+
+	minSize := msgHdrSize + slen + checksumSize
+	if hasHeaders {
+		minSize += 4
+	}
+	if int(rl) < minSize || int(rl) > len(buf) {
+		return nil, fmt.Errorf("record length %d is out of range", rl)
+	}
+	return &msgRecord{
+		seq:       seq &^ (ebit | tbit),
+		ts:        int64(le.Uint64(buf[12:])),
+		size:      int(rl),
+		erased:    seq&ebit != 0,
+		tombstone: seq&tbit != 0,
+	}, nil
+}
+
+// rewriteSnapshot copies the snapshot from src to dst keeping only the given number of bytes of every message block.
+// A block is kept as is when it is mapped to a negative length.
+func rewriteSnapshot(src, dst string, keep map[int]int, encryption *archiveEncryption) error {
+	in, err := encryption.open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := encryption.create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	zw := s2.NewWriter(out)
+	tw := tar.NewWriter(zw)
+	tr := tar.NewReader(s2.NewReader(in))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if isMsgIndexFile(hdr.Name) {
+			// the stream state will be rebuilt from the blocks
+			continue
+		}
+
+		var data io.Reader = tr
+		if index, ok := msgBlockIndex(hdr.Name); ok {
+			n := keep[index]
+			if n == 0 {
+				continue
+			}
+			if n > 0 {
+				buf := make([]byte, n)
+				if _, err := io.ReadFull(tr, buf); err != nil {
+					return err
+				}
+				hdr.Size = int64(n)
+				data = bytes.NewReader(buf)
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// updateSnapshotState updates the stream state recorded in the snapshot metadata after the snapshot has been truncated
+func updateSnapshotState(file string, total blockScan) error {
+	byteInfo, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	info := map[string]any{}
+	dec := json.NewDecoder(bytes.NewReader(byteInfo))
+	dec.UseNumber()
+	if err := dec.Decode(&info); err != nil {
+		return err
+	}
+	state, ok := info["state"].(map[string]any)
+	if !ok {
+		state = map[string]any{}
+	}
+	state["messages"] = total.msgs
+	state["bytes"] = total.bytes
+	state["last_seq"] = total.lastSeq
+	if total.lastSeq > 0 {
+		state["last_ts"] = time.Unix(0, total.lastTs).UTC()
+	}
+	delete(state, "num_deleted")
+	delete(state, "deleted")
+	info["state"] = state
+
+	byteInfo, err = json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, byteInfo, 0o644)
+}
+
+// msgBlockIndex returns the index of the block if the file is a message block (msgs/<index>.blk)
+func msgBlockIndex(name string) (int, bool) {
+	dir, file := path.Split(path.Clean(name))
+	if path.Base(dir) != "msgs" || !strings.HasSuffix(file, ".blk") {
+		return 0, false
+	}
+	index, err := strconv.Atoi(strings.TrimSuffix(file, ".blk"))
+	if err != nil {
+		return 0, false
+	}
+	return index, true
+}
+
+// isMsgIndexFile reports whether the file holds an index of the message blocks that is invalidated by truncation
+func isMsgIndexFile(name string) bool {
+	dir, file := path.Split(path.Clean(name))
+	if path.Base(dir) != "msgs" {
+		return false
+	}
+	return file == "index.db" || strings.HasSuffix(file, ".idx") || strings.HasSuffix(file, ".fss")
+}
@@ -0,0 +1,446 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/s2"
+)
+
+var archiveTestTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// testMsgRecord builds a record of a file store message block. The checksum is filled with a fixed pattern,
+// which the server would reject, as the scan does not verify it.
+func testMsgRecord(seq uint64, ts time.Time, subject string, hdr, msg []byte) []byte {
+	rl := msgHdrSize + len(subject) + len(msg) + checksumSize
+	if hdr != nil {
+		rl += 4 + len(hdr)
+	}
+	le := binary.LittleEndian
+	buf := make([]byte, msgHdrSize, rl)
+	length := uint32(rl)
+	if hdr != nil {
+		length |= hbit
+	}
+	le.PutUint32(buf[0:], length)
+	le.PutUint64(buf[4:], seq)
+	le.PutUint64(buf[12:], uint64(ts.UnixNano()))
+	le.PutUint16(buf[20:], uint16(len(subject)))
+	buf = append(buf, subject...)
+	if hdr != nil {
+		buf = le.AppendUint32(buf, uint32(len(hdr)))
+		buf = append(buf, hdr...)
+	}
+	buf = append(buf, msg...)
+	return append(buf, bytes.Repeat([]byte{0xab}, checksumSize)...)
+}
+
+func testMsgBlock(records ...[]byte) []byte {
+	return bytes.Join(records, nil)
+}
+
+func TestParseMsgRecord(t *testing.T) {
+	plain := testMsgRecord(7, archiveTestTime, "orders.new", nil, []byte("hello"))
+	withHeaders := testMsgRecord(8, archiveTestTime, "orders.new", []byte("NATS/1.0\r\nk: v\r\n\r\n"), []byte("hello"))
+	cases := []struct {
+		name     string
+		buf      []byte
+		expected *msgRecord
+		errMsg   string
+	}{
+		{
+			name:     "message",
+			buf:      plain,
+			expected: &msgRecord{seq: 7, ts: archiveTestTime.UnixNano(), size: len(plain)},
+		},
+		{
+			name:     "message with headers",
+			buf:      withHeaders,
+			expected: &msgRecord{seq: 8, ts: archiveTestTime.UnixNano(), size: len(withHeaders)},
+		},
+		{
+			name:     "followed by another record",
+			buf:      testMsgBlock(plain, withHeaders),
+			expected: &msgRecord{seq: 7, ts: archiveTestTime.UnixNano(), size: len(plain)},
+		},
+		{
+			name:     "erased message",
+			buf:      testMsgRecord(7|ebit, archiveTestTime, "orders.new", nil, []byte("hello")),
+			expected: &msgRecord{seq: 7, ts: archiveTestTime.UnixNano(), size: len(plain), erased: true},
+		},
+		{
+			name:     "tombstone",
+			buf:      testMsgRecord(7|tbit, archiveTestTime, "", nil, nil),
+			expected: &msgRecord{seq: 7, ts: archiveTestTime.UnixNano(), size: msgHdrSize + checksumSize, tombstone: true},
+		},
+		{
+			name:   "truncated record",
+			buf:    plain[:len(plain)-1],
+			errMsg: "out of range",
+		},
+		{
+			name:   "truncated record header",
+			buf:    plain[:msgHdrSize-1],
+			errMsg: "short record header",
+		},
+		{
+			name: "record length below the subject and the checksum",
+			buf: func() []byte {
+				buf := bytes.Clone(plain)
+				binary.LittleEndian.PutUint32(buf, msgHdrSize+checksumSize)
+				return buf
+			}(),
+			errMsg: "out of range",
+		},
+		{
+			name:   "compressed block",
+			buf:    s2.Encode(nil, plain),
+			errMsg: "out of range",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec, err := parseMsgRecord(tc.buf)
+			if tc.errMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.errMsg) {
+					t.Fatalf("expected error containing %q, got %v", tc.errMsg, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rec, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, rec)
+			}
+		})
+	}
+}
+
+func TestScanMsgBlock(t *testing.T) {
+	at := func(seconds int) time.Time { return archiveTestTime.Add(time.Duration(seconds) * time.Second) }
+	rec1 := testMsgRecord(1, at(1), "orders.new", nil, []byte("one"))
+	rec2 := testMsgRecord(2|ebit, at(2), "orders.new", nil, []byte("two"))
+	rec3 := testMsgRecord(3, at(3), "orders.paid", []byte("NATS/1.0\r\nk: v\r\n\r\n"), []byte("three"))
+	// the tombstone of message 1 has been written after message 3
+	tomb := testMsgRecord(1|tbit, at(4), "", nil, nil)
+	rec5 := testMsgRecord(5, at(5), "orders.new", nil, []byte("five"))
+	block := testMsgBlock(rec1, rec2, rec3, tomb, rec5)
+	offset := func(records ...[]byte) int { return len(testMsgBlock(records...)) }
+
+	badChecksum := bytes.Clone(block)
+	copy(badChecksum[len(rec1)-checksumSize:len(rec1)], "corrupt!")
+
+	cases := []struct {
+		name     string
+		block    []byte
+		rp       *restorePoint
+		expected blockScan
+		errMsg   string
+	}{
+		{
+			name:     "no restore point",
+			block:    block,
+			expected: blockScan{cut: -1, msgs: 3, bytes: uint64(len(rec1) + len(rec3) + len(rec5)), lastSeq: 5, lastTs: at(5).UnixNano()},
+		},
+		{
+			name:     "sequence within the block",
+			block:    block,
+			rp:       &restorePoint{seq: 3},
+			expected: blockScan{cut: offset(rec1, rec2, rec3, tomb), msgs: 2, bytes: uint64(len(rec1) + len(rec3)), lastSeq: 3, lastTs: at(3).UnixNano()},
+		},
+		{
+			name:     "time within the block",
+			block:    block,
+			rp:       &restorePoint{time: at(3)},
+			expected: blockScan{cut: offset(rec1, rec2, rec3), msgs: 2, bytes: uint64(len(rec1) + len(rec3)), lastSeq: 3, lastTs: at(3).UnixNano()},
+		},
+		{
+			name:     "erased message beyond the restore point",
+			block:    block,
+			rp:       &restorePoint{seq: 1},
+			expected: blockScan{cut: offset(rec1), msgs: 1, bytes: uint64(len(rec1)), lastSeq: 1, lastTs: at(1).UnixNano()},
+		},
+		{
+			name:     "restore point before the first message",
+			block:    block,
+			rp:       &restorePoint{time: at(0)},
+			expected: blockScan{cut: 0},
+		},
+		{
+			name:     "restore point after the last message",
+			block:    block,
+			rp:       &restorePoint{seq: 100},
+			expected: blockScan{cut: -1, msgs: 3, bytes: uint64(len(rec1) + len(rec3) + len(rec5)), lastSeq: 5, lastTs: at(5).UnixNano()},
+		},
+		{
+			name:     "restore point on the last message",
+			block:    block,
+			rp:       &restorePoint{time: at(5)},
+			expected: blockScan{cut: -1, msgs: 3, bytes: uint64(len(rec1) + len(rec3) + len(rec5)), lastSeq: 5, lastTs: at(5).UnixNano()},
+		},
+		{
+			name:     "bad checksum",
+			block:    badChecksum,
+			rp:       &restorePoint{seq: 3},
+			expected: blockScan{cut: offset(rec1, rec2, rec3, tomb), msgs: 2, bytes: uint64(len(rec1) + len(rec3)), lastSeq: 3, lastTs: at(3).UnixNano()},
+		},
+		{
+			name:   "truncated record",
+			block:  block[:len(block)-1],
+			errMsg: "invalid record at offset " + strconv.Itoa(offset(rec1, rec2, rec3, tomb)),
+		},
+		{
+			name:     "empty block",
+			expected: blockScan{cut: -1},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			scan, err := scanMsgBlock(tc.block, tc.rp)
+			if tc.errMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.errMsg) {
+					t.Fatalf("expected error containing %q, got %v", tc.errMsg, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*scan, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, *scan)
+			}
+		})
+	}
+}
+
+// testSnapshotEntry is a file of the snapshot data (tar.s2) of a stream
+type testSnapshotEntry struct {
+	name string
+	data []byte
+}
+
+func writeTestSnapshot(t *testing.T, file string, entries ...testSnapshotEntry) {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := s2.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for _, entry := range entries {
+		hdr := &tar.Header{Typeflag: tar.TypeReg, Name: entry.name, Mode: 0o644, Size: int64(len(entry.data))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(entry.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestSnapshot(t *testing.T, file string) []testSnapshotEntry {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []testSnapshotEntry
+	tr := tar.NewReader(s2.NewReader(f))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(data)) != hdr.Size {
+			t.Fatalf("entry %s has %d bytes, its header says %d", hdr.Name, len(data), hdr.Size)
+		}
+		entries = append(entries, testSnapshotEntry{name: hdr.Name, data: data})
+	}
+}
+
+func TestRewriteSnapshot(t *testing.T) {
+	block1 := testMsgBlock(
+		testMsgRecord(1, archiveTestTime, "orders.new", nil, []byte("one")),
+		testMsgRecord(2, archiveTestTime, "orders.new", nil, []byte("two")),
+	)
+	block2 := testMsgRecord(3, archiveTestTime, "orders.new", nil, []byte("three"))
+	meta := []byte(`{"name":"orders"}`)
+	entries := []testSnapshotEntry{
+		{"meta.inf", meta},
+		{"msgs/1.blk", block1},
+		{"msgs/1.idx", []byte("index")},
+		{"msgs/2.blk", block2},
+		{"msgs/index.db", []byte("index")},
+		{"obs/orders/o.dat", []byte("consumer")},
+	}
+	cut := len(block1) - len(block2)
+
+	cases := []struct {
+		name     string
+		keep     map[int]int
+		expected []testSnapshotEntry
+	}{
+		{
+			name: "cut within a block",
+			keep: map[int]int{1: cut, 2: 0},
+			expected: []testSnapshotEntry{
+				{"meta.inf", meta},
+				{"msgs/1.blk", block1[:cut]},
+				{"obs/orders/o.dat", []byte("consumer")},
+			},
+		},
+		{
+			name: "cut on a block boundary",
+			keep: map[int]int{1: -1, 2: 0},
+			expected: []testSnapshotEntry{
+				{"meta.inf", meta},
+				{"msgs/1.blk", block1},
+				{"obs/orders/o.dat", []byte("consumer")},
+			},
+		},
+		{
+			name: "nothing kept",
+			keep: map[int]int{1: 0, 2: 0},
+			expected: []testSnapshotEntry{
+				{"meta.inf", meta},
+				{"obs/orders/o.dat", []byte("consumer")},
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+			writeTestSnapshot(t, src, entries...)
+			if err := rewriteSnapshot(src, dst, tc.keep, nil); err != nil {
+				t.Fatal(err)
+			}
+			if got := readTestSnapshot(t, dst); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestTruncateStreamSnapshot(t *testing.T) {
+	at := func(seconds int) time.Time { return archiveTestTime.Add(time.Duration(seconds) * time.Second) }
+	rec1 := testMsgRecord(1, at(1), "orders.new", nil, []byte("one"))
+	rec2 := testMsgRecord(2, at(2), "orders.new", nil, []byte("two"))
+	rec3 := testMsgRecord(3, at(3), "orders.new", nil, []byte("three"))
+	entries := []testSnapshotEntry{
+		{"msgs/1.blk", testMsgBlock(rec1, rec2)},
+		{"msgs/2.blk", rec3},
+	}
+	cases := []struct {
+		name     string
+		rp       *restorePoint
+		expected []testSnapshotEntry
+		lastSeq  string
+		msgs     string
+	}{
+		{
+			name:     "cut within a block",
+			rp:       &restorePoint{seq: 1},
+			expected: []testSnapshotEntry{{"msgs/1.blk", rec1}},
+			lastSeq:  "1",
+			msgs:     "1",
+		},
+		{
+			name:     "cut on a block boundary",
+			rp:       &restorePoint{time: at(2)},
+			expected: []testSnapshotEntry{{"msgs/1.blk", testMsgBlock(rec1, rec2)}},
+			lastSeq:  "2",
+			msgs:     "2",
+		},
+		{
+			name:     "before the first message",
+			rp:       &restorePoint{time: at(0)},
+			expected: nil,
+			lastSeq:  "0",
+			msgs:     "0",
+		},
+		{
+			name:     "after the last message",
+			rp:       &restorePoint{seq: 10},
+			expected: entries,
+			lastSeq:  "3",
+			msgs:     "3",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestSnapshot(t, filepath.Join(dir, NATSSnapshotDataFile), entries...)
+			meta := []byte(`{"config":{"name":"orders"},"state":{"messages":3,"bytes":1,"last_seq":3,"num_deleted":1}}`)
+			if err := os.WriteFile(filepath.Join(dir, NATSSnapshotMetaFile), meta, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := truncateStreamSnapshot(dir, tc.rp, nil); err != nil {
+				t.Fatal(err)
+			}
+			if got := readTestSnapshot(t, filepath.Join(dir, NATSSnapshotDataFile)); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+
+			byteMeta, err := os.ReadFile(filepath.Join(dir, NATSSnapshotMetaFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			info := struct {
+				State map[string]any `json:"state"`
+			}{}
+			dec := json.NewDecoder(bytes.NewReader(byteMeta))
+			dec.UseNumber()
+			if err := dec.Decode(&info); err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(info.State["last_seq"]) != tc.lastSeq || fmt.Sprint(info.State["messages"]) != tc.msgs {
+				t.Errorf("expected last sequence %s and %s messages, got %v", tc.lastSeq, tc.msgs, info.State)
+			}
+		})
+	}
+}
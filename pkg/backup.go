@@ -19,8 +19,10 @@ package pkg
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
 	stash "stash.appscode.dev/apimachinery/client/clientset/versioned"
@@ -30,7 +32,6 @@ import (
 	"github.com/spf13/cobra"
 	license "go.bytebuilders.dev/license-verifier/kubernetes"
 	"gomodules.xyz/flags"
-	shell "gomodules.xyz/go-sh"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
@@ -45,8 +46,13 @@ func NewCmdBackup() *cobra.Command {
 		masterURL      string
 		kubeconfigPath string
 		opt            = natsOptions{
-			waitTimeout:      300,
-			warningThreshold: "30s",
+			waitTimeout:         300,
+			warningThreshold:    "30s",
+			maxIncrementalChain: 24,
+			maxConcurrency:      1,
+			snapshotLayout:      SnapshotLayoutArchive,
+			metricsJob:          "stash-nats-backup",
+			streamResults:       &streamResults{},
 			setupOptions: restic.SetupOptions{
 				ScratchDir:  restic.DefaultScratchDir,
 				EnableCache: false,
@@ -64,6 +70,12 @@ func NewCmdBackup() *cobra.Command {
 		RunE: func(cmd *cobra.Command, args []string) error {
 			flags.EnsureRequiredFlags(cmd, "appbinding", "provider", "storage-secret-name", "storage-secret-namespace")
 
+			// cancelled when the pod is terminated, so that a partial run still reports its failure
+			ctx, cancel := newRunContext(cmd)
+			defer cancel()
+			opt.ctx = ctx
+			startTime := time.Now()
+
 			// prepare client
 			config, err := clientcmd.BuildConfigFromFlags(masterURL, kubeconfigPath)
 			if err != nil {
@@ -91,7 +103,16 @@ func NewCmdBackup() *cobra.Command {
 			}
 			var backupOutput *restic.BackupOutput
 			backupOutput, err = opt.backupNATS(targetRef)
-			if err != nil {
+			if err == nil {
+				// the snapshot has been taken, but it misses the failed streams. Stash sees the backup as failed,
+				// while the snapshot is kept and the succeeded streams can be restored from it.
+				if ferr := opt.streamResults.partialOutcomeError(); ferr != nil {
+					for i := range backupOutput.BackupTargetStatus.Stats {
+						backupOutput.BackupTargetStatus.Stats[i].Phase = api_v1beta1.HostBackupFailed
+						backupOutput.BackupTargetStatus.Stats[i].Error = ferr.Error()
+					}
+				}
+			} else {
 				backupOutput = &restic.BackupOutput{
 					BackupTargetStatus: api_v1beta1.BackupTargetStatus{
 						Ref: targetRef,
@@ -105,15 +126,24 @@ func NewCmdBackup() *cobra.Command {
 					},
 				}
 			}
+			opt.pushMetrics(MetricsOperationBackup, err, startTime)
+			opt.events.completed(context.WithoutCancel(ctx), opt.streamResults.overallPhase(err), err, opt.streamResults.list())
+
 			// If output directory specified, then write the output in "output.json" file in the specified directory
 			if opt.outputDir != "" {
-				return backupOutput.WriteOutput(filepath.Join(opt.outputDir, restic.DefaultOutputFileName))
+				return opt.writeOutput(natsBackupOutput{
+					BackupOutput:  *backupOutput,
+					Phase:         opt.streamResults.overallPhase(err),
+					Streams:       opt.resolvedStreams,
+					StreamResults: opt.streamResults.list(),
+				})
 			}
 			return nil
 		},
 	}
 
 	cmd.Flags().StringVar(&opt.natsArgs, "nats-args", opt.natsArgs, "Additional arguments")
+	_ = cmd.Flags().MarkDeprecated("nats-args", "the nats CLI is not used anymore, so the value is ignored")
 	cmd.Flags().Int32Var(&opt.waitTimeout, "wait-timeout", opt.waitTimeout, "Time limit to wait for the database to be ready")
 	cmd.Flags().StringVar(&opt.warningThreshold, "warning-threshold", opt.warningThreshold, "Warning threshold to allow for establishing connections")
 
@@ -125,6 +155,9 @@ func NewCmdBackup() *cobra.Command {
 	cmd.Flags().StringVar(&opt.appBindingNamespace, "appbinding-namespace", opt.appBindingNamespace, "Namespace of the app binding")
 	cmd.Flags().StringVar(&opt.storageSecret.Name, "storage-secret-name", opt.storageSecret.Name, "Name of the storage secret")
 	cmd.Flags().StringVar(&opt.storageSecret.Namespace, "storage-secret-namespace", opt.storageSecret.Namespace, "Namespace of the storage secret")
+	cmd.Flags().StringVar(&opt.encryptionSecret.Name, "encryption-secret-name", opt.encryptionSecret.Name, "Name of the secret holding the keys to encrypt the stream archives with before they are stored in the interim data dir. Each key must be 32 bytes long and it is identified by its name. Only the archive layout is encrypted: it can not be used along with --stream-to-restic, --snapshot-layout=blocks or --object-buckets, as those store the data unencrypted")
+	cmd.Flags().StringVar(&opt.encryptionSecret.Namespace, "encryption-secret-namespace", opt.encryptionSecret.Namespace, "Namespace of the encryption secret")
+	cmd.Flags().StringVar(&opt.encryptionKeyID, "encryption-key-id", opt.encryptionKeyID, "Name of the key of the encryption secret to use. Required when the secret holds more than one key")
 
 	cmd.Flags().StringVar(&opt.setupOptions.Provider, "provider", opt.setupOptions.Provider, "Backend provider (i.e. gcs, s3, azure etc)")
 	cmd.Flags().StringVar(&opt.setupOptions.Bucket, "bucket", opt.setupOptions.Bucket, "Name of the cloud bucket/container (keep empty for local backend)")
@@ -148,8 +181,29 @@ func NewCmdBackup() *cobra.Command {
 	cmd.Flags().BoolVar(&opt.backupOptions.RetentionPolicy.DryRun, "retention-dry-run", opt.backupOptions.RetentionPolicy.DryRun, "Specify whether to test retention policy without deleting actual data")
 
 	cmd.Flags().StringVar(&opt.interimDataDir, "interim-data-dir", opt.interimDataDir, "Directory where the targeted data will be stored temporarily before uploading to the backend")
+	cmd.Flags().StringVar(&opt.pushgatewayURL, "pushgateway-url", opt.pushgatewayURL, "URL of a Pushgateway compatible endpoint to push the metrics of the run to (keep empty to push no metric)")
+	cmd.Flags().StringVar(&opt.metricsJob, "metrics-job", opt.metricsJob, "Job name to push the metrics with")
+	cmd.Flags().StringVar(&opt.pushgatewayCAFile, "pushgateway-ca-file", opt.pushgatewayCAFile, "Path of the CA bundle to verify the certificate of the Pushgateway with")
+	cmd.Flags().StringVar(&opt.pushgatewayCertFile, "pushgateway-cert-file", opt.pushgatewayCertFile, "Path of the client certificate to authenticate to the Pushgateway with")
+	cmd.Flags().StringVar(&opt.pushgatewayKeyFile, "pushgateway-key-file", opt.pushgatewayKeyFile, "Path of the key of the client certificate of the Pushgateway")
+	cmd.Flags().BoolVar(&opt.pushgatewayInsecureSkipVerify, "pushgateway-insecure-skip-verify", opt.pushgatewayInsecureSkipVerify, "Specify whether to skip the verification of the certificate of the Pushgateway")
+	cmd.Flags().StringVar(&opt.pushgatewayUsername, "pushgateway-username", opt.pushgatewayUsername, "Username for the basic authentication to the Pushgateway")
+	cmd.Flags().StringVar(&opt.pushgatewayPasswordFile, "pushgateway-password-file", opt.pushgatewayPasswordFile, "Path of the file holding the password for the basic authentication to the Pushgateway")
+	cmd.Flags().StringVar(&opt.pushgatewayBearerTokenFile, "pushgateway-bearer-token-file", opt.pushgatewayBearerTokenFile, "Path of the file holding the bearer token to authenticate to the Pushgateway with. It can not be combined with the basic authentication")
 	cmd.Flags().StringVar(&opt.outputDir, "output-dir", opt.outputDir, "Directory where output.json file will be written (keep empty if you don't need to write output in file)")
 	cmd.Flags().StringSliceVar(&opt.streams, "streams", opt.streams, "List of streams to backup. Keep empty to backup all streams")
+	cmd.Flags().StringSliceVar(&opt.includeStreams, "include-streams", opt.includeStreams, "Backup the streams matching these glob patterns, or regular expressions enclosed in slashes (i.e. /^orders-.*$/)")
+	cmd.Flags().StringSliceVar(&opt.excludeStreams, "exclude-streams", opt.excludeStreams, "Skip the streams matching these glob patterns, or regular expressions enclosed in slashes")
+	cmd.Flags().StringVar(&opt.accountsSecret, "accounts-secret", opt.accountsSecret, "Name of the secret in the namespace of the app binding holding the credentials (creds file) of each account to backup, keyed by the account name")
+	cmd.Flags().StringSliceVar(&opt.accounts, "accounts", opt.accounts, "List of accounts of the accounts secret to backup. Keep empty to backup all the accounts")
+	cmd.Flags().StringSliceVar(&opt.kvBuckets, "kv-buckets", opt.kvBuckets, "List of Key-Value buckets to backup along with their settings. If no stream or bucket is specified, all streams are backed up")
+	cmd.Flags().BoolVar(&opt.incremental, "incremental", opt.incremental, "Specify whether to backup only the messages published to the streams after the previous backup. The messages of the increments are republished on restore, so they get new sequences and timestamps. Mirror and sourced streams are always backed up in full")
+	cmd.Flags().IntVar(&opt.maxIncrementalChain, "max-incremental-chain", opt.maxIncrementalChain, "Maximum number of incremental backups taken on top of a full backup of a stream. Keep it 0 for no limit. The retention policy must keep all the snapshots of a chain")
+	cmd.Flags().BoolVar(&opt.continueOnError, "continue-on-error", opt.continueOnError, "Specify whether to keep backing up the remaining streams when a stream fails. The failed streams are left out of the snapshot and the backup is reported to Stash as failed")
+	cmd.Flags().IntVar(&opt.maxConcurrency, "max-concurrency", opt.maxConcurrency, "Maximum number of streams to backup at the same time")
+	cmd.Flags().BoolVar(&opt.streamToRestic, "stream-to-restic", opt.streamToRestic, "Specify whether to pipe the snapshot of each stream directly into restic instead of storing it in the interim data directory first. The piped snapshots are not encrypted, so it can not be used along with --encryption-secret-name")
+	cmd.Flags().StringVar(&opt.snapshotLayout, "snapshot-layout", opt.snapshotLayout, "Layout of the stream snapshots in the interim data dir. One of archive (compressed tarball) or blocks (uncompressed message blocks, which restic deduplicates across backups). The blocks layout is not encrypted, so it can not be used along with --encryption-secret-name")
+	cmd.Flags().StringSliceVar(&opt.objectBuckets, "object-buckets", opt.objectBuckets, "List of Object Store buckets to backup. Each object is stored unencrypted as a separate file along with its metadata, so it can not be used along with --encryption-secret-name")
 	return cmd
 }
 
@@ -160,11 +214,24 @@ func (opt *natsOptions) backupNATS(targetRef api_v1beta1.TargetRef) (*restic.Bac
 		return nil, err
 	}
 
-	opt.setupOptions.StorageSecret, err = opt.kubeClient.CoreV1().Secrets(opt.storageSecret.Namespace).Get(context.TODO(), opt.storageSecret.Name, metav1.GetOptions{})
+	opt.setupOptions.StorageSecret, err = opt.kubeClient.CoreV1().Secrets(opt.storageSecret.Namespace).Get(opt.ctx, opt.storageSecret.Name, metav1.GetOptions{})
 	if err != nil {
 		return nil, err
 	}
 
+	if err := opt.loadEncryption(); err != nil {
+		return nil, err
+	}
+	if opt.encryption != nil && (opt.streamToRestic || len(opt.objectBuckets) != 0) {
+		return nil, fmt.Errorf("--encryption-secret-name can not be used along with --stream-to-restic or --object-buckets")
+	}
+	if err := validateSnapshotLayout(opt.snapshotLayout); err != nil {
+		return nil, err
+	}
+	if opt.snapshotLayout == SnapshotLayoutBlocks && (opt.encryption != nil || opt.streamToRestic) {
+		return nil, fmt.Errorf("--snapshot-layout=%s can not be used along with --encryption-secret-name or --stream-to-restic", SnapshotLayoutBlocks)
+	}
+
 	// if any pre-backup actions has been assigned to it, execute them
 	actionOptions := api_util.ActionOptions{
 		StashClient:       opt.stashClient,
@@ -195,68 +262,176 @@ func (opt *natsOptions) backupNATS(targetRef api_v1beta1.TargetRef) (*restic.Bac
 		return nil, err
 	}
 
-	appBinding, err := opt.catalogClient.AppcatalogV1alpha1().AppBindings(opt.appBindingNamespace).Get(context.TODO(), opt.appBindingName, metav1.GetOptions{})
+	appBinding, err := opt.catalogClient.AppcatalogV1alpha1().AppBindings(opt.appBindingNamespace).Get(opt.ctx, opt.appBindingName, metav1.GetOptions{})
 	if err != nil {
 		return nil, err
 	}
 
-	klog.Infoln("Cleaning up temporary data directory: ", opt.interimDataDir)
-	if err := clearDir(opt.interimDataDir); err != nil {
-		return nil, err
+	opt.events = opt.newRunEvents(EventOperationBackup, appBinding, api_v1beta1.ResourceKindBackupSession, opt.backupSessionName)
+	opt.events.started(opt.ctx)
+
+	var backupOutput *restic.BackupOutput
+	err = opt.withCredentialsDir(func() error {
+		backupOutput, err = opt.backupApp(appBinding, targetRef)
+		return err
+	})
+	return backupOutput, err
+}
+
+// backupApp backs up the data of the server of the app binding
+func (opt *natsOptions) backupApp(appBinding *appcatalog.AppBinding, targetRef api_v1beta1.TargetRef) (*restic.BackupOutput, error) {
+	if !opt.streamToRestic {
+		klog.Infoln("Cleaning up temporary data directory: ", opt.interimDataDir)
+		if err := clearDir(opt.interimDataDir); err != nil {
+			return nil, err
+		}
 	}
 
-	session := opt.newSessionWrapper(NATSCMD)
+	if opt.accountsSecret != "" {
+		return opt.backupAccounts(appBinding, targetRef)
+	}
 
-	err = opt.setNATSCredentials(session.sh, appBinding)
+	session, err := opt.connectAppBinding(appBinding)
 	if err != nil {
 		return nil, err
 	}
+	defer session.close()
 
-	err = session.setNATSConnectionParameters(appBinding)
-	if err != nil {
+	if err := opt.resolveServerStreams(session); err != nil {
 		return nil, err
 	}
 
-	err = session.setTLSParameters(appBinding, opt.setupOptions.ScratchDir)
+	if opt.streamToRestic {
+		return opt.backupStreamsToRestic(session, targetRef)
+	}
+
+	resticWrapper, err := opt.newResticWrapper()
 	if err != nil {
 		return nil, err
 	}
 
-	err = session.waitForNATSReady(opt.warningThreshold)
-	if err != nil {
+	if err := opt.dumpData(session, resticWrapper); err != nil {
 		return nil, err
 	}
 
-	if err := opt.writeStreamNamesToFile(session.sh); err != nil {
+	return opt.backupInterimData(resticWrapper, targetRef)
+}
+
+// resolveServerStreams resolves the stream patterns against the streams of the server
+func (opt *natsOptions) resolveServerStreams(session *sessionWrapper) error {
+	if !opt.hasStreamPatterns() {
+		return nil
+	}
+	available, err := session.listStreams()
+	if err != nil {
+		return err
+	}
+	if err := opt.resolveStreams(available); err != nil {
+		return err
+	}
+	klog.Infof("Selected streams: %v", opt.streams)
+	return nil
+}
+
+// dumpData stores the selected streams and buckets in the interim data dir
+func (opt *natsOptions) dumpData(session *sessionWrapper, w *restic.ResticWrapper) error {
+	startTime := time.Now()
+	if err := opt.writeStreamNamesToFile(session); err != nil {
+		return err
+	}
+
+	if err := opt.dumpStreams(session, w); err != nil {
+		return err
+	}
+
+	if err := opt.dumpKVBuckets(session); err != nil {
+		return err
+	}
+
+	if err := opt.dumpObjectBuckets(session); err != nil {
+		return err
+	}
+
+	streams, err := opt.dropFailedStreams()
+	if err != nil {
+		return err
+	}
+	return opt.writeManifest(session, streams, startTime)
+}
+
+// dropFailedStreams removes the data of the failed streams from the interim data dir, so that only the
+// complete streams are uploaded. It returns the streams left in streams.json.
+func (opt *natsOptions) dropFailedStreams() ([]string, error) {
+	byteStreams, err := os.ReadFile(filepath.Join(opt.interimDataDir, NATSStreamsFile))
+	if err != nil {
+		return nil, err
+	}
+	var streams []string
+	if err := json.Unmarshal(byteStreams, &streams); err != nil {
 		return nil, err
 	}
 
-	if err := opt.dumpStreams(session); err != nil {
+	var kept []string
+	for _, stream := range streams {
+		if !opt.streamFailed(stream) {
+			kept = append(kept, stream)
+			continue
+		}
+		klog.Warningf("Excluding the failed stream %s from the backup", stream)
+		for _, dir := range []string{stream, filepath.Join(NATSIncrementalDir, stream)} {
+			if err := os.RemoveAll(filepath.Join(opt.interimDataDir, dir)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(kept) == len(streams) {
+		return streams, nil
+	}
+	if kept == nil {
+		kept = []string{}
+	}
+	byteStreams, err = json.Marshal(kept)
+	if err != nil {
 		return nil, err
 	}
+	return kept, os.WriteFile(filepath.Join(opt.interimDataDir, NATSStreamsFile), byteStreams, 0o644)
+}
 
+// backupInterimData uploads the interim data dir into the repository
+func (opt *natsOptions) backupInterimData(w *restic.ResticWrapper, targetRef api_v1beta1.TargetRef) (*restic.BackupOutput, error) {
 	// data snapshot has been stored in the interim data dir. Now, we will backup this directory using Stash.
 	opt.backupOptions.BackupPaths = []string{opt.interimDataDir}
 
-	resticWrapper, err := restic.NewResticWrapper(opt.setupOptions)
+	err := w.EnsureNoExclusiveLock(opt.kubeClient, opt.namespace)
 	if err != nil {
 		return nil, err
 	}
-	err = resticWrapper.EnsureNoExclusiveLock(opt.kubeClient, opt.namespace)
+
+	out, err := w.RunBackup(opt.backupOptions, targetRef)
 	if err != nil {
 		return nil, err
 	}
-
-	return resticWrapper.RunBackup(opt.backupOptions, targetRef)
+	logRepositoryGrowth(out)
+	return out, nil
 }
 
-func (opt *natsOptions) dumpStreams(session *sessionWrapper) error {
-	if len(opt.streams) == 0 {
+func (opt *natsOptions) dumpStreams(session *sessionWrapper, w *restic.ResticWrapper) error {
+	if opt.incremental {
+		if len(opt.streams) == 0 {
+			return fmt.Errorf("incremental backup requires the streams to be specified explicitly")
+		}
+		return opt.dumpIncremental(session, w)
+	}
+
+	if opt.backupAllStreams() {
 		if err := opt.dumpAll(session); err != nil {
 			return err
 		}
 		return nil
 	}
+	if len(opt.streams) == 0 {
+		return nil
+	}
 
 	if err := opt.dump(session); err != nil {
 		return err
@@ -266,32 +441,41 @@ func (opt *natsOptions) dumpStreams(session *sessionWrapper) error {
 }
 
 func (opt *natsOptions) dumpAll(session *sessionWrapper) error {
-	session.cmd.Args = append(session.cmd.Args, "account", "backup", opt.interimDataDir, "-f")
-	session.setUserArgs(opt.natsArgs)
-	session.sh.Command(NATSCMD, session.cmd.Args...)
-	if err := session.sh.Run(); err != nil {
+	streams, err := session.listStreams()
+	if err != nil {
 		return err
 	}
-	return nil
+	return opt.dumpStreamList(session, streams)
 }
 
 func (opt *natsOptions) dump(session *sessionWrapper) error {
-	session.cmd.Args = append(session.cmd.Args, "stream", "backup")
-	session.setUserArgs(opt.natsArgs)
-	streams := opt.streams
-	for i := range streams {
-		args := append(session.cmd.Args, streams[i], filepath.Join(opt.interimDataDir, streams[i]))
-		session.sh.Command(NATSCMD, args...)
-		if err := session.sh.Run(); err != nil {
+	return opt.dumpStreamList(session, opt.streams)
+}
+
+// dumpStreamList takes the snapshots of the streams, up to --max-concurrency streams at a time
+func (opt *natsOptions) dumpStreamList(session *sessionWrapper, streams []string) error {
+	return opt.forEachStream(streams, func(stream string, result *streamResult) error {
+		klog.Infoln("Backing up stream: ", stream)
+		dir := filepath.Join(opt.interimDataDir, stream)
+		if err := snapshotToDir(session.ctx, session.nc, stream, dir, opt.snapshotLayout, opt.encryption); err != nil {
 			return err
 		}
-	}
-	return nil
+		if info, err := readSnapshotInfo(dir); err == nil {
+			result.Messages, result.Bytes = info.State.Msgs, info.State.Bytes
+		}
+		return dumpConsumers(session, stream, dir)
+	})
 }
 
-func (opt *natsOptions) writeStreamNamesToFile(sh *shell.Session) error {
-	if len(opt.streams) == 0 {
-		if err := opt.writeAll(sh); err != nil {
+// backupAllStreams reports whether the whole account should be backed up.
+// It is the case only when no stream, KV bucket or object store bucket has been selected explicitly.
+func (opt *natsOptions) backupAllStreams() bool {
+	return len(opt.streams) == 0 && len(opt.kvBuckets) == 0 && len(opt.objectBuckets) == 0
+}
+
+func (opt *natsOptions) writeStreamNamesToFile(session *sessionWrapper) error {
+	if opt.backupAllStreams() {
+		if err := opt.writeAll(session); err != nil {
 			return err
 		}
 		return nil
@@ -304,18 +488,19 @@ func (opt *natsOptions) writeStreamNamesToFile(sh *shell.Session) error {
 	return nil
 }
 
-func (opt *natsOptions) writeAll(sh *shell.Session) error {
-	args := []any{
-		"stream",
-		"ls",
-		"--json",
+func (opt *natsOptions) writeAll(session *sessionWrapper) error {
+	streams, err := session.listStreams()
+	if err != nil {
+		return err
 	}
-	sh.Command(NATSCMD, args...)
-
-	if err := sh.WriteStdout(filepath.Join(opt.interimDataDir, NATSStreamsFile)); err != nil {
+	byteStreams, err := json.Marshal(streams)
+	if err != nil {
 		return err
 	}
 
+	if err = os.WriteFile(filepath.Join(opt.interimDataDir, NATSStreamsFile), byteStreams, 0o644); err != nil {
+		return err
+	}
 	return nil
 }
 
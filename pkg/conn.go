@@ -0,0 +1,78 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"crypto/tls"
+	"os"
+
+	"github.com/nats-io/nats.go"
+)
+
+// connectFromEnv connects to the NATS server using the connection parameters set in the environment.
+// The backup and restore commands set these variables while preparing the session, so the helper
+// commands started by restic inherit the connection parameters.
+func connectFromEnv() (*nats.Conn, error) {
+	return connect(os.Getenv)
+}
+
+// connect connects to the NATS server using the connection parameters read through getenv.
+// The parameters follow the environment variables of the nats CLI.
+func connect(getenv func(key string) string) (*nats.Conn, error) {
+	opts := []nats.Option{
+		nats.Name("stash-nats"),
+	}
+
+	// the server name has to be set before the options adding to the TLS configuration
+	if serverName := getenv(EnvNATSTLSServerName); serverName != "" {
+		opts = append(opts, nats.Secure(&tls.Config{
+			MinVersion: tls.VersionTLS12,
+			ServerName: serverName,
+		}))
+	}
+
+	// only one authentication method is set by the credential resolver
+	switch {
+	case getenv(EnvNATSCreds) != "":
+		opts = append(opts, nats.UserCredentials(getenv(EnvNATSCreds)))
+	case getenv(EnvNATSJWT) != "":
+		// the JWT is signed with the nkey seed
+		opts = append(opts, nats.UserCredentials(getenv(EnvNATSJWT), getenv(EnvNATSNkey)))
+	case getenv(EnvNATSNkey) != "":
+		opt, err := nats.NkeyOptionFromSeed(getenv(EnvNATSNkey))
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, opt)
+	case getenv(EnvNATSToken) != "":
+		opts = append(opts, nats.Token(getenv(EnvNATSToken)))
+	case getenv(EnvNATSUser) != "":
+		opts = append(opts, nats.UserInfo(getenv(EnvNATSUser), getenv(EnvNATSPassword)))
+	}
+	if cert, key := getenv(EnvNATSCert), getenv(EnvNATSKey); cert != "" && key != "" {
+		opts = append(opts, nats.ClientCert(cert, key))
+	}
+	if ca := getenv(EnvNATSCA); ca != "" {
+		opts = append(opts, nats.RootCAs(ca))
+	}
+
+	url := getenv(EnvNATSUrl)
+	if url == "" {
+		url = nats.DefaultURL
+	}
+	return nats.Connect(url, opts...)
+}
@@ -0,0 +1,232 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// ConsumerRestorePolicyResume re-creates the consumers at the position recorded in the backup
+	ConsumerRestorePolicyResume = "resume"
+	// ConsumerRestorePolicyRestart re-creates the consumers delivering from the start of the stream
+	ConsumerRestorePolicyRestart = "restart"
+	// ConsumerRestorePolicySkip restores the streams without any consumer
+	ConsumerRestorePolicySkip = "skip"
+)
+
+// dumpConsumers records the configuration and the delivery state of the durable consumers of the stream
+func dumpConsumers(session *sessionWrapper, stream, dir string) error {
+	s, err := session.js.Stream(session.ctx, stream)
+	if err != nil {
+		return fmt.Errorf("failed to read stream %s: %w", stream, err)
+	}
+	consumers := []*jetstream.ConsumerInfo{}
+	lister := s.ListConsumers(session.ctx)
+	for info := range lister.Info() {
+		if info.Config.Durable == "" {
+			continue
+		}
+		consumers = append(consumers, info)
+	}
+	if err := lister.Err(); err != nil {
+		return fmt.Errorf("failed to list consumers of stream %s: %w", stream, err)
+	}
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	byteConsumers, err := json.Marshal(consumers)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, NATSConsumersFile), byteConsumers, 0o644)
+}
+
+func validateConsumerRestorePolicy(policy string) error {
+	switch policy {
+	case ConsumerRestorePolicyResume, ConsumerRestorePolicyRestart, ConsumerRestorePolicySkip:
+		return nil
+	}
+	return fmt.Errorf("invalid consumer restore policy %q. Supported values are %s, %s and %s",
+		policy, ConsumerRestorePolicyResume, ConsumerRestorePolicyRestart, ConsumerRestorePolicySkip)
+}
+
+// readConsumerRecords reads the consumers recorded in dir by dumpConsumers
+func readConsumerRecords(dir string) ([]*jetstream.ConsumerInfo, error) {
+	byteConsumers, err := os.ReadFile(filepath.Join(dir, NATSConsumersFile))
+	if err != nil {
+		return nil, err
+	}
+	var consumers []*jetstream.ConsumerInfo
+	if err := json.Unmarshal(byteConsumers, &consumers); err != nil {
+		return nil, fmt.Errorf("invalid consumer records in %s: %w", dir, err)
+	}
+	return consumers, nil
+}
+
+// restoreConsumers replaces the consumers restored along with the stream snapshot by the ones recorded in dir,
+// according to --consumer-restore-policy. The snapshots taken without the consumer records are left as they are.
+// The ack floors beyond the full backup of the stream are mapped through floors to the sequences their messages
+// have been republished under.
+func (opt *natsOptions) restoreConsumers(session *sessionWrapper, stream, dir string, floors *restoredAckFloors) error {
+	consumers, err := readConsumerRecords(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		klog.Infof("No consumer has been recorded for stream %s. Keeping the consumers of the snapshot", stream)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s, err := session.js.Stream(session.ctx, stream)
+	if err != nil {
+		return fmt.Errorf("failed to read stream %s: %w", stream, err)
+	}
+	// the state of the consumers in the snapshot may not match the restored messages, so they are always re-created.
+	// The names are collected first, as deleting while listing would skip some of them.
+	var existing []string
+	names := s.ConsumerNames(session.ctx)
+	for name := range names.Name() {
+		existing = append(existing, name)
+	}
+	if err := names.Err(); err != nil {
+		return fmt.Errorf("failed to list consumers of stream %s: %w", stream, err)
+	}
+	for _, name := range existing {
+		if err := s.DeleteConsumer(session.ctx, name); err != nil && !errors.Is(err, jetstream.ErrConsumerNotFound) {
+			return fmt.Errorf("failed to delete consumer %s of stream %s: %w", name, stream, err)
+		}
+	}
+	if opt.consumerRestorePolicy == ConsumerRestorePolicySkip {
+		return nil
+	}
+
+	streamReplicas := s.CachedInfo().Config.Replicas
+	for _, info := range consumers {
+		config, err := consumerRestoreConfig(info, opt.consumerRestorePolicy, floors, streamReplicas)
+		if err != nil {
+			return fmt.Errorf("failed to restore consumer %s of stream %s: %w", info.Config.Durable, stream, err)
+		}
+		klog.Infof("Restoring consumer %s of stream %s", config.Durable, stream)
+		if _, err := s.CreateConsumer(session.ctx, config); err != nil {
+			return fmt.Errorf("failed to restore consumer %s of stream %s: %w", config.Durable, stream, err)
+		}
+	}
+	return nil
+}
+
+// consumerRestoreConfig returns the configuration to re-create a recorded consumer with.
+// The replicas of the consumer are limited to the replicas of the stream, which may have been lowered by an override.
+func consumerRestoreConfig(info *jetstream.ConsumerInfo, policy string, floors *restoredAckFloors, streamReplicas int) (jetstream.ConsumerConfig, error) {
+	config := info.Config
+	config.OptStartTime = nil
+	config.OptStartSeq = 0
+	ackFloor := info.AckFloor.Stream
+	if policy == ConsumerRestorePolicyResume && ackFloor != 0 {
+		restored, ok := floors.restoredSeq(ackFloor)
+		if !ok {
+			return config, fmt.Errorf("ack floor %d can not be mapped to the restored stream", ackFloor)
+		}
+		ackFloor = restored
+	}
+	switch {
+	case policy == ConsumerRestorePolicyRestart:
+		config.DeliverPolicy = jetstream.DeliverAllPolicy
+	case ackFloor != 0:
+		// resume right after the last message acknowledged by the consumer
+		config.DeliverPolicy = jetstream.DeliverByStartSequencePolicy
+		config.OptStartSeq = ackFloor + 1
+	default:
+		// nothing has been acknowledged yet, so the consumer starts as it has been configured
+		config.OptStartTime = info.Config.OptStartTime
+		config.OptStartSeq = info.Config.OptStartSeq
+	}
+	if streamReplicas > 0 && config.Replicas > streamReplicas {
+		config.Replicas = streamReplicas
+	}
+	return config, nil
+}
+
+// restoredAckFloors maps the ack floors of the recorded consumers to the sequences of the restored stream.
+// The messages of the increments are republished under new sequences, so an ack floor beyond the full backup
+// is mapped to the republished message with the highest backed up sequence not above it.
+type restoredAckFloors struct {
+	baseLastSeq uint64
+	floors      map[uint64]uint64
+}
+
+// newRestoredAckFloors tracks the ack floors of the consumers beyond the full backup of the stream.
+// restoredLastSeq is the last sequence of the stream once its full backup has been restored.
+func newRestoredAckFloors(consumers []*jetstream.ConsumerInfo, baseLastSeq, restoredLastSeq uint64) *restoredAckFloors {
+	f := &restoredAckFloors{
+		baseLastSeq: baseLastSeq,
+		floors:      map[uint64]uint64{},
+	}
+	for _, info := range consumers {
+		if info.AckFloor.Stream > baseLastSeq {
+			f.floors[info.AckFloor.Stream] = restoredLastSeq
+		}
+	}
+	return f
+}
+
+// trackAckFloors returns the ack floors of the consumers recorded in dir to track while the increments of the
+// stream are republished. It returns nil if the stream has no increment.
+func trackAckFloors(session *sessionWrapper, stream, dir string, state *streamBackupState) (*restoredAckFloors, error) {
+	if len(state.Increments) == 0 {
+		return nil, nil
+	}
+	consumers, err := readConsumerRecords(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	info, err := session.getStreamInfo(stream)
+	if err != nil {
+		return nil, err
+	}
+	return newRestoredAckFloors(consumers, state.BaseLastSeq, info.State.LastSeq), nil
+}
+
+// republished records that the message backed up under seq has been republished under newSeq.
+// The messages are republished in order, so a later message always gets a higher sequence.
+func (f *restoredAckFloors) republished(seq, newSeq uint64) {
+	if f == nil {
+		return
+	}
+	for floor := range f.floors {
+		if seq <= floor {
+			f.floors[floor] = newSeq
+		}
+	}
+}
+
+// restoredSeq returns the sequence an ack floor is restored under
+func (f *restoredAckFloors) restoredSeq(floor uint64) (uint64, bool) {
+	if f == nil || floor <= f.baseLastSeq {
+		return floor, true
+	}
+	seq, ok := f.floors[floor]
+	return seq, ok
+}
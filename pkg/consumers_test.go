@@ -0,0 +1,173 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func TestConsumerRestoreConfig(t *testing.T) {
+	// the full backup ends at 100 and the messages 110, 120 and 130 of the increments are republished as 101-103
+	floors := newRestoredAckFloors([]*jetstream.ConsumerInfo{
+		{AckFloor: jetstream.SequenceInfo{Stream: 105}},
+		{AckFloor: jetstream.SequenceInfo{Stream: 120}},
+		{AckFloor: jetstream.SequenceInfo{Stream: 125}},
+		{AckFloor: jetstream.SequenceInfo{Stream: 200}},
+	}, 100, 100)
+	for i, seq := range []uint64{110, 120, 130} {
+		floors.republished(seq, uint64(101+i))
+	}
+	cases := []struct {
+		name           string
+		policy         string
+		ackFloor       uint64
+		replicas       int
+		floors         *restoredAckFloors
+		streamReplicas int
+		deliverPolicy  jetstream.DeliverPolicy
+		startSeq       uint64
+		expReplicas    int
+		errMsg         string
+	}{
+		{
+			name:          "resume after the ack floor",
+			policy:        ConsumerRestorePolicyResume,
+			ackFloor:      42,
+			deliverPolicy: jetstream.DeliverByStartSequencePolicy,
+			startSeq:      43,
+		},
+		{
+			name:          "nothing acknowledged",
+			policy:        ConsumerRestorePolicyResume,
+			deliverPolicy: jetstream.DeliverNewPolicy,
+		},
+		{
+			name:          "restart",
+			policy:        ConsumerRestorePolicyRestart,
+			ackFloor:      42,
+			deliverPolicy: jetstream.DeliverAllPolicy,
+		},
+		{
+			name:          "ack floor in the full backup of an incremental stream",
+			policy:        ConsumerRestorePolicyResume,
+			ackFloor:      100,
+			floors:        floors,
+			deliverPolicy: jetstream.DeliverByStartSequencePolicy,
+			startSeq:      101,
+		},
+		{
+			name:          "ack floor on a republished message",
+			policy:        ConsumerRestorePolicyResume,
+			ackFloor:      120,
+			floors:        floors,
+			deliverPolicy: jetstream.DeliverByStartSequencePolicy,
+			startSeq:      103,
+		},
+		{
+			name:          "ack floor between republished messages",
+			policy:        ConsumerRestorePolicyResume,
+			ackFloor:      125,
+			floors:        floors,
+			deliverPolicy: jetstream.DeliverByStartSequencePolicy,
+			startSeq:      103,
+		},
+		{
+			name:          "ack floor before the first republished message",
+			policy:        ConsumerRestorePolicyResume,
+			ackFloor:      105,
+			floors:        floors,
+			deliverPolicy: jetstream.DeliverByStartSequencePolicy,
+			startSeq:      101,
+		},
+		{
+			name:          "ack floor beyond the last republished message",
+			policy:        ConsumerRestorePolicyResume,
+			ackFloor:      200,
+			floors:        floors,
+			deliverPolicy: jetstream.DeliverByStartSequencePolicy,
+			startSeq:      104,
+		},
+		{
+			name:     "ack floor not tracked",
+			policy:   ConsumerRestorePolicyResume,
+			ackFloor: 150,
+			floors:   floors,
+			errMsg:   "ack floor 150 can not be mapped",
+		},
+		{
+			name:          "untracked ack floor on restart",
+			policy:        ConsumerRestorePolicyRestart,
+			ackFloor:      150,
+			floors:        floors,
+			deliverPolicy: jetstream.DeliverAllPolicy,
+		},
+		{
+			name:          "ack floor beyond the full backup without increments",
+			policy:        ConsumerRestorePolicyResume,
+			ackFloor:      120,
+			deliverPolicy: jetstream.DeliverByStartSequencePolicy,
+			startSeq:      121,
+		},
+		{
+			name:           "replicas limited to the stream",
+			policy:         ConsumerRestorePolicyRestart,
+			replicas:       3,
+			streamReplicas: 1,
+			deliverPolicy:  jetstream.DeliverAllPolicy,
+			expReplicas:    1,
+		},
+		{
+			name:           "replicas within the stream",
+			policy:         ConsumerRestorePolicyRestart,
+			replicas:       3,
+			streamReplicas: 3,
+			deliverPolicy:  jetstream.DeliverAllPolicy,
+			expReplicas:    3,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			info := &jetstream.ConsumerInfo{
+				Config: jetstream.ConsumerConfig{
+					Durable:       "worker",
+					DeliverPolicy: jetstream.DeliverNewPolicy,
+					Replicas:      tc.replicas,
+				},
+				AckFloor: jetstream.SequenceInfo{Stream: tc.ackFloor},
+			}
+			config, err := consumerRestoreConfig(info, tc.policy, tc.floors, tc.streamReplicas)
+			if tc.errMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.errMsg) {
+					t.Fatalf("expected error containing %q, got %v", tc.errMsg, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.DeliverPolicy != tc.deliverPolicy || config.OptStartSeq != tc.startSeq {
+				t.Errorf("expected deliver policy %v from %d, got %v from %d", tc.deliverPolicy, tc.startSeq, config.DeliverPolicy, config.OptStartSeq)
+			}
+			if config.Replicas != tc.expReplicas {
+				t.Errorf("expected %d replicas, got %d", tc.expReplicas, config.Replicas)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	shell "gomodules.xyz/go-sh"
+)
+
+// natsContext holds the connection settings of a context file of the nats CLI.
+// The files it refers to must be available at the given paths.
+type natsContext struct {
+	Token    string `json:"token,omitempty"`
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+	Creds    string `json:"creds,omitempty"`
+	Nkey     string `json:"nkey,omitempty"`
+	Cert     string `json:"cert,omitempty"`
+	Key      string `json:"key,omitempty"`
+	CA       string `json:"ca,omitempty"`
+}
+
+// natsCredentials holds the authentication settings read from the secret of the app binding.
+// At most one authentication method is allowed: a creds file, a JWT along with its nkey seed,
+// an nkey seed, a token or a username along with its password. A client certificate can be
+// combined with any of them.
+type natsCredentials struct {
+	token    string
+	user     string
+	password string
+	creds    []byte
+	jwt      []byte
+	nkey     []byte
+	cert     []byte
+	key      []byte
+	context  *natsContext
+}
+
+// resolveNATSCredentials reads the authentication settings from the data of the secret.
+// A context file can not be combined with the other keys, so that it is always clear which settings are used.
+// The URL, the CA bundle and the server name of the app binding take precedence over the ones of a context file.
+func resolveNATSCredentials(data map[string][]byte) (*natsCredentials, error) {
+	credentials := &natsCredentials{
+		token:    string(data[NATSToken]),
+		user:     string(data[NATSUser]),
+		password: string(data[NATSPassword]),
+		creds:    data[NATSCreds],
+		jwt:      data[NATSJWT],
+		nkey:     data[NATSNkey],
+		cert:     data[NATSCert],
+		key:      data[NATSKey],
+	}
+	byteContext, ok := data[NATSContext]
+	if !ok {
+		return credentials, credentials.validate()
+	}
+
+	var keys []string
+	for _, key := range []string{NATSToken, NATSUser, NATSPassword, NATSCreds, NATSJWT, NATSNkey, NATSCert, NATSKey} {
+		if _, ok := data[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) != 0 {
+		return nil, fmt.Errorf("secret key %q can not be combined with %s", NATSContext, strings.Join(keys, ", "))
+	}
+	natsCtx := &natsContext{}
+	if err := json.Unmarshal(byteContext, natsCtx); err != nil {
+		return nil, fmt.Errorf("invalid nats context: %w", err)
+	}
+	credentials = &natsCredentials{
+		token:    natsCtx.Token,
+		user:     natsCtx.User,
+		password: natsCtx.Password,
+		context:  natsCtx,
+	}
+	if err := credentials.validate(); err != nil {
+		return nil, fmt.Errorf("invalid nats context: %w", err)
+	}
+	return credentials, nil
+}
+
+// validate checks that the credentials hold complete settings of a single authentication method
+func (c *natsCredentials) validate() error {
+	switch {
+	case c.user != "" && c.password == "":
+		return fmt.Errorf("%q is set without %q", NATSUser, NATSPassword)
+	case c.password != "" && c.user == "":
+		return fmt.Errorf("%q is set without %q", NATSPassword, NATSUser)
+	case len(c.jwt) != 0 && !c.hasNkey():
+		return fmt.Errorf("%q is set without the %q seed to sign with", NATSJWT, NATSNkey)
+	case c.hasCert() != c.hasKey():
+		return fmt.Errorf("both %q and %q are required for TLS client authentication", NATSCert, NATSKey)
+	}
+	if methods := c.authMethods(); len(methods) > 1 {
+		return fmt.Errorf("conflicting authentication methods %s. Only one of them can be used", strings.Join(methods, ", "))
+	}
+	return nil
+}
+
+// authMethods returns the names of the authentication methods set in the credentials
+func (c *natsCredentials) authMethods() []string {
+	var methods []string
+	if c.hasCreds() {
+		methods = append(methods, NATSCreds)
+	}
+	if len(c.jwt) != 0 {
+		methods = append(methods, NATSJWT+"+"+NATSNkey)
+	} else if c.hasNkey() {
+		methods = append(methods, NATSNkey)
+	}
+	if c.token != "" {
+		methods = append(methods, NATSToken)
+	}
+	if c.user != "" {
+		methods = append(methods, NATSUser+"+"+NATSPassword)
+	}
+	return methods
+}
+
+func (c *natsCredentials) hasCreds() bool {
+	return len(c.creds) != 0 || (c.context != nil && c.context.Creds != "")
+}
+
+func (c *natsCredentials) hasNkey() bool {
+	return len(c.nkey) != 0 || (c.context != nil && c.context.Nkey != "")
+}
+
+func (c *natsCredentials) hasCert() bool {
+	return len(c.cert) != 0 || (c.context != nil && c.context.Cert != "")
+}
+
+func (c *natsCredentials) hasKey() bool {
+	return len(c.key) != 0 || (c.context != nil && c.context.Key != "")
+}
+
+// clientCertificate returns the TLS client certificate of the credentials without any authentication method
+func (c *natsCredentials) clientCertificate() *natsCredentials {
+	cert := &natsCredentials{
+		cert: c.cert,
+		key:  c.key,
+	}
+	if c.context != nil {
+		cert.context = &natsContext{
+			Cert: c.context.Cert,
+			Key:  c.context.Key,
+			CA:   c.context.CA,
+		}
+	}
+	return cert
+}
+
+// apply passes the credentials to the connection through the environment of sh.
+// The credentials stored in files are written into dir.
+func (c *natsCredentials) apply(sh *shell.Session, dir string) error {
+	if c.context != nil {
+		for env, value := range map[string]string{
+			EnvNATSCreds: c.context.Creds,
+			EnvNATSNkey:  c.context.Nkey,
+			EnvNATSCert:  c.context.Cert,
+			EnvNATSKey:   c.context.Key,
+			EnvNATSCA:    c.context.CA,
+		} {
+			if value != "" {
+				sh.SetEnv(env, value)
+			}
+		}
+	}
+	if c.token != "" {
+		sh.SetEnv(EnvNATSToken, c.token)
+	}
+	if c.user != "" {
+		sh.SetEnv(EnvNATSUser, c.user)
+		sh.SetEnv(EnvNATSPassword, c.password)
+	}
+
+	for _, file := range []struct {
+		data []byte
+		name string
+		env  string
+	}{
+		{c.creds, NATSCredsFile, EnvNATSCreds},
+		{c.jwt, NATSJWTFile, EnvNATSJWT},
+		{c.nkey, NATSNkeyFile, EnvNATSNkey},
+		{c.cert, NATSCertFile, EnvNATSCert},
+		{c.key, NATSKeyFile, EnvNATSKey},
+	} {
+		if len(file.data) == 0 {
+			continue
+		}
+		if err := writeCredentialFile(filepath.Join(dir, file.name), file.data); err != nil {
+			return err
+		}
+		sh.SetEnv(file.env, filepath.Join(dir, file.name))
+	}
+	return nil
+}
@@ -0,0 +1,392 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	shell "gomodules.xyz/go-sh"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	appcatalog "kmodules.xyz/custom-resources/apis/appcatalog/v1alpha1"
+)
+
+func TestResolveNATSCredentials(t *testing.T) {
+	cases := []struct {
+		name    string
+		data    map[string]string
+		method  string
+		token   string
+		user    string
+		ctxCred string
+		ctxNkey string
+		ctxCert string
+		err     string
+	}{
+		{
+			name: "no credentials",
+			data: map[string]string{},
+		},
+		{
+			name:   "token",
+			data:   map[string]string{NATSToken: "t"},
+			method: NATSToken,
+			token:  "t",
+		},
+		{
+			name:   "username and password",
+			data:   map[string]string{NATSUser: "u", NATSPassword: "p"},
+			method: NATSUser + "+" + NATSPassword,
+			user:   "u",
+		},
+		{
+			name: "username without password",
+			data: map[string]string{NATSUser: "u"},
+			err:  "is set without",
+		},
+		{
+			name: "jwt without nkey",
+			data: map[string]string{NATSJWT: "j"},
+			err:  "seed to sign with",
+		},
+		{
+			name: "certificate without key",
+			data: map[string]string{NATSCert: "c"},
+			err:  "TLS client authentication",
+		},
+		{
+			name:   "jwt signed with nkey",
+			data:   map[string]string{NATSJWT: "j", NATSNkey: "n"},
+			method: NATSJWT + "+" + NATSNkey,
+		},
+		{
+			name: "creds along with everything else",
+			data: map[string]string{NATSCreds: "c", NATSJWT: "j", NATSNkey: "n", NATSToken: "t", NATSUser: "u", NATSPassword: "p"},
+			err:  "conflicting authentication methods creds, jwt+nkey, token, username+password",
+		},
+		{
+			name: "jwt and nkey along with token",
+			data: map[string]string{NATSJWT: "j", NATSNkey: "n", NATSToken: "t"},
+			err:  "conflicting authentication methods jwt+nkey, token",
+		},
+		{
+			name: "nkey along with username and password",
+			data: map[string]string{NATSNkey: "n", NATSUser: "u", NATSPassword: "p"},
+			err:  "conflicting authentication methods nkey, username+password",
+		},
+		{
+			name: "token along with username and password",
+			data: map[string]string{NATSToken: "t", NATSUser: "u", NATSPassword: "p"},
+			err:  "conflicting authentication methods token, username+password",
+		},
+		{
+			name:   "client certificate along with a token",
+			data:   map[string]string{NATSCert: "c", NATSKey: "k", NATSToken: "t"},
+			method: NATSToken,
+			token:  "t",
+		},
+		{
+			name:    "context",
+			data:    map[string]string{NATSContext: `{"creds":"/a.creds","cert":"/tls.crt","key":"/tls.key"}`},
+			method:  NATSCreds,
+			ctxCred: "/a.creds",
+			ctxCert: "/tls.crt",
+		},
+		{
+			name:   "token of the context",
+			data:   map[string]string{NATSContext: `{"token":"ctx"}`},
+			method: NATSToken,
+			token:  "ctx",
+		},
+		{
+			name: "context along with a token",
+			data: map[string]string{NATSContext: `{"token":"ctx"}`, NATSToken: "t"},
+			err:  `secret key "context" can not be combined with token`,
+		},
+		{
+			name: "context along with a username",
+			data: map[string]string{NATSContext: `{"user":"ctx","password":"ctx"}`, NATSUser: "u"},
+			err:  `secret key "context" can not be combined with username`,
+		},
+		{
+			name: "context along with a client certificate",
+			data: map[string]string{NATSContext: `{"cert":"/tls.crt","key":"/tls.key"}`, NATSCert: "c", NATSKey: "k"},
+			err:  `secret key "context" can not be combined with tls.crt, tls.key`,
+		},
+		{
+			name: "context along with an nkey",
+			data: map[string]string{NATSContext: `{"creds":"/a.creds"}`, NATSNkey: "n"},
+			err:  `secret key "context" can not be combined with nkey`,
+		},
+		{
+			name: "context with conflicting methods",
+			data: map[string]string{NATSContext: `{"creds":"/a.creds","token":"t"}`},
+			err:  "invalid nats context: conflicting authentication methods creds, token",
+		},
+		{
+			name: "context with username without password",
+			data: map[string]string{NATSContext: `{"user":"u"}`},
+			err:  "invalid nats context",
+		},
+		{
+			name: "invalid context",
+			data: map[string]string{NATSContext: "{"},
+			err:  "invalid nats context",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			data := map[string][]byte{}
+			for k, v := range c.data {
+				data[k] = []byte(v)
+			}
+			credentials, err := resolveNATSCredentials(data)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("expected error containing %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if method := strings.Join(credentials.authMethods(), ", "); method != c.method {
+				t.Errorf("expected method %q, got %q", c.method, method)
+			}
+			if credentials.token != c.token {
+				t.Errorf("expected token %q, got %q", c.token, credentials.token)
+			}
+			if credentials.user != c.user {
+				t.Errorf("expected user %q, got %q", c.user, credentials.user)
+			}
+			if credentials.context != nil {
+				if credentials.context.Creds != c.ctxCred {
+					t.Errorf("expected context creds %q, got %q", c.ctxCred, credentials.context.Creds)
+				}
+				if credentials.context.Nkey != c.ctxNkey {
+					t.Errorf("expected context nkey %q, got %q", c.ctxNkey, credentials.context.Nkey)
+				}
+				if credentials.context.Cert != c.ctxCert {
+					t.Errorf("expected context cert %q, got %q", c.ctxCert, credentials.context.Cert)
+				}
+			}
+		})
+	}
+}
+
+func checkMode(t *testing.T, path string, mode os.FileMode) {
+	t.Helper()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != mode {
+		t.Errorf("expected mode %o of %s, got %o", mode, path, fi.Mode().Perm())
+	}
+}
+
+func TestApplyCredentials(t *testing.T) {
+	opt := &natsOptions{setupOptions: restic.SetupOptions{ScratchDir: filepath.Join(t.TempDir(), "scratch")}}
+	if err := opt.createCredentialsDir(); err != nil {
+		t.Fatal(err)
+	}
+	defer opt.removeCredentialsDir()
+	checkMode(t, opt.credentialsDir, 0o700)
+
+	credentials, err := resolveNATSCredentials(map[string][]byte{
+		NATSCreds: []byte("creds"),
+		NATSCert:  []byte("cert"),
+		NATSKey:   []byte("key"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh := shell.NewSession()
+	if err := credentials.apply(sh, opt.credentialsDir); err != nil {
+		t.Fatal(err)
+	}
+	for env, data := range map[string]string{
+		EnvNATSCreds: "creds",
+		EnvNATSCert:  "cert",
+		EnvNATSKey:   "key",
+	} {
+		file := sh.Env[env]
+		if filepath.Dir(file) != opt.credentialsDir {
+			t.Errorf("expected %s to point into %s, got %q", env, opt.credentialsDir, file)
+			continue
+		}
+		checkMode(t, file, 0o600)
+		if content, err := os.ReadFile(file); err != nil || string(content) != data {
+			t.Errorf("unexpected content of %s: %q, %v", file, content, err)
+		}
+	}
+	for _, env := range []string{EnvNATSJWT, EnvNATSNkey, EnvNATSToken, EnvNATSUser, EnvNATSPassword} {
+		if v, ok := sh.Env[env]; ok {
+			t.Errorf("expected %s to be unset, got %q", env, v)
+		}
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	credentials, err := resolveNATSCredentials(map[string][]byte{
+		NATSContext: []byte(`{"creds":"/a.creds","cert":"/tls.crt","key":"/tls.key","ca":"/ca.crt"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := credentials.clientCertificate()
+	if methods := cert.authMethods(); len(methods) != 0 {
+		t.Errorf("expected no authentication method, got %v", methods)
+	}
+
+	dir := t.TempDir()
+	sh := shell.NewSession()
+	if err := cert.apply(sh, dir); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		EnvNATSCert: "/tls.crt",
+		EnvNATSKey:  "/tls.key",
+		EnvNATSCA:   "/ca.crt",
+	}
+	for env, value := range expected {
+		if sh.Env[env] != value {
+			t.Errorf("expected %s=%q, got %q", env, value, sh.Env[env])
+		}
+	}
+	for _, env := range []string{EnvNATSCreds, EnvNATSJWT, EnvNATSNkey, EnvNATSToken, EnvNATSUser, EnvNATSPassword} {
+		if v, ok := sh.Env[env]; ok {
+			t.Errorf("expected %s to be unset, got %q", env, v)
+		}
+	}
+}
+
+// unusedAddress returns an address no server listens on
+func unusedAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+	return addr
+}
+
+func TestCredentialsDirRemoval(t *testing.T) {
+	const namespace = "demo"
+	url := "nats://" + unusedAddress(t)
+	appBinding := &appcatalog.AppBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: "nats", Namespace: namespace},
+		Spec: appcatalog.AppBindingSpec{
+			ClientConfig: appcatalog.ClientConfig{
+				URL:      &url,
+				CABundle: []byte("ca"),
+			},
+			Secret: &appcatalog.TypedLocalObjectReference{Name: "nats-auth"},
+		},
+	}
+	secret := &core.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "nats-auth", Namespace: namespace},
+		Data:       map[string][]byte{NATSCreds: []byte("creds")},
+	}
+
+	cases := []struct {
+		name    string
+		connect bool
+		cancel  bool
+		run     func(opt *natsOptions) error
+	}{
+		{
+			name: "succeeded",
+			run:  func(opt *natsOptions) error { return nil },
+		},
+		{
+			name:    "connection failed",
+			connect: true,
+			run: func(opt *natsOptions) error {
+				_, err := opt.connectAppBinding(appBinding)
+				return err
+			},
+		},
+		{
+			name:    "cancelled",
+			connect: true,
+			cancel:  true,
+			run: func(opt *natsOptions) error {
+				_, err := opt.connectAppBinding(appBinding)
+				return err
+			},
+		},
+		{
+			name: "panicked",
+			run:  func(opt *natsOptions) error { panic("failure") },
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if c.cancel {
+				cancel()
+			}
+			opt := &natsOptions{
+				ctx:              ctx,
+				kubeClient:       fake.NewSimpleClientset(secret),
+				warningThreshold: "1s",
+				waitTimeout:      1,
+				setupOptions:     restic.SetupOptions{ScratchDir: t.TempDir()},
+			}
+
+			var dir string
+			func() {
+				defer func() { _ = recover() }()
+				_ = opt.withCredentialsDir(func() error {
+					dir = opt.credentialsDir
+					checkMode(t, dir, 0o700)
+					err := c.run(opt)
+					if c.connect {
+						if err == nil {
+							t.Error("expected the connection to fail")
+						}
+						for _, file := range []string{NATSCredsFile, NATSCACertFile} {
+							checkMode(t, filepath.Join(dir, file), 0o600)
+						}
+					}
+					return err
+				})
+			}()
+
+			if dir == "" {
+				t.Fatal("credentials directory has not been created")
+			}
+			if _, err := os.Stat(dir); !os.IsNotExist(err) {
+				t.Errorf("expected credentials directory %s to be removed, got %v", dir, err)
+			}
+			if opt.credentialsDir != "" {
+				t.Errorf("expected credentials directory to be reset, got %q", opt.credentialsDir)
+			}
+		})
+	}
+}
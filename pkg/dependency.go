@@ -0,0 +1,128 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// readSnapshotConfig reads the stream configuration recorded in the snapshot stored in dir
+func readSnapshotConfig(dir string) (*jetstream.StreamConfig, error) {
+	byteMeta, err := os.ReadFile(filepath.Join(dir, NATSSnapshotMetaFile))
+	if err != nil {
+		return nil, err
+	}
+	meta := &struct {
+		Config jetstream.StreamConfig `json:"config"`
+	}{}
+	if err := json.Unmarshal(byteMeta, meta); err != nil {
+		return nil, err
+	}
+	return &meta.Config, nil
+}
+
+// streamOrigins returns the streams the given stream mirrors or sources from.
+// The origins in another JetStream domain or account are left out, as they are never part of the restore.
+func streamOrigins(config *jetstream.StreamConfig) []string {
+	var origins []string
+	if config.Mirror != nil && config.Mirror.External == nil {
+		origins = append(origins, config.Mirror.Name)
+	}
+	for _, source := range config.Sources {
+		if source != nil && source.External == nil {
+			origins = append(origins, source.Name)
+		}
+	}
+	return origins
+}
+
+// restoreWaves groups the streams stored in the interim data dir into waves, so that a stream is restored only
+// after the streams it mirrors or sources from. The streams of a wave do not depend on each other.
+// The streams are tracked by the names they are restored as, as the mirror and source configurations are renamed
+// the same way. Origins that are not being restored are expected to exist already and are ignored.
+func (opt *natsOptions) restoreWaves(streams []string) ([][]string, error) {
+	unique := make([]string, 0, len(streams))
+	// restoredAs maps the name a stream is restored as to its name in the backup
+	restoredAs := make(map[string]string, len(streams))
+	for _, stream := range streams {
+		name := opt.restoreName(stream)
+		if prev, found := restoredAs[name]; found {
+			if prev == stream {
+				continue
+			}
+			return nil, fmt.Errorf("streams %s and %s are both restored as %s", prev, stream, name)
+		}
+		restoredAs[name] = stream
+		unique = append(unique, stream)
+	}
+	streams = unique
+
+	deps := make(map[string][]string, len(streams))
+	for _, stream := range streams {
+		config, err := readSnapshotConfig(filepath.Join(opt.interimDataDir, stream))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read configuration of stream %s: %w", stream, err)
+		}
+		for _, origin := range streamOrigins(config) {
+			if dep, found := restoredAs[opt.restoreName(origin)]; found && dep != stream {
+				deps[stream] = append(deps[stream], dep)
+			}
+		}
+	}
+
+	var waves [][]string
+	done := make(map[string]bool, len(streams))
+	for len(done) < len(streams) {
+		var wave []string
+		for _, stream := range streams {
+			if done[stream] {
+				continue
+			}
+			ready := true
+			for _, origin := range deps[stream] {
+				if !done[origin] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				wave = append(wave, stream)
+			}
+		}
+		if len(wave) == 0 {
+			var pending []string
+			for _, stream := range streams {
+				if !done[stream] {
+					pending = append(pending, stream)
+				}
+			}
+			sort.Strings(pending)
+			return nil, fmt.Errorf("circular mirror/source dependency among streams %v", pending)
+		}
+		for _, stream := range wave {
+			done[stream] = true
+		}
+		waves = append(waves, wave)
+	}
+	return waves, nil
+}
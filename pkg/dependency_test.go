@@ -0,0 +1,174 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// writeSnapshotConfigs stores the snapshot metadata of the given stream configurations in a new interim data dir
+func writeSnapshotConfigs(t *testing.T, configs map[string]jetstream.StreamConfig) string {
+	t.Helper()
+	dir := t.TempDir()
+	for stream, config := range configs {
+		config.Name = stream
+		byteMeta, err := json.Marshal(map[string]any{"config": config})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(dir, stream), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, stream, NATSSnapshotMetaFile), byteMeta, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestRestoreWaves(t *testing.T) {
+	configs := map[string]jetstream.StreamConfig{
+		"orders":  {},
+		"archive": {Mirror: &jetstream.StreamSource{Name: "orders"}},
+		"all":     {Sources: []*jetstream.StreamSource{{Name: "orders"}, {Name: "archive"}}},
+		"remote":  {Mirror: &jetstream.StreamSource{Name: "orders", External: &jetstream.ExternalStream{APIPrefix: "$JS.hub.API"}}},
+		"replica": {Mirror: &jetstream.StreamSource{Name: "current"}},
+		"ping":    {Mirror: &jetstream.StreamSource{Name: "pong"}},
+		"pong":    {Mirror: &jetstream.StreamSource{Name: "ping"}},
+	}
+	cases := []struct {
+		name      string
+		streams   []string
+		overrides map[string]streamOverride
+		expected  [][]string
+		wantErr   string
+	}{
+		{
+			name:     "independent streams",
+			streams:  []string{"orders", "remote"},
+			expected: [][]string{{"orders", "remote"}},
+		},
+		{
+			name:     "mirror and sources after their origins",
+			streams:  []string{"all", "archive", "orders"},
+			expected: [][]string{{"orders"}, {"archive"}, {"all"}},
+		},
+		{
+			name:     "duplicate streams",
+			streams:  []string{"archive", "orders", "archive", "orders"},
+			expected: [][]string{{"orders"}, {"archive"}},
+		},
+		{
+			name:      "origin restored under a new name",
+			streams:   []string{"replica", "orders"},
+			overrides: map[string]streamOverride{"orders": {Name: "current"}},
+			expected:  [][]string{{"orders"}, {"replica"}},
+		},
+		{
+			name:      "origin renamed away",
+			streams:   []string{"archive", "orders"},
+			overrides: map[string]streamOverride{"orders": {Name: "orders-v2"}},
+			expected:  [][]string{{"orders"}, {"archive"}},
+		},
+		{
+			name:      "streams restored under the same name",
+			streams:   []string{"orders", "remote"},
+			overrides: map[string]streamOverride{"remote": {Name: "orders"}},
+			wantErr:   "both restored as orders",
+		},
+		{
+			name:    "circular dependency",
+			streams: []string{"ping", "pong", "orders"},
+			wantErr: "circular mirror/source dependency among streams [ping pong]",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			opt := &natsOptions{
+				interimDataDir:  writeSnapshotConfigs(t, configs),
+				streamOverrides: tc.overrides,
+			}
+			waves, err := opt.restoreWaves(tc.streams)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(waves, tc.expected) {
+				t.Errorf("expected waves %v, got %v", tc.expected, waves)
+			}
+		})
+	}
+}
+
+func TestStreamRestoreConfigRenamesOrigins(t *testing.T) {
+	opt := &natsOptions{
+		interimDataDir: writeSnapshotConfigs(t, map[string]jetstream.StreamConfig{
+			"archive": {Mirror: &jetstream.StreamSource{Name: "orders"}},
+			"all": {Sources: []*jetstream.StreamSource{
+				{Name: "orders"},
+				{Name: "orders", External: &jetstream.ExternalStream{APIPrefix: "$JS.hub.API"}},
+				{Name: "events"},
+			}},
+			"events": {},
+		}),
+		streamOverrides: map[string]streamOverride{"orders": {Name: "orders-v2"}},
+	}
+
+	name, config, err := opt.streamRestoreConfig("archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := &jetstream.StreamConfig{}
+	if err := json.Unmarshal(config, restored); err != nil {
+		t.Fatal(err)
+	}
+	if name != "archive" || restored.Mirror == nil || restored.Mirror.Name != "orders-v2" {
+		t.Errorf("expected archive to mirror orders-v2, got %s mirroring %+v", name, restored.Mirror)
+	}
+
+	if _, config, err = opt.streamRestoreConfig("all"); err != nil {
+		t.Fatal(err)
+	}
+	restored = &jetstream.StreamConfig{}
+	if err := json.Unmarshal(config, restored); err != nil {
+		t.Fatal(err)
+	}
+	var sources []string
+	for _, source := range restored.Sources {
+		sources = append(sources, source.Name)
+	}
+	if expected := []string{"orders-v2", "orders", "events"}; !reflect.DeepEqual(sources, expected) {
+		t.Errorf("expected sources %v, got %v", expected, sources)
+	}
+
+	// a stream without renamed origins or overrides is restored with the configuration of the snapshot
+	if name, config, err = opt.streamRestoreConfig("events"); err != nil || name != "events" || config != nil {
+		t.Errorf("expected events to be restored as is, got %s %s %v", name, config, err)
+	}
+}
@@ -0,0 +1,203 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"time"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"k8s.io/klog/v2"
+)
+
+const (
+	RestoreActionCreate    = "create"
+	RestoreActionOverwrite = "overwrite"
+	RestoreActionSkip      = "skip"
+	RestoreActionConflict  = "conflict"
+)
+
+// streamRestorePlan tells what a restore would do with a backed up stream
+type streamRestorePlan struct {
+	Stream string `json:"stream"`
+	// Target is the name the stream would be restored as
+	Target string `json:"target,omitempty"`
+	Action string `json:"action"`
+	Reason string `json:"reason,omitempty"`
+	// Messages and Bytes are recorded in the backup
+	Messages uint64 `json:"messages"`
+	Bytes    uint64 `json:"bytes"`
+	// LastSeq includes the messages of the incremental backups
+	LastSeq uint64 `json:"lastSeq"`
+	// ExistingMessages and ExistingBytes are the size of the stream on the server that would be replaced
+	ExistingMessages uint64 `json:"existingMessages,omitempty"`
+	ExistingBytes    uint64 `json:"existingBytes,omitempty"`
+}
+
+// planRestore reports what a restore would do with every backed up stream without changing anything.
+// Only the metadata of the snapshot is read from the repository.
+func (opt *natsOptions) planRestore(session *sessionWrapper, targetRef api_v1beta1.TargetRef) (*restic.RestoreOutput, error) {
+	w, err := opt.newResticWrapper()
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := opt.planSnapshot(w)
+	if err != nil {
+		return nil, err
+	}
+	klog.Infoln("Planning restore of snapshot: ", snapshot)
+
+	byteStreams, err := w.DumpOnce(restic.DumpOptions{
+		Snapshot: snapshot,
+		FileName: filepath.Join(opt.interimDataDir, NATSStreamsFile),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var backedUp []string
+	if err := json.Unmarshal(byteStreams, &backedUp); err != nil {
+		return nil, err
+	}
+	selected := backedUp
+	if opt.hasStreamPatterns() {
+		if selected, err = opt.selectStreams(backedUp); err != nil {
+			return nil, err
+		}
+	} else if len(opt.streams) != 0 {
+		selected = opt.streams
+	}
+
+	// the state is only present in the snapshots taken in incremental mode
+	state, err := opt.readBackupState(w, snapshot)
+	if err != nil {
+		state = nil
+	}
+	existing, err := session.listStreams()
+	if err != nil {
+		return nil, err
+	}
+
+	startTime := time.Now()
+	for _, stream := range backedUp {
+		if !slices.Contains(selected, stream) {
+			opt.restorePlan = append(opt.restorePlan, streamRestorePlan{Stream: stream, Action: RestoreActionSkip, Reason: "not selected"})
+		}
+	}
+	for _, stream := range selected {
+		plan := streamRestorePlan{Stream: stream, Target: opt.restoreName(stream)}
+		if !slices.Contains(backedUp, stream) {
+			plan.Action, plan.Reason = RestoreActionConflict, "not found in the snapshot"
+			opt.restorePlan = append(opt.restorePlan, plan)
+			continue
+		}
+
+		info, err := opt.readSnapshotInfoFromRepository(w, snapshot, stream, state.find(stream))
+		if err != nil {
+			plan.Action, plan.Reason = RestoreActionConflict, fmt.Sprintf("failed to read backup metadata: %v", err)
+			opt.restorePlan = append(opt.restorePlan, plan)
+			continue
+		}
+		plan.Messages, plan.Bytes, plan.LastSeq = info.State.Msgs, info.State.Bytes, info.State.LastSeq
+		if s := state.find(stream); s != nil {
+			plan.LastSeq = s.LastSeq
+		}
+
+		switch {
+		case !streamExists(plan.Target, existing):
+			plan.Action = RestoreActionCreate
+		case opt.overwrite:
+			plan.Action = RestoreActionOverwrite
+		default:
+			plan.Action, plan.Reason = RestoreActionConflict, "stream already exists, use --overwrite to replace it"
+		}
+		if plan.Action != RestoreActionCreate {
+			if current, err := session.getStreamInfo(plan.Target); err == nil {
+				plan.ExistingMessages, plan.ExistingBytes = current.State.Msgs, current.State.Bytes
+			}
+		}
+		opt.restorePlan = append(opt.restorePlan, plan)
+	}
+
+	for _, plan := range opt.restorePlan {
+		klog.Infof("Stream %s: %s %s (messages: %d, bytes: %d, last sequence: %d, existing messages: %d, existing bytes: %d)",
+			plan.Stream, plan.Action, plan.Reason, plan.Messages, plan.Bytes, plan.LastSeq, plan.ExistingMessages, plan.ExistingBytes)
+	}
+
+	return &restic.RestoreOutput{
+		RestoreTargetStatus: api_v1beta1.RestoreMemberStatus{
+			Ref: targetRef,
+			Stats: []api_v1beta1.HostRestoreStats{
+				{
+					Hostname: opt.restoreOptions.Host,
+					Phase:    api_v1beta1.HostRestoreSucceeded,
+					Duration: time.Since(startTime).String(),
+				},
+			},
+		},
+	}, nil
+}
+
+// planSnapshot returns the snapshot a restore would use
+func (opt *natsOptions) planSnapshot(w *restic.ResticWrapper) (string, error) {
+	if len(opt.restoreOptions.Snapshots) != 0 {
+		return opt.restoreOptions.Snapshots[len(opt.restoreOptions.Snapshots)-1], nil
+	}
+	host := opt.restoreOptions.SourceHost
+	if host == "" {
+		host = opt.restoreOptions.Host
+	}
+	latest, err := opt.latestSnapshot(w, host)
+	if err != nil {
+		return "", err
+	}
+	if latest == nil {
+		return "", fmt.Errorf("no snapshot found for host %s", host)
+	}
+	return latest.ID, nil
+}
+
+// readSnapshotInfoFromRepository reads the metadata of the full backup of a stream.
+// The full backup of an incrementally backed up stream is stored in one of the earlier snapshots of its chain.
+func (opt *natsOptions) readSnapshotInfoFromRepository(w *restic.ResticWrapper, snapshot, stream string, s *streamBackupState) (*jetstream.StreamInfo, error) {
+	snapshots := []string{snapshot}
+	if s != nil {
+		snapshots = append(snapshots, s.Snapshots...)
+	}
+	var lastErr error
+	for _, id := range snapshots {
+		byteInfo, err := w.DumpOnce(restic.DumpOptions{
+			Snapshot: id,
+			FileName: filepath.Join(opt.interimDataDir, stream, NATSSnapshotMetaFile),
+		})
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		info := &jetstream.StreamInfo{}
+		if err := json.Unmarshal(byteInfo, info); err != nil {
+			return nil, err
+		}
+		return info, nil
+	}
+	return nil, lastErr
+}
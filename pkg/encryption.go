@@ -0,0 +1,380 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Layout of an encrypted archive:
+//
+//	8 bytes magic
+//	uint32 header length and JSON encoded encryptionHeader
+//	chunks, each one being uint32 length followed by the data sealed with AES-256-GCM
+//
+// Every archive is encrypted with a random data key which is stored in the header wrapped
+// with the key of the encryption secret. The nonce of a chunk is its index, which is safe as
+// the data key is never reused. The last chunk is sealed with a different additional data,
+// so that a truncated archive is detected.
+const (
+	EncryptionAlgorithm = "AES-256-GCM"
+
+	encryptionMagic     = "NATSENC1"
+	encryptionChunkSize = 64 * 1024
+	encryptionKeySize   = 32
+)
+
+var (
+	chunkAD     = []byte{0}
+	lastChunkAD = []byte{1}
+
+	errArchiveEncrypted = errors.New("archive is encrypted")
+)
+
+// encryptionHeader describes how an archive has been encrypted
+type encryptionHeader struct {
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"keyId"`
+	// WrappedKey is the data key of the archive sealed with the key identified by KeyID
+	WrappedKey []byte `json:"wrappedKey"`
+}
+
+// archiveEncryption encrypts the archives written into the interim data dir and decrypts them back.
+// A nil archiveEncryption reads and writes the archives as they are.
+type archiveEncryption struct {
+	// keyID identifies the key used to encrypt the new archives
+	keyID string
+	// keys holds all the keys of the encryption secret by their ID, so that archives encrypted with an earlier key can be read
+	keys map[string][]byte
+}
+
+// loadEncryption reads the keys of the encryption secret. Every key of the secret must be 32 bytes long and
+// it is identified by its name. --encryption-key-id selects the key used for the new archives.
+func (opt *natsOptions) loadEncryption() error {
+	if opt.encryptionSecret.Name == "" {
+		if opt.encryptionKeyID != "" {
+			return fmt.Errorf("--encryption-key-id requires --encryption-secret-name")
+		}
+		return nil
+	}
+	secret, err := opt.kubeClient.CoreV1().Secrets(opt.encryptionSecret.Namespace).Get(opt.ctx, opt.encryptionSecret.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	encryption := &archiveEncryption{
+		keyID: opt.encryptionKeyID,
+		keys:  map[string][]byte{},
+	}
+	for id, key := range secret.Data {
+		if len(key) != encryptionKeySize {
+			return fmt.Errorf("key %q of encryption secret %s/%s must be %d bytes long", id, secret.Namespace, secret.Name, encryptionKeySize)
+		}
+		encryption.keys[id] = key
+	}
+	if encryption.keyID == "" {
+		if len(encryption.keys) != 1 {
+			ids := make([]string, 0, len(encryption.keys))
+			for id := range encryption.keys {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			return fmt.Errorf("encryption secret %s/%s holds keys %v. Select one of them with --encryption-key-id", secret.Namespace, secret.Name, ids)
+		}
+		for id := range encryption.keys {
+			encryption.keyID = id
+		}
+	}
+	if _, ok := encryption.keys[encryption.keyID]; !ok {
+		return fmt.Errorf("key %q not found in encryption secret %s/%s", encryption.keyID, secret.Namespace, secret.Name)
+	}
+	opt.encryption = encryption
+	return nil
+}
+
+// currentKeyID returns the ID of the key used to encrypt the new archives, or an empty string if they are not encrypted
+func (e *archiveEncryption) currentKeyID() string {
+	if e == nil {
+		return ""
+	}
+	return e.keyID
+}
+
+// create creates an archive that is encrypted as it is written
+func (e *archiveEncryption) create(file string) (io.WriteCloser, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return f, nil
+	}
+	w, err := e.newWriter(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// open opens an archive for reading. An encrypted archive is decrypted as it is read.
+func (e *archiveEncryption) open(file string) (io.ReadCloser, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(len(encryptionMagic))
+	if err != nil || string(magic) != encryptionMagic {
+		// not encrypted, i.e. taken without --encryption-secret-name
+		return readCloser{Reader: br, Closer: f}, nil
+	}
+	if e == nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("%s: %w. Use --encryption-secret-name to provide the key", file, errArchiveEncrypted)
+	}
+	r, err := e.newReader(br)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("failed to decrypt %s: %w", file, err)
+	}
+	return readCloser{Reader: r, Closer: f}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (e *archiveEncryption) newWriter(f *os.File) (*encryptingWriter, error) {
+	dataKey := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	kek, err := newGCM(e.keys[e.keyID])
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, kek.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header, err := json.Marshal(encryptionHeader{
+		Algorithm:  EncryptionAlgorithm,
+		KeyID:      e.keyID,
+		WrappedKey: kek.Seal(nonce, nonce, dataKey, []byte(e.keyID)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &encryptingWriter{
+		f:    f,
+		w:    bufio.NewWriter(f),
+		aead: aead,
+		buf:  make([]byte, 0, encryptionChunkSize),
+	}
+	if _, err := w.w.WriteString(encryptionMagic); err != nil {
+		return nil, err
+	}
+	if err := writeFrame(w.w, header); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (e *archiveEncryption) newReader(r *bufio.Reader) (*decryptingReader, error) {
+	if _, err := r.Discard(len(encryptionMagic)); err != nil {
+		return nil, err
+	}
+	byteHeader, err := readFrame(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption header: %w", err)
+	}
+	header := &encryptionHeader{}
+	if err := json.Unmarshal(byteHeader, header); err != nil {
+		return nil, fmt.Errorf("invalid encryption header: %w", err)
+	}
+	if header.Algorithm != EncryptionAlgorithm {
+		return nil, fmt.Errorf("unsupported encryption algorithm %q", header.Algorithm)
+	}
+	key, ok := e.keys[header.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("key %q not found in the encryption secret", header.KeyID)
+	}
+	kek, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(header.WrappedKey) < kek.NonceSize() {
+		return nil, fmt.Errorf("invalid wrapped key")
+	}
+	nonce, wrapped := header.WrappedKey[:kek.NonceSize()], header.WrappedKey[kek.NonceSize():]
+	dataKey, err := kek.Open(nil, nonce, wrapped, []byte(header.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap the data key with key %q: %w", header.KeyID, err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptingReader{r: r, aead: aead}, nil
+}
+
+// encryptingWriter seals the data in chunks of encryptionChunkSize
+type encryptingWriter struct {
+	f     *os.File
+	w     *bufio.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	index uint64
+}
+
+func (w *encryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), encryptionChunkSize-len(w.buf))
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		// a full chunk is sealed only once more data arrives, as the last chunk is sealed differently
+		if len(w.buf) == encryptionChunkSize && len(p) > 0 {
+			if err := w.seal(chunkAD); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *encryptingWriter) seal(ad []byte) error {
+	sealed := w.aead.Seal(nil, chunkNonce(w.aead, w.index), w.buf, ad)
+	w.index++
+	w.buf = w.buf[:0]
+	return writeFrame(w.w, sealed)
+}
+
+// Close seals the last chunk and closes the file
+func (w *encryptingWriter) Close() error {
+	if w.buf == nil {
+		return nil
+	}
+	err := w.seal(lastChunkAD)
+	w.buf = nil
+	if err == nil {
+		err = w.w.Flush()
+	}
+	if err != nil {
+		_ = w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// decryptingReader opens the chunks sealed by encryptingWriter
+type decryptingReader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	buf   []byte
+	index uint64
+	done  bool
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		sealed, err := readFrame(r.r)
+		if errors.Is(err, io.EOF) {
+			return 0, fmt.Errorf("encrypted archive is truncated: %w", io.ErrUnexpectedEOF)
+		}
+		if err != nil {
+			return 0, err
+		}
+		nonce := chunkNonce(r.aead, r.index)
+		r.index++
+		if r.buf, err = r.aead.Open(nil, nonce, sealed, chunkAD); err == nil {
+			continue
+		}
+		if r.buf, err = r.aead.Open(nil, nonce, sealed, lastChunkAD); err != nil {
+			return 0, fmt.Errorf("failed to decrypt chunk %d: %w", r.index-1, err)
+		}
+		r.done = true
+		if _, err := r.r.Peek(1); !errors.Is(err, io.EOF) {
+			return 0, fmt.Errorf("unexpected data after the last chunk of the encrypted archive")
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func chunkNonce(aead cipher.AEAD, index uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], index)
+	return nonce
+}
+
+func writeFrame(w io.Writer, data []byte) error {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+	if _, err := w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > encryptionChunkSize+1024 {
+		return nil, fmt.Errorf("invalid frame size %d", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,359 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	kmapi "kmodules.xyz/client-go/api/v1"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, encryptionKeySize)
+}
+
+// testArchiveData returns data spanning three full chunks and a partial last one
+func testArchiveData() []byte {
+	data := make([]byte, 3*encryptionChunkSize+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+func writeTestArchive(t *testing.T, e *archiveEncryption, data []byte) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "archive")
+	w, err := e.create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// write in pieces that do not line up with the chunks
+	for len(data) > 0 {
+		n := min(len(data), 10000)
+		if _, err := w.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func readTestArchive(e *archiveEncryption, file string) ([]byte, error) {
+	r, err := e.open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// splitTestArchive splits an encrypted archive into the magic along with the header frame and the chunk frames
+func splitTestArchive(t *testing.T, file string) ([]byte, [][]byte) {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := func(off int) int {
+		return off + 4 + int(binary.BigEndian.Uint32(data[off:]))
+	}
+	off := frame(len(encryptionMagic))
+	head := data[:off]
+	var chunks [][]byte
+	for off < len(data) {
+		end := frame(off)
+		chunks = append(chunks, data[off:end])
+		off = end
+	}
+	return head, chunks
+}
+
+func joinTestArchive(t *testing.T, file string, head []byte, chunks [][]byte) {
+	t.Helper()
+	data := append([]byte{}, head...)
+	for _, c := range chunks {
+		data = append(data, c...)
+	}
+	if err := os.WriteFile(file, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveEncryption(t *testing.T) {
+	encryption := &archiveEncryption{keyID: "k1", keys: map[string][]byte{"k1": testKey(1)}}
+	data := testArchiveData()
+
+	cases := []struct {
+		name string
+		// read decrypts the archive with these keys instead of the ones it was encrypted with
+		read *archiveEncryption
+		// modify tampers with the encrypted archive
+		modify  func(head []byte, chunks [][]byte) ([]byte, [][]byte)
+		wantErr string
+	}{
+		{
+			name: "round trip",
+		},
+		{
+			name:    "wrong key",
+			read:    &archiveEncryption{keyID: "k1", keys: map[string][]byte{"k1": testKey(2)}},
+			wantErr: `failed to unwrap the data key with key "k1"`,
+		},
+		{
+			name:    "unknown key",
+			read:    &archiveEncryption{keyID: "k2", keys: map[string][]byte{"k2": testKey(1)}},
+			wantErr: `key "k1" not found in the encryption secret`,
+		},
+		{
+			name: "flipped header byte",
+			modify: func(head []byte, chunks [][]byte) ([]byte, [][]byte) {
+				// the last bytes of the header are the end of the wrapped key
+				head[len(head)-5] ^= 0x01
+				return head, chunks
+			},
+			wantErr: "failed to decrypt",
+		},
+		{
+			name: "flipped chunk byte",
+			modify: func(head []byte, chunks [][]byte) ([]byte, [][]byte) {
+				chunks[1][100] ^= 0x01
+				return head, chunks
+			},
+			wantErr: "failed to decrypt chunk 1",
+		},
+		{
+			name: "dropped chunk",
+			modify: func(head []byte, chunks [][]byte) ([]byte, [][]byte) {
+				return head, append(chunks[:1:1], chunks[2:]...)
+			},
+			wantErr: "failed to decrypt chunk 1",
+		},
+		{
+			name: "reordered chunks",
+			modify: func(head []byte, chunks [][]byte) ([]byte, [][]byte) {
+				chunks[1], chunks[2] = chunks[2], chunks[1]
+				return head, chunks
+			},
+			wantErr: "failed to decrypt chunk 1",
+		},
+		{
+			name: "truncated at a chunk boundary",
+			modify: func(head []byte, chunks [][]byte) ([]byte, [][]byte) {
+				return head, chunks[:len(chunks)-1]
+			},
+			wantErr: "encrypted archive is truncated",
+		},
+		{
+			name: "truncated within a chunk",
+			modify: func(head []byte, chunks [][]byte) ([]byte, [][]byte) {
+				chunks[1] = chunks[1][:1000]
+				return head, chunks[:2]
+			},
+			wantErr: io.ErrUnexpectedEOF.Error(),
+		},
+		{
+			name: "data after the last chunk",
+			modify: func(head []byte, chunks [][]byte) ([]byte, [][]byte) {
+				return head, append(chunks, chunks[0])
+			},
+			wantErr: "unexpected data after the last chunk",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			file := writeTestArchive(t, encryption, data)
+			head, chunks := splitTestArchive(t, file)
+			if len(chunks) != 4 {
+				t.Fatalf("archive holds %d chunks, expected 4", len(chunks))
+			}
+			if c.modify != nil {
+				head, chunks = c.modify(head, chunks)
+				joinTestArchive(t, file, head, chunks)
+			}
+			read := encryption
+			if c.read != nil {
+				read = c.read
+			}
+
+			got, err := readTestArchive(read, file)
+			if c.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", c.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("decrypted %d bytes that differ from the %d bytes written", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestArchiveEncryptionEdgeSizes(t *testing.T) {
+	encryption := &archiveEncryption{keyID: "k1", keys: map[string][]byte{"k1": testKey(1)}}
+	for _, size := range []int{0, 1, encryptionChunkSize - 1, encryptionChunkSize, encryptionChunkSize + 1, 2 * encryptionChunkSize} {
+		data := bytes.Repeat([]byte{7}, size)
+		file := writeTestArchive(t, encryption, data)
+		_, chunks := splitTestArchive(t, file)
+		// a full last chunk is not followed by an empty one
+		if want := max(1, (size+encryptionChunkSize-1)/encryptionChunkSize); len(chunks) != want {
+			t.Errorf("size %d: archive holds %d chunks, expected %d", size, len(chunks), want)
+		}
+		got, err := readTestArchive(encryption, file)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("size %d: decrypted %d bytes", size, len(got))
+		}
+	}
+}
+
+func TestArchiveEncryptionPlaintext(t *testing.T) {
+	encryption := &archiveEncryption{keyID: "k1", keys: map[string][]byte{"k1": testKey(1)}}
+	data := testArchiveData()
+
+	// archives taken without encryption are read as they are
+	plain := writeTestArchive(t, nil, data)
+	got, err := readTestArchive(encryption, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes of a plaintext archive, expected %d", len(got), len(data))
+	}
+
+	// encrypted archives are refused without the keys
+	encrypted := writeTestArchive(t, encryption, data)
+	if _, err := readTestArchive(nil, encrypted); !errors.Is(err, errArchiveEncrypted) {
+		t.Errorf("expected %v, got %v", errArchiveEncrypted, err)
+	}
+}
+
+func TestLoadEncryption(t *testing.T) {
+	cases := []struct {
+		name    string
+		keys    map[string][]byte
+		keyID   string
+		wantID  string
+		wantErr string
+	}{
+		{
+			name:   "single key",
+			keys:   map[string][]byte{"k1": testKey(1)},
+			wantID: "k1",
+		},
+		{
+			name:    "multiple keys without key id",
+			keys:    map[string][]byte{"k1": testKey(1), "k2": testKey(2)},
+			wantErr: "holds keys [k1 k2]. Select one of them with --encryption-key-id",
+		},
+		{
+			name:   "multiple keys with key id",
+			keys:   map[string][]byte{"k1": testKey(1), "k2": testKey(2)},
+			keyID:  "k2",
+			wantID: "k2",
+		},
+		{
+			name:    "missing key id",
+			keys:    map[string][]byte{"k1": testKey(1)},
+			keyID:   "k2",
+			wantErr: `key "k2" not found`,
+		},
+		{
+			name:    "short key",
+			keys:    map[string][]byte{"k1": testKey(1), "k2": []byte("short")},
+			keyID:   "k1",
+			wantErr: `key "k2" of encryption secret demo/keys must be 32 bytes long`,
+		},
+		{
+			name:    "key id without secret",
+			keyID:   "k1",
+			wantErr: "--encryption-key-id requires --encryption-secret-name",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			opt := &natsOptions{
+				ctx:             context.Background(),
+				encryptionKeyID: c.keyID,
+				kubeClient:      fake.NewSimpleClientset(),
+			}
+			if c.keys != nil {
+				opt.encryptionSecret = kmapi.ObjectReference{Namespace: "demo", Name: "keys"}
+				opt.kubeClient = fake.NewSimpleClientset(&core.Secret{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "demo", Name: "keys"},
+					Data:       c.keys,
+				})
+			}
+
+			err := opt.loadEncryption()
+			if c.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", c.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := opt.encryption.currentKeyID(); got != c.wantID {
+				t.Errorf("selected key %q, expected %q", got, c.wantID)
+			}
+		})
+	}
+}
+
+func TestArchiveEncryptionKeyRotation(t *testing.T) {
+	old := &archiveEncryption{keyID: "k1", keys: map[string][]byte{"k1": testKey(1)}}
+	rotated := &archiveEncryption{keyID: "k2", keys: map[string][]byte{"k1": testKey(1), "k2": testKey(2)}}
+	data := testArchiveData()
+
+	// archives encrypted with the earlier key are read with the key recorded in their header
+	oldFile := writeTestArchive(t, old, data)
+	got, err := readTestArchive(rotated, oldFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("decrypted %d bytes, expected %d", len(got), len(data))
+	}
+
+	// new archives are encrypted with the selected key only
+	newFile := writeTestArchive(t, rotated, data)
+	if _, err := readTestArchive(old, newFile); err == nil || !strings.Contains(err.Error(), `key "k2" not found`) {
+		t.Errorf("expected the archive to be encrypted with key k2, got %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	stash "stash.appscode.dev/apimachinery/client/clientset/versioned"
+	"stash.appscode.dev/apimachinery/pkg/invoker"
+
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	appcatalog "kmodules.xyz/custom-resources/apis/appcatalog/v1alpha1"
+)
+
+const (
+	EventSourceNATS = "stash-nats"
+
+	EventOperationBackup  = "Backup"
+	EventOperationRestore = "Restore"
+
+	// AnnotationPhase holds the overall phase of the run on the session
+	AnnotationPhase = "nats.stash.appscode.com/phase"
+	// AnnotationStreams holds a summary of every processed stream on the session
+	AnnotationStreams = "nats.stash.appscode.com/streams"
+
+	// maxStreamsAnnotationSize keeps the summary well within the size limit of the annotations of an object
+	maxStreamsAnnotationSize = 32 * 1024
+)
+
+// runEvents reports the progress of a backup or restore run as Kubernetes events on the app binding and
+// on the session that has invoked the run. A failure to report is only logged, so that it does not fail the run.
+type runEvents struct {
+	kubeClient  kubernetes.Interface
+	stashClient stash.Interface
+	// operation is either Backup or Restore. It prefixes the reason of every event.
+	operation string
+	objects   []*core.ObjectReference
+	// session is the BackupSession, RestoreSession or RestoreBatch the summary annotations are written on
+	session *core.ObjectReference
+}
+
+// newRunEvents creates the event recorder of the run. The session is looked up by sessionKind and sessionName,
+// and it is left out when it is not given or can not be read.
+func (opt *natsOptions) newRunEvents(operation string, appBinding *appcatalog.AppBinding, sessionKind, sessionName string) *runEvents {
+	e := &runEvents{
+		kubeClient:  opt.kubeClient,
+		stashClient: opt.stashClient,
+		operation:   operation,
+		objects: []*core.ObjectReference{
+			{
+				APIVersion:      appcatalog.SchemeGroupVersion.String(),
+				Kind:            appcatalog.ResourceKindApp,
+				Namespace:       appBinding.Namespace,
+				Name:            appBinding.Name,
+				UID:             appBinding.UID,
+				ResourceVersion: appBinding.ResourceVersion,
+			},
+		},
+	}
+	if sessionName == "" || opt.stashClient == nil {
+		return e
+	}
+	session, err := opt.getSessionRef(sessionKind, sessionName)
+	if err != nil {
+		klog.Warningf("Failed to read %s %s/%s. No event is recorded for it. Reason: %v", sessionKind, opt.namespace, sessionName, err)
+		return e
+	}
+	e.session = session
+	e.objects = append(e.objects, session)
+	return e
+}
+
+func (opt *natsOptions) getSessionRef(kind, name string) (*core.ObjectReference, error) {
+	if kind != api_v1beta1.ResourceKindBackupSession {
+		inv, err := invoker.NewRestoreInvoker(opt.kubeClient, opt.stashClient, kind, name, opt.namespace)
+		if err != nil {
+			return nil, err
+		}
+		return inv.GetObjectRef()
+	}
+	bs, err := opt.stashClient.StashV1beta1().BackupSessions(opt.namespace).Get(opt.ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &core.ObjectReference{
+		APIVersion:      api_v1beta1.SchemeGroupVersion.String(),
+		Kind:            api_v1beta1.ResourceKindBackupSession,
+		Namespace:       bs.Namespace,
+		Name:            bs.Name,
+		UID:             bs.UID,
+		ResourceVersion: bs.ResourceVersion,
+	}, nil
+}
+
+// started records the start of the run
+func (e *runEvents) started(ctx context.Context) {
+	if e == nil {
+		return
+	}
+	e.record(ctx, core.EventTypeNormal, e.operation+"Started", fmt.Sprintf("%s of the NATS streams has started", e.operation))
+}
+
+// streamProcessed records the outcome of a single stream
+func (e *runEvents) streamProcessed(ctx context.Context, result streamResult) {
+	if e == nil {
+		return
+	}
+	name := streamDisplayName(result)
+	if result.Phase == StreamPhaseFailed {
+		e.record(ctx, core.EventTypeWarning, "Stream"+e.operation+"Failed",
+			fmt.Sprintf("%s of stream %s has failed. Reason: %s", e.operation, name, result.Error))
+		return
+	}
+	e.record(ctx, core.EventTypeNormal, "Stream"+e.operation+"Succeeded",
+		fmt.Sprintf("%s of stream %s has succeeded with %d messages (%d bytes) in %s", e.operation, name, result.Messages, result.Bytes, result.Duration))
+}
+
+// completed records the end of the run and writes the summary of the streams as annotations of the session
+func (e *runEvents) completed(ctx context.Context, phase string, runErr error, results []streamResult) {
+	if e == nil {
+		return
+	}
+	failed := 0
+	for _, result := range results {
+		if result.Phase == StreamPhaseFailed {
+			failed++
+		}
+	}
+	switch {
+	case runErr != nil:
+		e.record(ctx, core.EventTypeWarning, e.operation+"Failed",
+			fmt.Sprintf("%s of the NATS streams has failed. Reason: %v", e.operation, runErr))
+	case failed != 0:
+		e.record(ctx, core.EventTypeWarning, e.operation+PhasePartiallySucceeded,
+			fmt.Sprintf("%s has failed for %d of %d streams", e.operation, failed, len(results)))
+	default:
+		e.record(ctx, core.EventTypeNormal, e.operation+"Succeeded",
+			fmt.Sprintf("%s of %d streams has succeeded", e.operation, len(results)))
+	}
+
+	if err := e.annotateSession(ctx, phase, results); err != nil {
+		klog.Warningf("Failed to write the stream summary on %s %s/%s. Reason: %v", e.session.Kind, e.session.Namespace, e.session.Name, err)
+	}
+}
+
+func (e *runEvents) record(ctx context.Context, eventType, reason, message string) {
+	for _, obj := range e.objects {
+		t := metav1.Now()
+		_, err := e.kubeClient.CoreV1().Events(obj.Namespace).Create(ctx, &core.Event{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("%v.%x", obj.Name, t.UnixNano()),
+				Namespace: obj.Namespace,
+			},
+			InvolvedObject: *obj,
+			Reason:         reason,
+			Message:        message,
+			FirstTimestamp: t,
+			LastTimestamp:  t,
+			Count:          1,
+			Type:           eventType,
+			Source:         core.EventSource{Component: EventSourceNATS},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			klog.Warningf("Failed to record event %s on %s %s/%s. Reason: %v", reason, obj.Kind, obj.Namespace, obj.Name, err)
+		}
+	}
+}
+
+// annotateSession writes the overall phase and a summary of the streams on the session
+func (e *runEvents) annotateSession(ctx context.Context, phase string, results []streamResult) error {
+	if e.session == nil {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{
+				AnnotationPhase:   phase,
+				AnnotationStreams: streamsSummary(results),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	v1beta1 := e.stashClient.StashV1beta1()
+	switch e.session.Kind {
+	case api_v1beta1.ResourceKindBackupSession:
+		_, err = v1beta1.BackupSessions(e.session.Namespace).Patch(ctx, e.session.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	case api_v1beta1.ResourceKindRestoreSession:
+		_, err = v1beta1.RestoreSessions(e.session.Namespace).Patch(ctx, e.session.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	case api_v1beta1.ResourceKindRestoreBatch:
+		_, err = v1beta1.RestoreBatches(e.session.Namespace).Patch(ctx, e.session.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	default:
+		err = fmt.Errorf("unsupported kind %s", e.session.Kind)
+	}
+	return err
+}
+
+// streamsSummary returns a compact summary of the streams, i.e. "orders: Succeeded, 10 messages, 2048 bytes, 1.5s; events: Failed"
+func streamsSummary(results []streamResult) string {
+	entries := make([]string, 0, len(results))
+	size := 0
+	for i, result := range results {
+		entry := streamDisplayName(result) + ": " + result.Phase
+		if result.Phase != StreamPhaseFailed {
+			entry += fmt.Sprintf(", %d messages, %d bytes", result.Messages, result.Bytes)
+		}
+		if d, err := time.ParseDuration(result.Duration); err == nil {
+			entry += ", " + d.Round(time.Millisecond).String()
+		}
+		if size+len(entry) > maxStreamsAnnotationSize {
+			entries = append(entries, fmt.Sprintf("and %d more streams", len(results)-i))
+			break
+		}
+		size += len(entry) + 2
+		entries = append(entries, entry)
+	}
+	return strings.Join(entries, "; ")
+}
+
+// streamDisplayName returns the name of the stream along with its account in a multi-account run
+func streamDisplayName(result streamResult) string {
+	if result.Account != "" {
+		return result.Account + "/" + result.Stream
+	}
+	return result.Stream
+}
@@ -0,0 +1,401 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"stash.appscode.dev/apimachinery/apis"
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	"stash.appscode.dev/apimachinery/pkg/conditions"
+	"stash.appscode.dev/apimachinery/pkg/invoker"
+
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/klog/v2"
+	appcatalog "kmodules.xyz/custom-resources/apis/appcatalog/v1alpha1"
+	prober "kmodules.xyz/prober/api/v1"
+)
+
+// hookResult is the outcome of a single hook
+type hookResult struct {
+	Hook     string `json:"hook"`
+	Phase    string `json:"phase"`
+	Duration string `json:"duration,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// hookRequestTimeout limits the requests of the HTTP handlers when no hook timeout is set
+const hookRequestTimeout = 5 * time.Minute
+
+// restoreHooks executes the hooks of the restore invoker for the restored app binding.
+// The hooks run in the restore job. The HTTP and TCP handlers connect to the host of the app binding unless they
+// specify one, and their named ports are looked up in the service of the app binding. The HTTP handlers connecting to
+// the host of the app binding trust its CA bundle and verify its server name. Stash runs the exec handlers
+// inside the pod of the target workload, but an app binding has no workload, so the exec handlers are refused
+// instead of being run in the restore job, where they could not reach the app.
+type restoreHooks struct {
+	inv       invoker.RestoreInvoker
+	hooks     *api_v1beta1.RestoreHooks
+	host      string
+	ports     map[string]int
+	tlsConfig *tls.Config
+	timeout   time.Duration
+	results   []hookResult
+}
+
+// loadRestoreHooks reads the hooks of the target from the restore invoker. It returns nil if no invoker is given.
+func (opt *natsOptions) loadRestoreHooks(appBinding *appcatalog.AppBinding, targetRef api_v1beta1.TargetRef) (*restoreHooks, error) {
+	if opt.invokerName == "" {
+		return nil, nil
+	}
+	inv, err := invoker.NewRestoreInvoker(opt.kubeClient, opt.stashClient, opt.invokerKind, opt.invokerName, opt.namespace)
+	if err != nil {
+		return nil, err
+	}
+	if targetRef.Namespace == "" {
+		targetRef.Namespace = opt.namespace
+	}
+	h := &restoreHooks{
+		inv:     inv,
+		timeout: opt.hookTimeout,
+	}
+	for _, info := range inv.GetTargetInfo() {
+		if info.Target != nil && invoker.TargetMatched(info.Target.Ref, targetRef) {
+			h.hooks = info.Hooks
+		}
+	}
+	for name, handler := range h.handlers() {
+		if handler.Exec != nil {
+			return nil, fmt.Errorf("%s hook of %s/%s uses an exec handler, which is not supported for an app binding. Use an HTTP or a TCP socket handler instead",
+				name, opt.invokerKind, opt.invokerName)
+		}
+	}
+	if h.host, err = appBinding.Hostname(); err != nil {
+		return nil, err
+	}
+	if h.ports, err = opt.resolveHookPorts(appBinding, h.handlers()); err != nil {
+		return nil, err
+	}
+	if h.tlsConfig, err = hookTLSConfig(appBinding); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// hookTLSConfig returns the TLS configuration for connecting to the host of the app binding
+func hookTLSConfig(appBinding *appcatalog.AppBinding) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: appBinding.Spec.ClientConfig.ServerName,
+	}
+	if len(appBinding.Spec.ClientConfig.CABundle) != 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(appBinding.Spec.ClientConfig.CABundle) {
+			return nil, fmt.Errorf("no certificate found in the CA bundle of app binding %s/%s", appBinding.Namespace, appBinding.Name)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// httpClient returns the client of an HTTP handler connecting to host. The TLS configuration of the app binding is
+// only used when the handler connects to the host of the app binding, i.e. when it specifies no host.
+func (h *restoreHooks) httpClient(host string) *http.Client {
+	timeout := h.timeout
+	if timeout <= 0 {
+		timeout = hookRequestTimeout
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if host == "" && h.tlsConfig != nil {
+		transport.TLSClientConfig = h.tlsConfig.Clone()
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}
+}
+
+// resolveHookPorts looks up the named ports of the handlers in the service of the app binding, as there is no pod
+// to look them up in. The service is only read when a handler uses a named port.
+func (opt *natsOptions) resolveHookPorts(appBinding *appcatalog.AppBinding, handlers map[string]*prober.Handler) (map[string]int, error) {
+	var names []string
+	for _, handler := range handlers {
+		if port, ok := handlerPort(handler); ok && port.Type == intstr.String {
+			if _, err := strconv.Atoi(port.StrVal); err != nil {
+				names = append(names, port.StrVal)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	ref := appBinding.Spec.ClientConfig.Service
+	if ref == nil {
+		return nil, fmt.Errorf("named port %q of the hooks can not be resolved as app binding %s/%s does not refer to a service",
+			names[0], appBinding.Namespace, appBinding.Name)
+	}
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = appBinding.Namespace
+	}
+	svc, err := opt.kubeClient.CoreV1().Services(namespace).Get(opt.ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve the named ports of the hooks: %w", err)
+	}
+	ports := map[string]int{}
+	for _, port := range svc.Spec.Ports {
+		if port.Name != "" {
+			ports[port.Name] = int(port.Port)
+		}
+	}
+	for _, name := range names {
+		if _, ok := ports[name]; !ok {
+			return nil, fmt.Errorf("service %s/%s has no port named %q", namespace, ref.Name, name)
+		}
+	}
+	return ports, nil
+}
+
+// handlerPort returns the port a handler connects to
+func handlerPort(handler *prober.Handler) (intstr.IntOrString, bool) {
+	switch {
+	case handler.HTTPGet != nil:
+		return handler.HTTPGet.Port, true
+	case handler.HTTPPost != nil:
+		return handler.HTTPPost.Port, true
+	case handler.TCPSocket != nil:
+		return handler.TCPSocket.Port, true
+	}
+	return intstr.IntOrString{}, false
+}
+
+// handlers returns the handlers of the hooks by the name of their hook
+func (h *restoreHooks) handlers() map[string]*prober.Handler {
+	handlers := map[string]*prober.Handler{}
+	if h.hooks == nil {
+		return handlers
+	}
+	if h.hooks.PreRestore != nil {
+		handlers[apis.PreRestoreHook] = h.hooks.PreRestore
+	}
+	if h.hooks.PostRestore != nil && h.hooks.PostRestore.Handler != nil {
+		handlers[apis.PostRestoreHook] = h.hooks.PostRestore.Handler
+	}
+	return handlers
+}
+
+// executePreRestore executes the preRestore hook. The restore must not start if it fails.
+func (h *restoreHooks) executePreRestore(ctx context.Context) error {
+	if h == nil || h.hooks == nil || h.hooks.PreRestore == nil {
+		return nil
+	}
+	err := h.execute(ctx, apis.PreRestoreHook, h.hooks.PreRestore)
+	if err != nil {
+		h.setCondition(conditions.SetPreRestoreHookExecutionSucceededToFalse(h.inv, err))
+		return fmt.Errorf("failed to execute %s hook: %w", apis.PreRestoreHook, err)
+	}
+	h.setCondition(conditions.SetPreRestoreHookExecutionSucceededToTrue(h.inv))
+	return nil
+}
+
+// executePostRestore executes the postRestore hook if its execution policy matches the outcome of the restore
+func (h *restoreHooks) executePostRestore(ctx context.Context, restoreSucceeded bool) error {
+	if h == nil || h.hooks == nil || h.hooks.PostRestore == nil || h.hooks.PostRestore.Handler == nil {
+		return nil
+	}
+	switch h.hooks.PostRestore.ExecutionPolicy {
+	case api_v1beta1.ExecuteOnSuccess:
+		if !restoreSucceeded {
+			return h.skipPostRestore("the restore has failed")
+		}
+	case api_v1beta1.ExecuteOnFailure:
+		if restoreSucceeded {
+			return h.skipPostRestore("the restore has succeeded")
+		}
+	}
+	err := h.execute(ctx, apis.PostRestoreHook, h.hooks.PostRestore.Handler)
+	if err != nil {
+		h.setCondition(conditions.SetPostRestoreHookExecutionSucceededToFalse(h.inv, err))
+		return fmt.Errorf("failed to execute %s hook: %w", apis.PostRestoreHook, err)
+	}
+	h.setCondition(conditions.SetPostRestoreHookExecutionSucceededToTrue(h.inv))
+	return nil
+}
+
+func (h *restoreHooks) skipPostRestore(reason string) error {
+	msg := fmt.Sprintf("Skipped executing %s hook as %s.", apis.PostRestoreHook, reason)
+	klog.Infoln(msg)
+	h.setCondition(conditions.SetPostRestoreHookExecutionSucceededToTrueWithMsg(h.inv, msg))
+	return nil
+}
+
+// setCondition logs the failure to update the condition of the invoker. It does not fail the restore.
+func (h *restoreHooks) setCondition(err error) {
+	if err != nil {
+		klog.Warningf("Failed to update the condition of %s/%s. Reason: %v", h.inv.GetTypeMeta().Kind, h.inv.GetObjectMeta().Name, err)
+	}
+}
+
+// list returns the results of the executed hooks
+func (h *restoreHooks) list() []hookResult {
+	if h == nil {
+		return nil
+	}
+	return h.results
+}
+
+func (h *restoreHooks) execute(ctx context.Context, name string, handler *prober.Handler) error {
+	klog.Infof("Executing %s hook", name)
+	startTime := time.Now()
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+	err := h.executeHandler(ctx, handler)
+
+	result := hookResult{
+		Hook:     name,
+		Phase:    StreamPhaseSucceeded,
+		Duration: time.Since(startTime).String(),
+	}
+	if err != nil {
+		klog.Errorf("Failed to execute %s hook. Reason: %v", name, err)
+		result.Phase = StreamPhaseFailed
+		result.Error = err.Error()
+	} else {
+		klog.Infof("Successfully executed %s hook", name)
+	}
+	h.results = append(h.results, result)
+	return err
+}
+
+func (h *restoreHooks) executeHandler(ctx context.Context, handler *prober.Handler) error {
+	switch {
+	case handler.HTTPGet != nil:
+		get := handler.HTTPGet
+		u, err := h.hookURL(get.Scheme, get.Host, get.Port, get.Path)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return err
+		}
+		return doHookRequest(h.httpClient(get.Host), req, get.HTTPHeaders)
+	case handler.HTTPPost != nil:
+		post := handler.HTTPPost
+		u, err := h.hookURL(post.Scheme, post.Host, post.Port, post.Path)
+		if err != nil {
+			return err
+		}
+		body, contentType := post.Body, "application/json"
+		if len(post.Form) != 0 {
+			form := url.Values{}
+			for _, entry := range post.Form {
+				form[entry.Key] = entry.Values
+			}
+			body, contentType = form.Encode(), "application/x-www-form-urlencoded"
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", contentType)
+		return doHookRequest(h.httpClient(post.Host), req, post.HTTPHeaders)
+	case handler.TCPSocket != nil:
+		tcp := handler.TCPSocket
+		port, err := h.port(tcp.Port)
+		if err != nil {
+			return err
+		}
+		host := tcp.Host
+		if host == "" {
+			host = h.host
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	return fmt.Errorf("hook has no handler")
+}
+
+func (h *restoreHooks) hookURL(scheme core.URIScheme, host string, port intstr.IntOrString, path string) (string, error) {
+	p, err := h.port(port)
+	if err != nil {
+		return "", err
+	}
+	if scheme == "" {
+		scheme = core.URISchemeHTTP
+	}
+	if host == "" {
+		host = h.host
+	}
+	u := url.URL{
+		Scheme: strings.ToLower(string(scheme)),
+		Host:   net.JoinHostPort(host, strconv.Itoa(p)),
+		Path:   path,
+	}
+	return u.String(), nil
+}
+
+// port returns the port of a handler, resolving a named port through the service of the app binding
+func (h *restoreHooks) port(port intstr.IntOrString) (int, error) {
+	if port.Type == intstr.String {
+		if p, err := strconv.Atoi(port.StrVal); err == nil {
+			return p, nil
+		}
+		if p, ok := h.ports[port.StrVal]; ok {
+			return p, nil
+		}
+		return 0, fmt.Errorf("named port %q has not been resolved", port.StrVal)
+	}
+	return port.IntValue(), nil
+}
+
+// doHookRequest sends the request of an HTTP handler. Any status out of the 2xx and 3xx range is a failure.
+func doHookRequest(client *http.Client, req *http.Request, headers []core.HTTPHeader) error {
+	for _, header := range headers {
+		req.Header.Add(header.Name, header.Value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("%s %s returned %s: %s", req.Method, req.URL, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	stash_fake "stash.appscode.dev/apimachinery/client/clientset/versioned/fake"
+
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	appcatalog "kmodules.xyz/custom-resources/apis/appcatalog/v1alpha1"
+	prober "kmodules.xyz/prober/api/v1"
+)
+
+const hookTestNamespace = "demo"
+
+func hookTestAppBinding(url string) *appcatalog.AppBinding {
+	return &appcatalog.AppBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: "nats", Namespace: hookTestNamespace},
+		Spec: appcatalog.AppBindingSpec{
+			ClientConfig: appcatalog.ClientConfig{URL: &url},
+		},
+	}
+}
+
+func hookTestTargetRef() api_v1beta1.TargetRef {
+	return api_v1beta1.TargetRef{
+		APIVersion: appcatalog.SchemeGroupVersion.String(),
+		Kind:       appcatalog.ResourceKindApp,
+		Name:       "nats",
+		Namespace:  hookTestNamespace,
+	}
+}
+
+// loadTestRestoreHooks loads the hooks of a RestoreSession targeting the app binding
+func loadTestRestoreHooks(appBinding *appcatalog.AppBinding, hooks *api_v1beta1.RestoreHooks, objects ...runtime.Object) (*restoreHooks, error) {
+	restoreSession := &api_v1beta1.RestoreSession{
+		ObjectMeta: metav1.ObjectMeta{Name: "restore", Namespace: hookTestNamespace},
+		Spec: api_v1beta1.RestoreSessionSpec{
+			RestoreTargetSpec: api_v1beta1.RestoreTargetSpec{
+				Target: &api_v1beta1.RestoreTarget{Ref: hookTestTargetRef()},
+				Hooks:  hooks,
+			},
+		},
+	}
+	opt := &natsOptions{
+		ctx:         context.Background(),
+		kubeClient:  fake.NewSimpleClientset(objects...),
+		stashClient: stash_fake.NewSimpleClientset(restoreSession),
+		namespace:   hookTestNamespace,
+		invokerKind: api_v1beta1.ResourceKindRestoreSession,
+		invokerName: restoreSession.Name,
+	}
+	return opt.loadRestoreHooks(appBinding, hookTestTargetRef())
+}
+
+func TestLoadRestoreHooks(t *testing.T) {
+	exec := &prober.Handler{Exec: &core.ExecAction{Command: []string{"true"}}}
+	httpGet := &prober.Handler{HTTPGet: &core.HTTPGetAction{Port: intstr.FromInt32(8222), Path: "/healthz"}}
+
+	cases := []struct {
+		name  string
+		hooks *api_v1beta1.RestoreHooks
+		err   string
+	}{
+		{
+			name: "no hooks",
+		},
+		{
+			name: "http handlers",
+			hooks: &api_v1beta1.RestoreHooks{
+				PreRestore:  httpGet,
+				PostRestore: &api_v1beta1.PostRestoreHook{Handler: httpGet},
+			},
+		},
+		{
+			name:  "exec preRestore handler",
+			hooks: &api_v1beta1.RestoreHooks{PreRestore: exec},
+			err:   "preRestore hook of RestoreSession/restore uses an exec handler",
+		},
+		{
+			name:  "exec postRestore handler",
+			hooks: &api_v1beta1.RestoreHooks{PostRestore: &api_v1beta1.PostRestoreHook{Handler: exec}},
+			err:   "postRestore hook of RestoreSession/restore uses an exec handler",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h, err := loadTestRestoreHooks(hookTestAppBinding("nats://nats.demo.svc:4222"), c.hooks)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("expected error containing %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if h.host != "nats.demo.svc" {
+				t.Errorf("expected host nats.demo.svc, got %q", h.host)
+			}
+		})
+	}
+}
+
+func TestResolveHookPorts(t *testing.T) {
+	service := &core.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "nats", Namespace: hookTestNamespace},
+		Spec: core.ServiceSpec{
+			Ports: []core.ServicePort{
+				{Name: "client", Port: 4222},
+				{Name: "monitor", Port: 8222},
+			},
+		},
+	}
+	serviceBinding := &appcatalog.AppBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: "nats", Namespace: hookTestNamespace},
+		Spec: appcatalog.AppBindingSpec{
+			ClientConfig: appcatalog.ClientConfig{
+				Service: &appcatalog.ServiceReference{Scheme: "nats", Name: "nats", Port: 4222},
+			},
+		},
+	}
+	hooksWithPort := func(port intstr.IntOrString) *api_v1beta1.RestoreHooks {
+		return &api_v1beta1.RestoreHooks{
+			PreRestore:  &prober.Handler{HTTPGet: &core.HTTPGetAction{Port: port, Path: "/healthz"}},
+			PostRestore: &api_v1beta1.PostRestoreHook{Handler: &prober.Handler{TCPSocket: &core.TCPSocketAction{Port: port}}},
+		}
+	}
+
+	cases := []struct {
+		name       string
+		appBinding *appcatalog.AppBinding
+		port       intstr.IntOrString
+		expected   int
+		err        string
+	}{
+		{
+			name:       "number",
+			appBinding: hookTestAppBinding("nats://nats.demo.svc:4222"),
+			port:       intstr.FromInt32(8222),
+			expected:   8222,
+		},
+		{
+			name:       "number as string",
+			appBinding: hookTestAppBinding("nats://nats.demo.svc:4222"),
+			port:       intstr.FromString("8222"),
+			expected:   8222,
+		},
+		{
+			name:       "named port of the service",
+			appBinding: serviceBinding,
+			port:       intstr.FromString("monitor"),
+			expected:   8222,
+		},
+		{
+			name:       "unknown named port",
+			appBinding: serviceBinding,
+			port:       intstr.FromString("metrics"),
+			err:        `has no port named "metrics"`,
+		},
+		{
+			name:       "named port without service",
+			appBinding: hookTestAppBinding("nats://nats.demo.svc:4222"),
+			port:       intstr.FromString("monitor"),
+			err:        "does not refer to a service",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h, err := loadTestRestoreHooks(c.appBinding, hooksWithPort(c.port), service)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("expected error containing %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			port, err := h.port(c.port)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if port != c.expected {
+				t.Errorf("expected port %d, got %d", c.expected, port)
+			}
+			u, err := h.hookURL("", "", c.port, "/healthz")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if expected := "http://" + h.host + ":" + strconv.Itoa(c.expected) + "/healthz"; u != expected {
+				t.Errorf("expected URL %s, got %s", expected, u)
+			}
+		})
+	}
+}
+
+func TestHTTPHookTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(time.Second)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	caBundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	cases := []struct {
+		name       string
+		caBundle   []byte
+		serverName string
+		path       string
+		timeout    time.Duration
+		err        string
+	}{
+		{
+			name:       "trusted CA bundle and server name",
+			caBundle:   caBundle,
+			serverName: "example.com",
+			path:       "/healthz",
+		},
+		{
+			name:     "trusted CA bundle and the IP address",
+			caBundle: caBundle,
+			path:     "/healthz",
+		},
+		{
+			name: "no CA bundle",
+			path: "/healthz",
+			err:  "certificate",
+		},
+		{
+			name:       "wrong server name",
+			caBundle:   caBundle,
+			serverName: "nats.example.org",
+			path:       "/healthz",
+			err:        "certificate",
+		},
+		{
+			name:     "timeout",
+			caBundle: caBundle,
+			path:     "/slow",
+			timeout:  100 * time.Millisecond,
+			err:      "Client.Timeout",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			appBinding := hookTestAppBinding(srv.URL)
+			appBinding.Spec.ClientConfig.CABundle = c.caBundle
+			appBinding.Spec.ClientConfig.ServerName = c.serverName
+			handler := &prober.Handler{HTTPGet: &core.HTTPGetAction{Scheme: core.URISchemeHTTPS, Port: intstr.FromInt(port), Path: c.path}}
+			h, err := loadTestRestoreHooks(appBinding, &api_v1beta1.RestoreHooks{PreRestore: handler})
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.timeout = c.timeout
+
+			err = h.executeHandler(context.Background(), handler)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("expected error containing %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestHookTLSConfig(t *testing.T) {
+	appBinding := hookTestAppBinding("nats://nats.demo.svc:4222")
+	appBinding.Spec.ClientConfig.CABundle = []byte("not a certificate")
+	if _, err := hookTLSConfig(appBinding); err == nil {
+		t.Error("expected an invalid CA bundle to be refused")
+	}
+}
@@ -0,0 +1,684 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"k8s.io/klog/v2"
+)
+
+const (
+	exportBatchSize    = 256
+	exportFetchTimeout = 5 * time.Second
+)
+
+// backupState records the position of every stream covered by a snapshot.
+// Incremental backups use the state of the previous snapshot to decide from where to export messages.
+type backupState struct {
+	Streams []streamBackupState `json:"streams"`
+}
+
+type streamBackupState struct {
+	Stream string `json:"stream"`
+	// LastSeq is the last sequence of the stream covered by this snapshot
+	LastSeq uint64 `json:"lastSeq"`
+	// BaseLastSeq is the last sequence stored in the full backup of the stream
+	BaseLastSeq uint64 `json:"baseLastSeq"`
+	// BaseFirstSeq, BaseMessages and BaseBytes hold the state recorded in the full backup of the stream
+	BaseFirstSeq uint64 `json:"baseFirstSeq,omitempty"`
+	BaseMessages uint64 `json:"baseMessages,omitempty"`
+	BaseBytes    uint64 `json:"baseBytes,omitempty"`
+	// Config is the configuration of the stream at the time of this snapshot
+	Config json.RawMessage `json:"config,omitempty"`
+	// Increments lists the message ranges exported on top of the full backup, in order
+	Increments []incrementalSegment `json:"increments,omitempty"`
+	// Snapshots lists the earlier snapshots holding the full backup and the previous increments, oldest first
+	Snapshots []string `json:"snapshots,omitempty"`
+}
+
+type incrementalSegment struct {
+	FromSeq uint64 `json:"fromSeq"`
+	ToSeq   uint64 `json:"toSeq"`
+	File    string `json:"file"`
+	// Messages and Bytes count the exported messages and the size of their subjects, headers and data
+	Messages uint64 `json:"messages,omitempty"`
+	Bytes    uint64 `json:"bytes,omitempty"`
+}
+
+// messages returns the number of messages of the stream covered by the backup, including the increments
+func (s *streamBackupState) messages() (msgs, bytes uint64) {
+	msgs, bytes = s.BaseMessages, s.BaseBytes
+	for _, segment := range s.Increments {
+		msgs += segment.Messages
+		bytes += segment.Bytes
+	}
+	return msgs, bytes
+}
+
+// storedMsg is a single stream message exported by an incremental backup.
+// The format is compatible with the output of "nats stream get --json".
+type storedMsg struct {
+	Subject  string    `json:"subject"`
+	Sequence uint64    `json:"seq"`
+	Header   []byte    `json:"hdrs,omitempty"`
+	Data     []byte    `json:"data,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+func (s *backupState) find(stream string) *streamBackupState {
+	if s == nil {
+		return nil
+	}
+	for i := range s.Streams {
+		if s.Streams[i].Stream == stream {
+			return &s.Streams[i]
+		}
+	}
+	return nil
+}
+
+// latestSnapshot returns the most recent snapshot of the interim data directory taken from the given host
+func (opt *natsOptions) latestSnapshot(w *restic.ResticWrapper, host string) (*restic.Snapshot, error) {
+	snapshots, err := w.ListSnapshots(nil)
+	if err != nil {
+		return nil, err
+	}
+	var latest *restic.Snapshot
+	for i := range snapshots {
+		if snapshots[i].Hostname != host || !slices.Contains(snapshots[i].Paths, opt.interimDataDir) {
+			continue
+		}
+		if latest == nil || snapshots[i].Time.After(latest.Time) {
+			latest = &snapshots[i]
+		}
+	}
+	return latest, nil
+}
+
+// readBackupState reads the backup state stored in a snapshot without restoring the whole snapshot
+func (opt *natsOptions) readBackupState(w *restic.ResticWrapper, snapshotID string) (*backupState, error) {
+	out, err := w.DumpOnce(restic.DumpOptions{
+		Snapshot: snapshotID,
+		FileName: filepath.Join(opt.interimDataDir, NATSBackupStateFile),
+	})
+	if err != nil {
+		return nil, err
+	}
+	state := &backupState{}
+	if err := json.Unmarshal(out, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// dumpIncremental backs up the selected streams on top of the previous snapshot.
+// A stream is backed up in full when it has no usable entry in the previous snapshot,
+// when it has been re-created, when some messages after the previous backup have already been
+// removed from the stream or when the incremental chain has reached its maximum length.
+func (opt *natsOptions) dumpIncremental(session *sessionWrapper, w *restic.ResticWrapper) error {
+	var (
+		prevState    *backupState
+		prevSnapshot string
+	)
+	latest, err := opt.latestSnapshot(w, opt.backupOptions.Host)
+	if err != nil {
+		return err
+	}
+	if latest != nil {
+		prevState, err = opt.readBackupState(w, latest.ID)
+		if err != nil {
+			klog.Warningf("Failed to read backup state from snapshot %s. Taking full backup. Reason: %v", latest.ID, err)
+		}
+		prevSnapshot = latest.ID
+	}
+
+	// the states are kept in the order of the streams, regardless of the order the streams are dumped in
+	states := make([]*streamBackupState, len(opt.streams))
+	index := make(map[string]int, len(opt.streams))
+	for i, stream := range opt.streams {
+		index[stream] = i
+	}
+	err = opt.forEachStream(opt.streams, func(stream string, result *streamResult) error {
+		current, err := opt.dumpStreamIncremental(session, stream, prevState.find(stream), prevSnapshot, result)
+		if err != nil {
+			return err
+		}
+		states[index[stream]] = current
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	state := backupState{}
+	for _, current := range states {
+		if current != nil {
+			state.Streams = append(state.Streams, *current)
+		}
+	}
+	byteState, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(opt.interimDataDir, NATSBackupStateFile), byteState, 0o644)
+}
+
+// dumpStreamIncremental backs up a single stream on top of its state in the previous snapshot
+func (opt *natsOptions) dumpStreamIncremental(session *sessionWrapper, stream string, prev *streamBackupState, prevSnapshot string, result *streamResult) (*streamBackupState, error) {
+	info, err := session.getStreamInfo(stream)
+	if err != nil {
+		return nil, err
+	}
+	result.Messages, result.Bytes = info.State.Msgs, info.State.Bytes
+
+	if opt.continuesChain(info, prev) {
+		klog.Infof("Taking incremental backup of stream %s from sequence %d", stream, prev.LastSeq+1)
+		config, err := json.Marshal(info.Config)
+		if err != nil {
+			return nil, err
+		}
+		current := &streamBackupState{
+			Stream:       stream,
+			LastSeq:      info.State.LastSeq,
+			BaseLastSeq:  prev.BaseLastSeq,
+			BaseFirstSeq: prev.BaseFirstSeq,
+			BaseMessages: prev.BaseMessages,
+			BaseBytes:    prev.BaseBytes,
+			Config:       config,
+			Increments:   prev.Increments,
+			Snapshots:    appendUnique(prev.Snapshots, prevSnapshot),
+		}
+		if info.State.LastSeq > prev.LastSeq {
+			segment, err := opt.exportMessages(session, stream, prev.LastSeq+1, info.State.LastSeq)
+			if err != nil {
+				return nil, err
+			}
+			current.Increments = append(current.Increments, *segment)
+		}
+		// the consumers are recorded on every backup, so the latest snapshot of the chain holds their positions
+		if err := dumpConsumers(session, stream, filepath.Join(opt.interimDataDir, stream)); err != nil {
+			return nil, err
+		}
+		return current, nil
+	}
+
+	if prev != nil && !acceptsIncrements(&info.Config) {
+		klog.Infof("Taking full backup of stream %s, as the increments of a mirror or a sourced stream can not be restored", stream)
+	} else {
+		klog.Infoln("Taking full backup of stream: ", stream)
+	}
+	if err := snapshotToDir(session.ctx, session.nc, stream, filepath.Join(opt.interimDataDir, stream), opt.snapshotLayout, opt.encryption); err != nil {
+		return nil, err
+	}
+	if err := dumpConsumers(session, stream, filepath.Join(opt.interimDataDir, stream)); err != nil {
+		return nil, err
+	}
+	// the snapshot may contain messages published after we have read the stream info
+	if snapshotInfo, err := readSnapshotInfo(filepath.Join(opt.interimDataDir, stream)); err == nil {
+		info = snapshotInfo
+		result.Messages, result.Bytes = snapshotInfo.State.Msgs, snapshotInfo.State.Bytes
+	}
+	config, err := json.Marshal(info.Config)
+	if err != nil {
+		return nil, err
+	}
+	return &streamBackupState{
+		Stream:       stream,
+		LastSeq:      info.State.LastSeq,
+		BaseLastSeq:  info.State.LastSeq,
+		BaseFirstSeq: info.State.FirstSeq,
+		BaseMessages: info.State.Msgs,
+		BaseBytes:    info.State.Bytes,
+		Config:       config,
+	}, nil
+}
+
+// continuesChain reports whether the stream can be backed up on top of its state in the previous snapshot.
+// It is not the case when the stream has been re-created, when some messages after the previous backup have
+// already been removed from the stream or when the chain has reached its maximum length.
+func (opt *natsOptions) continuesChain(info *jetstream.StreamInfo, prev *streamBackupState) bool {
+	return prev != nil &&
+		acceptsIncrements(&info.Config) &&
+		info.State.LastSeq >= prev.LastSeq &&
+		info.State.FirstSeq <= prev.LastSeq+1 &&
+		(opt.maxIncrementalChain <= 0 || len(prev.Increments) < opt.maxIncrementalChain)
+}
+
+// acceptsIncrements reports whether the messages of an increment can be republished to the stream.
+// A mirror or a sourced stream receives its messages from its origins and rejects the ones published directly.
+func acceptsIncrements(config *jetstream.StreamConfig) bool {
+	return config.Mirror == nil && len(config.Sources) == 0
+}
+
+// exportMessages writes the messages of the given sequence range into a file, one JSON encoded message per line.
+// The messages are read through an ordered consumer, so the deleted messages are skipped.
+func (opt *natsOptions) exportMessages(session *sessionWrapper, stream string, fromSeq, toSeq uint64) (*incrementalSegment, error) {
+	segment := &incrementalSegment{
+		FromSeq: fromSeq,
+		ToSeq:   toSeq,
+		File:    filepath.Join(NATSIncrementalDir, stream, fmt.Sprintf("%020d-%020d.json", fromSeq, toSeq)),
+	}
+	if err := os.MkdirAll(filepath.Join(opt.interimDataDir, NATSIncrementalDir, stream), os.ModePerm); err != nil {
+		return nil, err
+	}
+	f, err := opt.encryption.create(filepath.Join(opt.interimDataDir, segment.File))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cons, err := session.js.OrderedConsumer(session.ctx, stream, jetstream.OrderedConsumerConfig{
+		DeliverPolicy: jetstream.DeliverByStartSequencePolicy,
+		OptStartSeq:   fromSeq,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read messages of stream %s: %w", stream, err)
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for {
+		if err := session.ctx.Err(); err != nil {
+			return nil, err
+		}
+		batch, err := cons.Fetch(exportBatchSize, jetstream.FetchMaxWait(exportFetchTimeout))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read messages of stream %s: %w", stream, err)
+		}
+		received, done := 0, false
+		for msg := range batch.Messages() {
+			received++
+			meta, err := msg.Metadata()
+			if err != nil {
+				return nil, err
+			}
+			if meta.Sequence.Stream > toSeq {
+				done = true
+				continue
+			}
+			stored := storedMsg{
+				Subject:  msg.Subject(),
+				Sequence: meta.Sequence.Stream,
+				Header:   encodeMsgHeader(msg.Headers()),
+				Data:     msg.Data(),
+				Time:     meta.Timestamp,
+			}
+			if err := enc.Encode(stored); err != nil {
+				return nil, err
+			}
+			segment.Messages++
+			segment.Bytes += uint64(len(stored.Subject) + len(stored.Header) + len(stored.Data))
+			if meta.Sequence.Stream == toSeq {
+				done = true
+			}
+		}
+		if err := batch.Error(); err != nil && !errors.Is(err, nats.ErrTimeout) {
+			return nil, fmt.Errorf("failed to read messages of stream %s: %w", stream, err)
+		}
+		// the last messages of the range may have been deleted, so an empty batch ends the range too
+		if done || received == 0 {
+			break
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	// closing an encrypted segment seals its last chunk
+	return segment, f.Close()
+}
+
+// readBackupStateFile reads the backup state restored into the interim data directory.
+// It returns nil if the snapshot has been taken without incremental mode.
+func (opt *natsOptions) readBackupStateFile() (*backupState, error) {
+	return readBackupStateFrom(opt.interimDataDir)
+}
+
+// readBackupStateFrom reads the backup state stored in dir. It returns nil if the backup has not been taken in incremental mode.
+func readBackupStateFrom(dir string) (*backupState, error) {
+	byteState, err := os.ReadFile(filepath.Join(dir, NATSBackupStateFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	state := &backupState{}
+	if err := json.Unmarshal(byteState, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// resolveSnapshotChain finds the snapshots that have to be restored together to rebuild the selected streams.
+// The snapshots are returned in the order they have been taken so that the later increments are restored last.
+func (opt *natsOptions) resolveSnapshotChain(w *restic.ResticWrapper) ([]string, error) {
+	var target string
+	switch len(opt.restoreOptions.Snapshots) {
+	case 0:
+		host := opt.restoreOptions.SourceHost
+		if host == "" {
+			host = opt.restoreOptions.Host
+		}
+		latest, err := opt.latestSnapshot(w, host)
+		if err != nil || latest == nil {
+			return nil, err
+		}
+		target = latest.ID
+	case 1:
+		target = opt.restoreOptions.Snapshots[0]
+	default:
+		// the user has chosen the snapshots explicitly
+		return opt.restoreOptions.Snapshots, nil
+	}
+
+	state, err := opt.readBackupState(w, target)
+	if err != nil {
+		// the snapshot has not been taken in incremental mode
+		klog.Infof("No backup state found in snapshot %s. Reason: %v", target, err)
+		return nil, nil
+	}
+
+	var ids []string
+	for _, s := range state.Streams {
+		if len(opt.streams) != 0 && !slices.Contains(opt.streams, s.Stream) {
+			continue
+		}
+		for _, id := range s.Snapshots {
+			ids = appendUnique(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	snapshots, err := w.ListSnapshots(ids)
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) != len(ids) {
+		return nil, fmt.Errorf("some of the snapshots required to rebuild the incremental chain are missing. required: %v", ids)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.Before(snapshots[j].Time)
+	})
+	chain := make([]string, 0, len(snapshots)+1)
+	for i := range snapshots {
+		chain = append(chain, snapshots[i].ID)
+	}
+	return append(chain, target), nil
+}
+
+// restoreSnapshotChain restores the snapshots of the chain into the interim data dir, oldest first
+func (opt *natsOptions) restoreSnapshotChain(w *restic.ResticWrapper, chain []string, targetRef api_v1beta1.TargetRef) (*restic.RestoreOutput, error) {
+	target := chain[len(chain)-1]
+	state, err := opt.readBackupState(w, target)
+	if err != nil {
+		klog.Infof("No backup state found in snapshot %s. Reason: %v", target, err)
+	}
+
+	startTime := time.Now()
+	err = opt.overlaySnapshots(chain, state, func(snapshot string) error {
+		restoreOptions := opt.restoreOptions
+		restoreOptions.Snapshots = []string{snapshot}
+		_, err := w.RunRestore(restoreOptions, targetRef)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &restic.RestoreOutput{
+		RestoreTargetStatus: api_v1beta1.RestoreMemberStatus{
+			Ref: targetRef,
+			Stats: []api_v1beta1.HostRestoreStats{
+				{
+					Hostname: opt.restoreOptions.Host,
+					Phase:    api_v1beta1.HostRestoreSucceeded,
+					Duration: time.Since(startTime).String(),
+				},
+			},
+		},
+	}, nil
+}
+
+// overlaySnapshots restores the snapshots of the chain on top of each other through restore.
+// A stream may have been backed up in full more than once within the chain, i.e. when it has been re-created.
+// So the directory of a stream is cleared right before the snapshot holding the full backup recorded in the state of
+// the last snapshot is restored. Otherwise the message blocks of an older full backup would be packed along with it.
+// The manifest of every snapshot only covers the files of that snapshot, so the files are checked against it right
+// after the snapshot is restored, before a later snapshot replaces any of them.
+func (opt *natsOptions) overlaySnapshots(chain []string, state *backupState, restore func(snapshot string) error) error {
+	target := chain[len(chain)-1]
+	fullBackups := map[string][]string{}
+	if state != nil {
+		for _, s := range state.Streams {
+			snapshot := target
+			if len(s.Snapshots) != 0 {
+				snapshot = s.Snapshots[0]
+			}
+			fullBackups[snapshot] = append(fullBackups[snapshot], s.Stream)
+		}
+	}
+
+	for _, snapshot := range chain {
+		for _, stream := range fullBackups[snapshot] {
+			if err := os.RemoveAll(filepath.Join(opt.interimDataDir, stream)); err != nil {
+				return err
+			}
+		}
+		// a snapshot taken without a manifest must not be checked against the manifest of an older snapshot
+		manifestFile := filepath.Join(opt.interimDataDir, NATSManifestFile)
+		if err := os.Remove(manifestFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		klog.Infof("Restoring snapshot %s of the incremental chain", snapshot)
+		if err := restore(snapshot); err != nil {
+			return err
+		}
+		manifest, err := readManifest(opt.interimDataDir)
+		if err != nil {
+			return fmt.Errorf("snapshot %s: %w", snapshot, err)
+		}
+		if manifest == nil {
+			klog.Infof("Snapshot %s has been taken without a manifest. Skipping the checksum verification", snapshot)
+			continue
+		}
+		if err := manifest.verifyFiles(opt.interimDataDir); err != nil {
+			return fmt.Errorf("snapshot %s of the incremental chain is corrupted: %w", snapshot, err)
+		}
+	}
+	return nil
+}
+
+// checkIncrements verifies that the messages of the increments can be republished to the stream restored with
+// config. It is called before the stream is restored, so that the restore does not fail partway.
+func (opt *natsOptions) checkIncrements(config *jetstream.StreamConfig, state *streamBackupState) error {
+	if len(state.Increments) == 0 {
+		return nil
+	}
+	if !acceptsIncrements(config) {
+		return fmt.Errorf("the increments of stream %s can not be restored, as a mirror or a sourced stream does not accept the messages published directly", state.Stream)
+	}
+	subjects := config.Subjects
+	if len(subjects) == 0 {
+		// a stream without subjects listens on its name
+		subjects = []string{config.Name}
+	}
+	for _, segment := range state.Increments {
+		err := forEachStoredMsg(filepath.Join(opt.interimDataDir, segment.File), opt.encryption, func(msg *storedMsg) error {
+			for _, subject := range subjects {
+				if subjectMatches(subject, msg.Subject) {
+					return nil
+				}
+			}
+			return fmt.Errorf("the increments of stream %s can not be restored, as the subject %s of message %d does not match the subjects %v of the restored stream",
+				state.Stream, msg.Subject, msg.Sequence, subjects)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyIncrements re-publishes the messages of the increments on top of the restored full backup of the stream.
+// The sequences and the timestamps of the messages are not preserved: the messages get new ones from the server,
+// right after the last message of the full backup. The new sequences of the ack floors are recorded in floors.
+func (opt *natsOptions) applyIncrements(session *sessionWrapper, state *streamBackupState, floors *restoredAckFloors) error {
+	for _, segment := range state.Increments {
+		klog.Infof("Applying increment %d-%d of stream %s", segment.FromSeq, segment.ToSeq, state.Stream)
+		err := forEachStoredMsg(filepath.Join(opt.interimDataDir, segment.File), opt.encryption, func(msg *storedMsg) error {
+			ack, err := publishStoredMsg(session.ctx, session.js, state.Stream, msg)
+			if err != nil {
+				return err
+			}
+			floors.republished(msg.Sequence, ack.Sequence)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func forEachStoredMsg(file string, encryption *archiveEncryption, fn func(msg *storedMsg) error) error {
+	f, err := encryption.open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		msg := &storedMsg{}
+		if err := dec.Decode(msg); err != nil {
+			return fmt.Errorf("failed to decode %s: %v", file, err)
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func publishStoredMsg(ctx context.Context, js jetstream.JetStream, stream string, msg *storedMsg) (*jetstream.PubAck, error) {
+	ack, err := js.PublishMsg(ctx, &nats.Msg{
+		Subject: msg.Subject,
+		Header:  parseMsgHeader(msg.Header),
+		Data:    msg.Data,
+	}, jetstream.WithExpectStream(stream))
+	if err != nil {
+		return nil, fmt.Errorf("failed to publish message %d of stream %s: %w", msg.Sequence, stream, err)
+	}
+	// the server drops a message whose ID is within the duplicate window of the stream
+	if ack.Duplicate {
+		return nil, fmt.Errorf("message %d of stream %s has been dropped by the server as a duplicate", msg.Sequence, stream)
+	}
+	return ack, nil
+}
+
+// subjectMatches reports whether the subject matches the subject filter, which may contain the "*" and ">" wildcards
+func subjectMatches(filter, subject string) bool {
+	filterTokens := strings.Split(filter, ".")
+	subjectTokens := strings.Split(subject, ".")
+	for i, token := range filterTokens {
+		if token == ">" {
+			return len(subjectTokens) > i
+		}
+		if i >= len(subjectTokens) || (token != "*" && token != subjectTokens[i]) {
+			return false
+		}
+	}
+	return len(filterTokens) == len(subjectTokens)
+}
+
+// encodeMsgHeader encodes the headers in the NATS header block format
+func encodeMsgHeader(header nats.Header) []byte {
+	if len(header) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	buf.WriteString("NATS/1.0\r\n")
+	for _, key := range keys {
+		for _, value := range header[key] {
+			buf.WriteString(key + ": " + value + "\r\n")
+		}
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// parseMsgHeader parses a NATS message header block ("NATS/1.0\r\nKey: Value\r\n\r\n")
+func parseMsgHeader(hdr []byte) nats.Header {
+	header := nats.Header{}
+	lines := strings.Split(string(hdr), "\r\n")
+	for i, line := range lines {
+		// the first line holds the version and status
+		if i == 0 || line == "" {
+			continue
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		header[key] = append(header[key], strings.TrimSpace(value))
+	}
+	return header
+}
+
+func readSnapshotInfo(dir string) (*jetstream.StreamInfo, error) {
+	byteInfo, err := os.ReadFile(filepath.Join(dir, NATSSnapshotMetaFile))
+	if err != nil {
+		return nil, err
+	}
+	info := &jetstream.StreamInfo{}
+	if err := json.Unmarshal(byteInfo, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func appendUnique(list []string, item string) []string {
+	if item == "" || slices.Contains(list, item) {
+		return list
+	}
+	return append(append([]string{}, list...), item)
+}
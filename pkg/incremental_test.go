@@ -0,0 +1,548 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func TestEncodeMsgHeader(t *testing.T) {
+	cases := []struct {
+		name     string
+		header   nats.Header
+		expected string
+	}{
+		{
+			name: "no header",
+		},
+		{
+			name:     "single value",
+			header:   nats.Header{"Nats-Msg-Id": {"1"}},
+			expected: "NATS/1.0\r\nNats-Msg-Id: 1\r\n\r\n",
+		},
+		{
+			name:     "sorted keys and multiple values",
+			header:   nats.Header{"b": {"2", "3"}, "a": {"1"}},
+			expected: "NATS/1.0\r\na: 1\r\nb: 2\r\nb: 3\r\n\r\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := string(encodeMsgHeader(tc.header)); got != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseMsgHeader(t *testing.T) {
+	cases := []struct {
+		name     string
+		hdr      string
+		expected nats.Header
+	}{
+		{
+			name:     "empty",
+			expected: nats.Header{},
+		},
+		{
+			name:     "no fields",
+			hdr:      "NATS/1.0\r\n\r\n",
+			expected: nats.Header{},
+		},
+		{
+			name:     "multiple values",
+			hdr:      "NATS/1.0\r\na: 1\r\nb: 2\r\nb: 3\r\n\r\n",
+			expected: nats.Header{"a": {"1"}, "b": {"2", "3"}},
+		},
+		{
+			name:     "status line and untrimmed values",
+			hdr:      "NATS/1.0 503\r\nkey:  value with: colon \r\n\r\n",
+			expected: nats.Header{"key": {"value with: colon"}},
+		},
+		{
+			name:     "malformed line",
+			hdr:      "NATS/1.0\r\nno colon\r\na: 1\r\n\r\n",
+			expected: nats.Header{"a": {"1"}},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := parseMsgHeader([]byte(tc.hdr)); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestMsgHeaderRoundTrip(t *testing.T) {
+	header := nats.Header{
+		"Nats-Msg-Id":  {"42"},
+		"Content-Type": {"application/json"},
+		"X-Trace":      {"a", "b"},
+	}
+	if got := parseMsgHeader(encodeMsgHeader(header)); !reflect.DeepEqual(got, header) {
+		t.Errorf("expected %v, got %v", header, got)
+	}
+}
+
+// snapshotDataNames lists the files packed into the snapshot data of the stream stored in dir
+func snapshotDataNames(t *testing.T, dir string) []string {
+	t.Helper()
+	r, err := openSnapshotData(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var names []string
+	tr := tar.NewReader(s2.NewReader(r))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return names
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+}
+
+func TestOverlaySnapshots(t *testing.T) {
+	// the stream "orders" has been backed up in full in s1, re-created and backed up in full again in s2,
+	// then backed up incrementally in s3. The stream "events" has been backed up in full in s1 only.
+	snapshots := map[string][]string{
+		"s1": {
+			"orders/" + NATSSnapshotMetaFile,
+			"orders/blocks/msgs/1.blk",
+			"orders/blocks/msgs/2.blk",
+			"orders/blocks/msgs/3.blk",
+			"events/" + NATSSnapshotMetaFile,
+			"events/blocks/msgs/1.blk",
+		},
+		"s2": {
+			"orders/" + NATSSnapshotMetaFile,
+			"orders/blocks/msgs/1.blk",
+			"events/consumers.json",
+		},
+		"s3": {
+			"orders/consumers.json",
+			"events/consumers.json",
+			"incremental/orders/1.json",
+		},
+	}
+	state := &backupState{
+		Streams: []streamBackupState{
+			{Stream: "orders", Snapshots: []string{"s2"}},
+			{Stream: "events", Snapshots: []string{"s1", "s2"}},
+		},
+	}
+
+	opt := &natsOptions{interimDataDir: t.TempDir()}
+	var restored []string
+	err := opt.overlaySnapshots([]string{"s1", "s2", "s3"}, state, func(snapshot string) error {
+		restored = append(restored, snapshot)
+		for _, name := range snapshots[snapshot] {
+			file := filepath.Join(opt.interimDataDir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+				return err
+			}
+			if err := os.WriteFile(file, []byte(snapshot), 0o644); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored, []string{"s1", "s2", "s3"}) {
+		t.Errorf("expected the snapshots to be restored in order, got %v", restored)
+	}
+
+	if names := snapshotDataNames(t, filepath.Join(opt.interimDataDir, "orders")); !reflect.DeepEqual(names, []string{"msgs/1.blk"}) {
+		t.Errorf("expected only the blocks of the last full backup of orders to be packed, got %v", names)
+	}
+	if content, err := os.ReadFile(filepath.Join(opt.interimDataDir, "orders", NATSSnapshotMetaFile)); err != nil || string(content) != "s2" {
+		t.Errorf("expected the meta of orders from s2, got %q, %v", content, err)
+	}
+	if names := snapshotDataNames(t, filepath.Join(opt.interimDataDir, "events")); !reflect.DeepEqual(names, []string{"msgs/1.blk"}) {
+		t.Errorf("expected the blocks of events to be kept, got %v", names)
+	}
+	for _, name := range []string{"orders/consumers.json", "events/consumers.json", "incremental/orders/1.json"} {
+		if content, err := os.ReadFile(filepath.Join(opt.interimDataDir, filepath.FromSlash(name))); err != nil || string(content) != "s3" {
+			t.Errorf("expected %s from s3, got %q, %v", name, content, err)
+		}
+	}
+}
+
+func TestContinuesChain(t *testing.T) {
+	prev := &streamBackupState{
+		Stream:     "orders",
+		LastSeq:    100,
+		Increments: []incrementalSegment{{FromSeq: 51, ToSeq: 100}},
+	}
+	cases := []struct {
+		name     string
+		prev     *streamBackupState
+		config   jetstream.StreamConfig
+		firstSeq uint64
+		lastSeq  uint64
+		maxChain int
+		expected bool
+	}{
+		{
+			name:     "new messages",
+			prev:     prev,
+			firstSeq: 1,
+			lastSeq:  150,
+			expected: true,
+		},
+		{
+			name:     "no new message",
+			prev:     prev,
+			firstSeq: 1,
+			lastSeq:  100,
+			expected: true,
+		},
+		{
+			name:     "no previous backup",
+			firstSeq: 1,
+			lastSeq:  150,
+		},
+		{
+			name:     "re-created stream",
+			prev:     prev,
+			firstSeq: 1,
+			lastSeq:  20,
+		},
+		{
+			name:     "messages removed after the previous backup",
+			prev:     prev,
+			firstSeq: 102,
+			lastSeq:  150,
+		},
+		{
+			name:     "all the messages of the previous backup removed",
+			prev:     prev,
+			firstSeq: 101,
+			lastSeq:  150,
+			expected: true,
+		},
+		{
+			name:     "maximum chain length reached",
+			prev:     prev,
+			firstSeq: 1,
+			lastSeq:  150,
+			maxChain: 1,
+		},
+		{
+			name:     "mirror",
+			prev:     prev,
+			config:   jetstream.StreamConfig{Mirror: &jetstream.StreamSource{Name: "origin"}},
+			firstSeq: 1,
+			lastSeq:  150,
+		},
+		{
+			name:     "sourced stream",
+			prev:     prev,
+			config:   jetstream.StreamConfig{Sources: []*jetstream.StreamSource{{Name: "origin"}}},
+			firstSeq: 1,
+			lastSeq:  150,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			opt := &natsOptions{maxIncrementalChain: tc.maxChain}
+			info := &jetstream.StreamInfo{
+				Config: tc.config,
+				State:  jetstream.StreamState{FirstSeq: tc.firstSeq, LastSeq: tc.lastSeq},
+			}
+			if got := opt.continuesChain(info, tc.prev); got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestSubjectMatches(t *testing.T) {
+	cases := []struct {
+		filter   string
+		subject  string
+		expected bool
+	}{
+		{"orders", "orders", true},
+		{"orders", "orders.new", false},
+		{"orders.*", "orders.new", true},
+		{"orders.*", "orders", false},
+		{"orders.*", "orders.new.eu", false},
+		{"orders.>", "orders.new.eu", true},
+		{"orders.>", "orders", false},
+		{"*.new", "orders.new", true},
+		{">", "orders", true},
+		{"events", "orders", false},
+	}
+	for _, tc := range cases {
+		if got := subjectMatches(tc.filter, tc.subject); got != tc.expected {
+			t.Errorf("subjectMatches(%q, %q): expected %v, got %v", tc.filter, tc.subject, tc.expected, got)
+		}
+	}
+}
+
+// writeIncrement writes the messages into an increment of the stream in the interim data dir
+func writeIncrement(t *testing.T, opt *natsOptions, stream string, msgs ...storedMsg) incrementalSegment {
+	t.Helper()
+	segment := incrementalSegment{
+		FromSeq: msgs[0].Sequence,
+		ToSeq:   msgs[len(msgs)-1].Sequence,
+		File:    filepath.Join(NATSIncrementalDir, stream, fmt.Sprintf("%d.json", msgs[0].Sequence)),
+	}
+	file := filepath.Join(opt.interimDataDir, segment.File)
+	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, msg := range msgs {
+		line, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(line))
+	}
+	if err := os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return segment
+}
+
+func TestCheckIncrements(t *testing.T) {
+	opt := &natsOptions{interimDataDir: t.TempDir()}
+	state := &streamBackupState{
+		Stream: "orders",
+		Increments: []incrementalSegment{
+			writeIncrement(t, opt, "orders", storedMsg{Subject: "orders.new", Sequence: 101}),
+			writeIncrement(t, opt, "orders", storedMsg{Subject: "orders.eu.paid", Sequence: 102}),
+		},
+	}
+	cases := []struct {
+		name   string
+		config jetstream.StreamConfig
+		state  *streamBackupState
+		errMsg string
+	}{
+		{
+			name:   "matching subjects",
+			config: jetstream.StreamConfig{Name: "orders", Subjects: []string{"orders.>"}},
+			state:  state,
+		},
+		{
+			name:   "no increment",
+			config: jetstream.StreamConfig{Name: "orders", Mirror: &jetstream.StreamSource{Name: "origin"}},
+			state:  &streamBackupState{Stream: "orders"},
+		},
+		{
+			name:   "subjects overridden",
+			config: jetstream.StreamConfig{Name: "orders", Subjects: []string{"orders.new", "orders.*"}},
+			state:  state,
+			errMsg: "subject orders.eu.paid of message 102 does not match",
+		},
+		{
+			name:   "stream without subjects",
+			config: jetstream.StreamConfig{Name: "orders"},
+			state:  state,
+			errMsg: "subject orders.new of message 101 does not match",
+		},
+		{
+			name:   "mirror",
+			config: jetstream.StreamConfig{Name: "orders", Mirror: &jetstream.StreamSource{Name: "origin"}},
+			state:  state,
+			errMsg: "a mirror or a sourced stream does not accept",
+		},
+		{
+			name:   "sourced stream",
+			config: jetstream.StreamConfig{Name: "orders", Subjects: []string{"orders.>"}, Sources: []*jetstream.StreamSource{{Name: "origin"}}},
+			state:  state,
+			errMsg: "a mirror or a sourced stream does not accept",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := opt.checkIncrements(&tc.config, tc.state)
+			if tc.errMsg == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.errMsg) {
+				t.Fatalf("expected error containing %q, got %v", tc.errMsg, err)
+			}
+		})
+	}
+}
+
+// fakePublisher records the messages published through it and assigns them the next sequences of the stream
+type fakePublisher struct {
+	jetstream.JetStream
+	lastSeq   uint64
+	published []*nats.Msg
+	duplicate string
+}
+
+func (p *fakePublisher) PublishMsg(_ context.Context, msg *nats.Msg, _ ...jetstream.PublishOpt) (*jetstream.PubAck, error) {
+	if msg.Header.Get(nats.MsgIdHdr) != "" && msg.Header.Get(nats.MsgIdHdr) == p.duplicate {
+		return &jetstream.PubAck{Stream: "orders", Sequence: p.lastSeq, Duplicate: true}, nil
+	}
+	p.lastSeq++
+	p.published = append(p.published, msg)
+	return &jetstream.PubAck{Stream: "orders", Sequence: p.lastSeq}, nil
+}
+
+func TestApplyIncrements(t *testing.T) {
+	opt := &natsOptions{interimDataDir: t.TempDir()}
+	header := encodeMsgHeader(nats.Header{nats.MsgIdHdr: {"order-105"}})
+	state := &streamBackupState{
+		Stream:      "orders",
+		BaseLastSeq: 100,
+		Increments: []incrementalSegment{
+			writeIncrement(t, opt, "orders",
+				storedMsg{Subject: "orders.new", Sequence: 101, Data: []byte("101")},
+				storedMsg{Subject: "orders.new", Sequence: 103, Data: []byte("103")}),
+			writeIncrement(t, opt, "orders",
+				storedMsg{Subject: "orders.paid", Sequence: 105, Header: header, Data: []byte("105")}),
+		},
+	}
+
+	floors := newRestoredAckFloors([]*jetstream.ConsumerInfo{
+		{AckFloor: jetstream.SequenceInfo{Stream: 102}},
+		{AckFloor: jetstream.SequenceInfo{Stream: 105}},
+	}, 100, 100)
+	publisher := &fakePublisher{lastSeq: 100}
+	session := &sessionWrapper{ctx: context.Background(), js: publisher}
+	if err := opt.applyIncrements(session, state, floors); err != nil {
+		t.Fatal(err)
+	}
+	for floor, expected := range map[uint64]uint64{100: 100, 102: 101, 105: 103} {
+		if seq, ok := floors.restoredSeq(floor); !ok || seq != expected {
+			t.Errorf("expected ack floor %d to be restored as %d, got %d, %v", floor, expected, seq, ok)
+		}
+	}
+	var got []string
+	for _, msg := range publisher.published {
+		got = append(got, msg.Subject+":"+string(msg.Data))
+	}
+	expected := []string{"orders.new:101", "orders.new:103", "orders.paid:105"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the messages to be republished in order as %v, got %v", expected, got)
+	}
+	if id := publisher.published[2].Header.Get(nats.MsgIdHdr); id != "order-105" {
+		t.Errorf("expected the headers to be republished, got message ID %q", id)
+	}
+
+	// a message dropped by the server must fail the restore instead of going missing silently
+	publisher = &fakePublisher{lastSeq: 100, duplicate: "order-105"}
+	session.js = publisher
+	if err := opt.applyIncrements(session, state, nil); err == nil || !strings.Contains(err.Error(), "message 105 of stream orders has been dropped") {
+		t.Errorf("expected the duplicate to be reported, got %v", err)
+	}
+}
+
+func TestOverlaySnapshotsVerifiesManifests(t *testing.T) {
+	checksum := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(sum[:])
+	}
+	// every snapshot writes orders/consumers.json with its name. s3 has been taken without a manifest.
+	manifests := map[string]map[string]string{
+		"s1": {"orders/consumers.json": checksum("s1")},
+		"s2": {"orders/consumers.json": checksum("s2")},
+	}
+	cases := []struct {
+		name    string
+		chain   []string
+		corrupt string
+		wantErr string
+	}{
+		{
+			name:  "intact chain",
+			chain: []string{"s1", "s2", "s3"},
+		},
+		{
+			name:    "corrupted middle snapshot",
+			chain:   []string{"s1", "s2", "s3"},
+			corrupt: "s2",
+			wantErr: "snapshot s2 of the incremental chain is corrupted: stream orders: checksum mismatch of orders/consumers.json",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			opt := &natsOptions{interimDataDir: t.TempDir()}
+			var restored []string
+			err := opt.overlaySnapshots(tc.chain, nil, func(snapshot string) error {
+				restored = append(restored, snapshot)
+				content := snapshot
+				if snapshot == tc.corrupt {
+					content = "corrupted"
+				}
+				if err := os.MkdirAll(filepath.Join(opt.interimDataDir, "orders"), os.ModePerm); err != nil {
+					return err
+				}
+				if err := os.WriteFile(filepath.Join(opt.interimDataDir, "orders", NATSConsumersFile), []byte(content), 0o644); err != nil {
+					return err
+				}
+				if files, ok := manifests[snapshot]; ok {
+					writeTestFile(t, filepath.Join(opt.interimDataDir, NATSManifestFile), backupManifest{
+						Version: ManifestVersion,
+						Streams: []streamManifest{{Name: "orders", Files: files}},
+					})
+				}
+				return nil
+			})
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if !reflect.DeepEqual(restored, tc.chain) {
+					t.Errorf("expected the snapshots %v to be restored, got %v", tc.chain, restored)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+			}
+			if !reflect.DeepEqual(restored, []string{"s1", "s2"}) {
+				t.Errorf("expected the chain to stop at the corrupted snapshot, got %v", restored)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"k8s.io/klog/v2"
+)
+
+// kvBucket holds the settings of a Key-Value bucket that are required to re-create it with the same semantics
+type kvBucket struct {
+	Bucket       string                `json:"bucket"`
+	Description  string                `json:"description,omitempty"`
+	History      int64                 `json:"history"`
+	TTL          time.Duration         `json:"ttl"`
+	MaxValueSize int32                 `json:"maxValueSize"`
+	MaxBytes     int64                 `json:"maxBytes"`
+	Storage      jetstream.StorageType `json:"storage"`
+	Replicas     int                   `json:"replicas"`
+}
+
+func newKVBucket(bucket string, config jetstream.StreamConfig) kvBucket {
+	return kvBucket{
+		Bucket:       bucket,
+		Description:  config.Description,
+		History:      config.MaxMsgsPerSubject,
+		TTL:          config.MaxAge,
+		MaxValueSize: config.MaxMsgSize,
+		MaxBytes:     config.MaxBytes,
+		Storage:      config.Storage,
+		Replicas:     config.Replicas,
+	}
+}
+
+// checkConfig verifies that a restored bucket has kept the settings recorded at backup time
+func (b *kvBucket) checkConfig(config jetstream.StreamConfig) error {
+	restored := newKVBucket(b.Bucket, config)
+	var mismatches []string
+	for _, field := range []struct {
+		name             string
+		recorded, actual any
+	}{
+		{"description", b.Description, restored.Description},
+		{"history", b.History, restored.History},
+		{"ttl", b.TTL, restored.TTL},
+		{"max value size", b.MaxValueSize, restored.MaxValueSize},
+		{"max bytes", b.MaxBytes, restored.MaxBytes},
+		{"storage", b.Storage, restored.Storage},
+		{"replicas", b.Replicas, restored.Replicas},
+	} {
+		if field.recorded != field.actual {
+			mismatches = append(mismatches, fmt.Sprintf("%s is %v instead of %v", field.name, field.actual, field.recorded))
+		}
+	}
+	if len(mismatches) != 0 {
+		return fmt.Errorf("restored KV bucket %q does not match the backup: %s", b.Bucket, strings.Join(mismatches, ", "))
+	}
+	return nil
+}
+
+func kvStreamName(bucket string) string {
+	return NATSKVPrefix + bucket
+}
+
+func (opt *natsOptions) dumpKVBuckets(session *sessionWrapper) error {
+	if len(opt.kvBuckets) == 0 {
+		return nil
+	}
+
+	buckets := make([]kvBucket, 0, len(opt.kvBuckets))
+	for _, bucket := range opt.kvBuckets {
+		stream := kvStreamName(bucket)
+		dir := filepath.Join(opt.interimDataDir, NATSKVDir, bucket)
+		err := opt.processStream(stream, func(result *streamResult) error {
+			info, err := session.getStreamInfo(stream)
+			if err != nil {
+				return fmt.Errorf("failed to read KV bucket %q: %w", bucket, err)
+			}
+
+			klog.Infoln("Backing up KV bucket: ", bucket)
+			if err := snapshotToDir(session.ctx, session.nc, stream, dir, opt.snapshotLayout, opt.encryption); err != nil {
+				return err
+			}
+			if snapshotInfo, err := readSnapshotInfo(dir); err == nil {
+				result.Messages, result.Bytes = snapshotInfo.State.Msgs, snapshotInfo.State.Bytes
+			}
+			buckets = append(buckets, newKVBucket(bucket, info.Config))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if opt.streamFailed(stream) {
+			// only the complete buckets are uploaded
+			klog.Warningf("Excluding the failed KV bucket %s from the backup", bucket)
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+		}
+	}
+
+	byteBuckets, err := json.Marshal(buckets)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(opt.interimDataDir, NATSKVFile), byteBuckets, 0o644)
+}
+
+// restoreKVBuckets re-creates the backed up KV buckets from the stream configuration captured in their snapshots
+// and checks them against the settings recorded in kv.json.
+// The buckets are restored only when they are selected or when nothing has been selected at all.
+func (opt *natsOptions) restoreKVBuckets(session *sessionWrapper) error {
+	if len(opt.kvBuckets) == 0 && !opt.backupAllStreams() {
+		return nil
+	}
+	byteBuckets, err := os.ReadFile(filepath.Join(opt.interimDataDir, NATSKVFile))
+	if err != nil {
+		if os.IsNotExist(err) && len(opt.kvBuckets) == 0 {
+			// the snapshot does not contain any KV bucket
+			return nil
+		}
+		return err
+	}
+	var buckets []kvBucket
+	if err := json.Unmarshal(byteBuckets, &buckets); err != nil {
+		return err
+	}
+	buckets, err = filterKVBuckets(buckets, opt.kvBuckets)
+	if err != nil {
+		return err
+	}
+
+	if opt.overwrite {
+		streams := make([]string, 0, len(buckets))
+		for i := range buckets {
+			streams = append(streams, kvStreamName(buckets[i].Bucket))
+		}
+		if err := session.removeMatchedStreams(streams); err != nil {
+			return err
+		}
+	}
+
+	for i := range buckets {
+		bucket := &buckets[i]
+		stream := kvStreamName(bucket.Bucket)
+		err := opt.processStream(stream, func(result *streamResult) error {
+			klog.Infoln("Restoring KV bucket: ", bucket.Bucket)
+			dir := filepath.Join(opt.interimDataDir, NATSKVDir, bucket.Bucket)
+			return session.removeOnCancel(stream, func() error {
+				if err := restoreFromDir(session.ctx, session.nc, stream, dir, nil, opt.encryption); err != nil {
+					return err
+				}
+				info, err := session.getStreamInfo(stream)
+				if err != nil {
+					return err
+				}
+				result.Messages, result.Bytes = info.State.Msgs, info.State.Bytes
+				return bucket.checkConfig(info.Config)
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func filterKVBuckets(buckets []kvBucket, names []string) ([]kvBucket, error) {
+	if len(names) == 0 {
+		return buckets, nil
+	}
+	filtered := make([]kvBucket, 0, len(names))
+	for _, name := range names {
+		found := false
+		for i := range buckets {
+			if buckets[i].Bucket == name {
+				filtered = append(filtered, buckets[i])
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("KV bucket %q is not present in the backup", name)
+		}
+	}
+	return filtered, nil
+}
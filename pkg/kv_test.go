@@ -0,0 +1,84 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func TestKVBucketCheckConfig(t *testing.T) {
+	config := jetstream.StreamConfig{
+		Name:              kvStreamName("settings"),
+		Description:       "application settings",
+		MaxMsgsPerSubject: 5,
+		MaxAge:            time.Hour,
+		MaxMsgSize:        1024,
+		MaxBytes:          1 << 20,
+		Storage:           jetstream.FileStorage,
+		Replicas:          3,
+	}
+	bucket := newKVBucket("settings", config)
+
+	cases := []struct {
+		name   string
+		modify func(config *jetstream.StreamConfig)
+		errMsg string
+	}{
+		{
+			name:   "same settings",
+			modify: func(config *jetstream.StreamConfig) {},
+		},
+		{
+			name:   "different history",
+			modify: func(config *jetstream.StreamConfig) { config.MaxMsgsPerSubject = 1 },
+			errMsg: "history is 1 instead of 5",
+		},
+		{
+			name:   "different ttl",
+			modify: func(config *jetstream.StreamConfig) { config.MaxAge = 0 },
+			errMsg: "ttl is 0s instead of 1h0m0s",
+		},
+		{
+			name: "different storage and replicas",
+			modify: func(config *jetstream.StreamConfig) {
+				config.Storage = jetstream.MemoryStorage
+				config.Replicas = 1
+			},
+			errMsg: "storage is Memory instead of File, replicas is 1 instead of 3",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			restored := config
+			c.modify(&restored)
+			err := bucket.checkConfig(restored)
+			if c.errMsg == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.errMsg) {
+				t.Fatalf("expected error containing %q, got %v", c.errMsg, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"github.com/klauspost/compress/s2"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// SnapshotLayoutArchive stores the snapshot of a stream as the compressed tarball sent by the server
+	SnapshotLayoutArchive = "archive"
+	// SnapshotLayoutBlocks stores every file of the snapshot uncompressed, so that each message block is a file of its own.
+	// The blocks that have not changed since the previous backup are deduplicated by restic.
+	// TestSnapshotLayoutRepositoryGrowth measures the repository growth of both layouts with the restic binary.
+	SnapshotLayoutBlocks = "blocks"
+)
+
+func validateSnapshotLayout(layout string) error {
+	switch layout {
+	case SnapshotLayoutArchive, SnapshotLayoutBlocks:
+		return nil
+	}
+	return fmt.Errorf("invalid snapshot layout %q. Supported values are %s and %s", layout, SnapshotLayoutArchive, SnapshotLayoutBlocks)
+}
+
+// hasSnapshotBlocks reports whether the snapshot stored in dir uses the blocks layout
+func hasSnapshotBlocks(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, NATSSnapshotBlocksDir))
+	return err == nil && info.IsDir()
+}
+
+// extractSnapshot unpacks the snapshot data (tar.s2) read from r into root
+func extractSnapshot(r io.Reader, root string) error {
+	tr := tar.NewReader(s2.NewReader(r))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("invalid file name %q in snapshot", hdr.Name)
+		}
+		file := filepath.Join(root, filepath.FromSlash(name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(file, os.ModePerm); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeReg:
+		default:
+			return fmt.Errorf("unsupported entry %q of type %c in snapshot", hdr.Name, hdr.Typeflag)
+		}
+		if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+			return err
+		}
+		if err := writeSnapshotFile(file, tr, hdr); err != nil {
+			return err
+		}
+	}
+}
+
+func writeSnapshotFile(file string, r io.Reader, hdr *tar.Header) error {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, hdr.FileInfo().Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// keep the modification time of the server, so that restic does not re-read the unchanged blocks
+	return os.Chtimes(file, hdr.ModTime, hdr.ModTime)
+}
+
+// archiveSnapshotBlocks packs the files unpacked by extractSnapshot back into the snapshot data (tar.s2) the server expects
+func archiveSnapshotBlocks(root string, w io.Writer) error {
+	zw := s2.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	err := forEachSnapshotBlock(root, func(name string, info fs.FileInfo, r io.Reader) error {
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     int64(info.Mode().Perm()),
+			Size:     info.Size(),
+			ModTime:  info.ModTime(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// forEachSnapshotBlock calls fn for every file unpacked into root, in lexical order, with its name in the snapshot
+func forEachSnapshotBlock(root string, fn func(name string, info fs.FileInfo, r io.Reader) error) error {
+	return filepath.WalkDir(root, func(file string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return fn(filepath.ToSlash(rel), info, f)
+	})
+}
+
+// openSnapshotData returns the snapshot data (tar.s2) of the snapshot stored in dir in any layout
+func openSnapshotData(dir string, encryption *archiveEncryption) (io.ReadCloser, error) {
+	if !hasSnapshotBlocks(dir) {
+		return encryption.open(filepath.Join(dir, NATSSnapshotDataFile))
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(archiveSnapshotBlocks(filepath.Join(dir, NATSSnapshotBlocksDir), pw))
+	}()
+	return pr, nil
+}
+
+// forEachSnapshotEntry calls fn for every file of the snapshot stored in dir in any layout
+func forEachSnapshotEntry(dir string, encryption *archiveEncryption, fn func(name string, r io.Reader) error) error {
+	if hasSnapshotBlocks(dir) {
+		return forEachSnapshotBlock(filepath.Join(dir, NATSSnapshotBlocksDir), func(name string, _ fs.FileInfo, r io.Reader) error {
+			return fn(name, r)
+		})
+	}
+
+	f, err := encryption.open(filepath.Join(dir, NATSSnapshotDataFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(s2.NewReader(f))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to decode archive: %w", err)
+		}
+		if err := fn(hdr.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// truncateSnapshotBlocks cuts the message blocks unpacked into root. A block is kept as is when it is
+// mapped to a negative length and removed when it is mapped to zero. The indexes of the blocks are removed.
+func truncateSnapshotBlocks(root string, keep map[int]int) error {
+	return filepath.WalkDir(root, func(file string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if isMsgIndexFile(name) {
+			return os.Remove(file)
+		}
+		index, ok := msgBlockIndex(name)
+		if !ok {
+			return nil
+		}
+		switch n := keep[index]; {
+		case n == 0:
+			return os.Remove(file)
+		case n > 0:
+			return os.Truncate(file, int64(n))
+		}
+		return nil
+	})
+}
+
+// logRepositoryGrowth logs how much data restic has uploaded for every snapshot of the backup
+func logRepositoryGrowth(out *restic.BackupOutput) {
+	if out == nil {
+		return
+	}
+	for _, host := range out.BackupTargetStatus.Stats {
+		for _, snapshot := range host.Snapshots {
+			fs := snapshot.FileStats
+			klog.Infof("Snapshot %s of %s: uploaded %s of %s, files: %d new, %d modified, %d unmodified",
+				snapshot.Name, snapshot.Path, snapshot.Uploaded, snapshot.TotalSize,
+				derefInt64(fs.NewFiles), derefInt64(fs.ModifiedFiles), derefInt64(fs.UnmodifiedFiles))
+		}
+	}
+}
+
+func derefInt64(v *int64) int64 {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
@@ -0,0 +1,150 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const growthTestBlockSize = 1 << 20
+
+// testGrowthBlock builds a message block of about growthTestBlockSize bytes. The messages look like JSON
+// documents with random IDs, so that they compress about as well as typical payloads.
+func testGrowthBlock(rnd *rand.Rand, index int) []byte {
+	var records [][]byte
+	size := 0
+	for seq := uint64(index * 100000); size < growthTestBlockSize; seq++ {
+		msg := fmt.Sprintf(`{"order":%d,"id":"%016x%016x","customer":"customer-%d","amount":%d}`,
+			seq, rnd.Uint64(), rnd.Uint64(), rnd.Intn(1000), rnd.Intn(100000))
+		record := testMsgRecord(seq, archiveTestTime.Add(time.Duration(seq)*time.Second), "orders.new", nil, []byte(msg))
+		records = append(records, record)
+		size += len(record)
+	}
+	return testMsgBlock(records...)
+}
+
+// writeGrowthSnapshot stores a snapshot made of the given blocks into dir in the given layout
+func writeGrowthSnapshot(t *testing.T, dir, layout string, blocks map[int][]byte, first, last int) {
+	t.Helper()
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	entries := []testSnapshotEntry{{"meta.inf", []byte(fmt.Sprintf(`{"name":"orders","first":%d,"last":%d}`, first, last))}}
+	for i := first; i <= last; i++ {
+		entries = append(entries, testSnapshotEntry{fmt.Sprintf("msgs/%d.blk", i), blocks[i]})
+	}
+	archive := filepath.Join(dir, NATSSnapshotDataFile)
+	writeTestSnapshot(t, archive, entries...)
+	if layout == SnapshotLayoutArchive {
+		return
+	}
+	f, err := os.Open(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := extractSnapshot(f, filepath.Join(dir, NATSSnapshotBlocksDir)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(archive); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func runRestic(t *testing.T, repo string, args ...string) []byte {
+	t.Helper()
+	cmd := exec.Command("restic", append([]string{"--no-cache", "--quiet"}, args...)...)
+	cmd.Env = append(os.Environ(), "RESTIC_REPOSITORY="+repo, "RESTIC_PASSWORD=test")
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			t.Fatalf("restic %v: %v: %s", args, err, exitErr.Stderr)
+		}
+		t.Fatalf("restic %v: %v", args, err)
+	}
+	return out
+}
+
+// resticRepoSize returns the size of the data stored in the repository, after deduplication and compression
+func resticRepoSize(t *testing.T, repo string) int64 {
+	t.Helper()
+	stats := struct {
+		TotalSize int64 `json:"total_size"`
+	}{}
+	if err := json.Unmarshal(runRestic(t, repo, "stats", "--json", "--mode", "raw-data"), &stats); err != nil {
+		t.Fatal(err)
+	}
+	return stats.TotalSize
+}
+
+// TestSnapshotLayoutRepositoryGrowth measures how much the restic repository grows when a stream is backed up
+// again after its oldest block has aged out and a new block has been written, which shifts the whole archive.
+func TestSnapshotLayoutRepositoryGrowth(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the restic measurement in short mode")
+	}
+	if _, err := exec.LookPath("restic"); err != nil {
+		t.Skip("restic binary not found in PATH")
+	}
+
+	const blockCount = 8
+	rnd := rand.New(rand.NewSource(1))
+	blocks := map[int][]byte{}
+	for i := 1; i <= blockCount+1; i++ {
+		blocks[i] = testGrowthBlock(rnd, i)
+	}
+
+	growth := map[string]float64{}
+	for _, layout := range []string{SnapshotLayoutArchive, SnapshotLayoutBlocks} {
+		root := t.TempDir()
+		repo := filepath.Join(root, "repo")
+		dir := filepath.Join(root, "data")
+		runRestic(t, repo, "init")
+
+		writeGrowthSnapshot(t, dir, layout, blocks, 1, blockCount)
+		runRestic(t, repo, "backup", dir)
+		first := resticRepoSize(t, repo)
+
+		writeGrowthSnapshot(t, dir, layout, blocks, 2, blockCount+1)
+		runRestic(t, repo, "backup", dir)
+		second := resticRepoSize(t, repo)
+
+		growth[layout] = float64(second-first) / float64(first)
+		t.Logf("%s layout: first backup stored %d bytes, second backup added %d bytes (%.0f%%)",
+			layout, first, second-first, 100*growth[layout])
+	}
+
+	// only the new block and the metadata are added with the blocks layout, i.e. about 1/blockCount of the first backup
+	if growth[SnapshotLayoutBlocks] > 2.0/blockCount {
+		t.Errorf("blocks layout grew the repository by %.0f%% of the first backup, expected at most %.0f%%",
+			100*growth[SnapshotLayoutBlocks], 100*2.0/blockCount)
+	}
+	if growth[SnapshotLayoutBlocks]*2 > growth[SnapshotLayoutArchive] {
+		t.Errorf("blocks layout grew the repository by %.0f%%, not less than half of the %.0f%% of the archive layout",
+			100*growth[SnapshotLayoutBlocks], 100*growth[SnapshotLayoutArchive])
+	}
+}
@@ -0,0 +1,374 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"github.com/nats-io/nats.go/jetstream"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// ManifestVersion is the version of the manifest format. It has to be changed along with any incompatible change.
+const ManifestVersion = "v1"
+
+// backupManifest describes the content of a backup
+type backupManifest struct {
+	Version       string    `json:"version"`
+	ServerVersion string    `json:"serverVersion,omitempty"`
+	StartTime     time.Time `json:"startTime"`
+	EndTime       time.Time `json:"endTime"`
+	// Layout is the layout of the stream snapshots, empty for the archive layout
+	Layout string `json:"layout,omitempty"`
+	// Encryption is set when the archives of the streams are encrypted
+	Encryption *manifestEncryption `json:"encryption,omitempty"`
+	Streams    []streamManifest    `json:"streams"`
+	// KVBuckets and ObjectBuckets record the backed up Key-Value and object store buckets
+	KVBuckets     []bucketManifest `json:"kvBuckets,omitempty"`
+	ObjectBuckets []bucketManifest `json:"objectBuckets,omitempty"`
+}
+
+type manifestEncryption struct {
+	Algorithm string `json:"algorithm"`
+	// KeyID is the name of the key of the encryption secret that wraps the data keys of the archives
+	KeyID string `json:"keyId"`
+}
+
+type streamManifest struct {
+	Name      string          `json:"name"`
+	Config    json.RawMessage `json:"config,omitempty"`
+	FirstSeq  uint64          `json:"firstSeq"`
+	LastSeq   uint64          `json:"lastSeq"`
+	Messages  uint64          `json:"messages"`
+	Bytes     uint64          `json:"bytes"`
+	Consumers int             `json:"consumers"`
+	// Files maps the path of every file holding the data of the stream, relative to the interim data dir, to its SHA-256 checksum.
+	// It is empty for the streams piped directly into restic.
+	Files map[string]string `json:"files"`
+}
+
+type bucketManifest struct {
+	Name string `json:"name"`
+	// Messages and Bytes hold the state of the stream backing a KV bucket
+	Messages uint64 `json:"messages,omitempty"`
+	// Objects counts the objects of an object store bucket, including the links
+	Objects int    `json:"objects,omitempty"`
+	Bytes   uint64 `json:"bytes"`
+	// Files maps the path of every file holding the data of the bucket, relative to the interim data dir, to its SHA-256 checksum
+	Files map[string]string `json:"files"`
+}
+
+// newManifest creates the manifest of a backup started at startTime
+func (opt *natsOptions) newManifest(session *sessionWrapper, startTime time.Time) *backupManifest {
+	manifest := &backupManifest{
+		Version:   ManifestVersion,
+		StartTime: startTime,
+		Streams:   []streamManifest{},
+	}
+	if session.nc != nil {
+		manifest.ServerVersion = session.nc.ConnectedServerVersion()
+	}
+	if opt.snapshotLayout != SnapshotLayoutArchive {
+		manifest.Layout = opt.snapshotLayout
+	}
+	if opt.encryption != nil {
+		manifest.Encryption = &manifestEncryption{
+			Algorithm: EncryptionAlgorithm,
+			KeyID:     opt.encryption.currentKeyID(),
+		}
+	}
+	return manifest
+}
+
+// writeManifest records the streams and the buckets stored in the interim data dir in the manifest.
+// The state of every stream is taken from the data that has been dumped, not from the server, which may have changed since.
+func (opt *natsOptions) writeManifest(session *sessionWrapper, streams []string, startTime time.Time) error {
+	manifest := opt.newManifest(session, startTime)
+	state, err := opt.readBackupStateFile()
+	if err != nil {
+		return err
+	}
+
+	for _, stream := range streams {
+		entry := streamManifest{Name: stream}
+		if info, err := readSnapshotInfo(filepath.Join(opt.interimDataDir, stream)); err == nil {
+			config, err := json.Marshal(info.Config)
+			if err != nil {
+				return err
+			}
+			entry.Config = config
+			entry.FirstSeq, entry.LastSeq = info.State.FirstSeq, info.State.LastSeq
+			entry.Messages, entry.Bytes, entry.Consumers = info.State.Msgs, info.State.Bytes, info.State.Consumers
+		} else if s := state.find(stream); s != nil {
+			// the full backup of an incrementally backed up stream is stored in an earlier snapshot,
+			// so the stream is recorded as the full backup along with the exported increments
+			entry.Config = s.Config
+			entry.FirstSeq, entry.LastSeq = s.BaseFirstSeq, s.LastSeq
+			entry.Messages, entry.Bytes = s.messages()
+			if entry.Consumers, err = countRecordedConsumers(filepath.Join(opt.interimDataDir, stream)); err != nil {
+				return err
+			}
+		}
+
+		files := map[string]string{}
+		for _, dir := range []string{stream, filepath.Join(NATSIncrementalDir, stream)} {
+			if err := opt.checksumFiles(dir, files); err != nil {
+				return err
+			}
+		}
+		entry.Files = files
+		manifest.Streams = append(manifest.Streams, entry)
+	}
+	sort.Slice(manifest.Streams, func(i, j int) bool {
+		return manifest.Streams[i].Name < manifest.Streams[j].Name
+	})
+
+	for _, bucket := range opt.kvBuckets {
+		entry := bucketManifest{Name: bucket, Files: map[string]string{}}
+		dir := filepath.Join(NATSKVDir, bucket)
+		if info, err := readSnapshotInfo(filepath.Join(opt.interimDataDir, dir)); err == nil {
+			entry.Messages, entry.Bytes = info.State.Msgs, info.State.Bytes
+		}
+		if err := opt.checksumFiles(dir, entry.Files); err != nil {
+			return err
+		}
+		manifest.KVBuckets = append(manifest.KVBuckets, entry)
+	}
+	for _, bucket := range opt.objectBuckets {
+		entry := bucketManifest{Name: bucket, Files: map[string]string{}}
+		dir := filepath.Join(NATSObjectDir, bucket)
+		metaFiles, err := filepath.Glob(filepath.Join(opt.interimDataDir, dir, "*"+NATSObjectMetaSuffix))
+		if err != nil {
+			return err
+		}
+		for _, metaFile := range metaFiles {
+			object, err := readObjectInfo(metaFile)
+			if err != nil {
+				return err
+			}
+			entry.Objects++
+			entry.Bytes += object.Size
+		}
+		if err := opt.checksumFiles(dir, entry.Files); err != nil {
+			return err
+		}
+		manifest.ObjectBuckets = append(manifest.ObjectBuckets, entry)
+	}
+	return opt.storeManifest(manifest, filepath.Join(opt.interimDataDir, NATSManifestFile))
+}
+
+// writeStreamingManifest records the streams piped directly into restic in the manifest and stores it in the
+// repository as a separate snapshot. As no copy of the streams is kept, the state of every stream is the one
+// read from the server right before its snapshot and no file checksum is recorded.
+func (opt *natsOptions) writeStreamingManifest(session *sessionWrapper, w *restic.ResticWrapper, targetRef api_v1beta1.TargetRef, infos []*jetstream.StreamInfo, startTime time.Time) (*restic.BackupOutput, error) {
+	manifest := opt.newManifest(session, startTime)
+	for _, info := range infos {
+		config, err := json.Marshal(info.Config)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Streams = append(manifest.Streams, streamManifest{
+			Name:      info.Config.Name,
+			Config:    config,
+			FirstSeq:  info.State.FirstSeq,
+			LastSeq:   info.State.LastSeq,
+			Messages:  info.State.Msgs,
+			Bytes:     info.State.Bytes,
+			Consumers: info.State.Consumers,
+			Files:     map[string]string{},
+		})
+	}
+	sort.Slice(manifest.Streams, func(i, j int) bool {
+		return manifest.Streams[i].Name < manifest.Streams[j].Name
+	})
+
+	file := filepath.Join(opt.setupOptions.ScratchDir, NATSManifestFile)
+	if err := opt.storeManifest(manifest, file); err != nil {
+		return nil, err
+	}
+	defer os.Remove(file)
+
+	backupOptions := opt.backupOptions
+	backupOptions.BackupPaths = nil
+	backupOptions.StdinFileName = NATSManifestFile
+	backupOptions.StdinPipeCommands = []restic.Command{
+		{
+			Name: "cat",
+			Args: []any{file},
+		},
+	}
+	return w.RunBackup(backupOptions, targetRef)
+}
+
+func (opt *natsOptions) storeManifest(manifest *backupManifest, file string) error {
+	manifest.EndTime = time.Now()
+	byteManifest, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, byteManifest, 0o644)
+}
+
+// countRecordedConsumers returns the number of consumers recorded in dir by dumpConsumers
+func countRecordedConsumers(dir string) (int, error) {
+	byteConsumers, err := os.ReadFile(filepath.Join(dir, NATSConsumersFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var consumers []json.RawMessage
+	if err := json.Unmarshal(byteConsumers, &consumers); err != nil {
+		return 0, err
+	}
+	return len(consumers), nil
+}
+
+// checksumFiles adds the checksum of every file under dir, relative to the interim data dir, to files
+func (opt *natsOptions) checksumFiles(dir string, files map[string]string) error {
+	root := filepath.Join(opt.interimDataDir, dir)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		sum, err := fileChecksum(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(opt.interimDataDir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = sum
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readManifest reads the manifest stored in dir. It returns nil if the backup has been taken without a manifest.
+func readManifest(dir string) (*backupManifest, error) {
+	byteManifest, err := os.ReadFile(filepath.Join(dir, NATSManifestFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	manifest := &backupManifest{}
+	if err := json.Unmarshal(byteManifest, manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if manifest.Version != ManifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %q", manifest.Version)
+	}
+	return manifest, nil
+}
+
+// verifyChecksums compares the files of a stream stored in dir with the checksums recorded in the manifest
+func (m *streamManifest) verifyChecksums(dir string) error {
+	return verifyFileChecksums(dir, m.Files)
+}
+
+// verifyFiles compares the files of every stream and bucket stored in dir with the checksums recorded in the manifest
+func (m *backupManifest) verifyFiles(dir string) error {
+	var errs []error
+	for i := range m.Streams {
+		if err := m.Streams[i].verifyChecksums(dir); err != nil {
+			errs = append(errs, fmt.Errorf("stream %s: %w", m.Streams[i].Name, err))
+		}
+	}
+	for _, buckets := range [][]bucketManifest{m.KVBuckets, m.ObjectBuckets} {
+		for i := range buckets {
+			if err := verifyFileChecksums(dir, buckets[i].Files); err != nil {
+				errs = append(errs, fmt.Errorf("bucket %s: %w", buckets[i].Name, err))
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// findKVBucket returns the manifest of a KV bucket, or nil if it is not recorded
+func (m *backupManifest) findKVBucket(name string) *bucketManifest {
+	if m == nil {
+		return nil
+	}
+	return findBucket(m.KVBuckets, name)
+}
+
+// findObjectBucket returns the manifest of an object store bucket, or nil if it is not recorded
+func (m *backupManifest) findObjectBucket(name string) *bucketManifest {
+	if m == nil {
+		return nil
+	}
+	return findBucket(m.ObjectBuckets, name)
+}
+
+func findBucket(buckets []bucketManifest, name string) *bucketManifest {
+	for i := range buckets {
+		if buckets[i].Name == name {
+			return &buckets[i]
+		}
+	}
+	return nil
+}
+
+// verifyFileChecksums compares the files stored in dir with the given checksums
+func verifyFileChecksums(dir string, files map[string]string) error {
+	for file, expected := range files {
+		sum, err := fileChecksum(filepath.Join(dir, filepath.FromSlash(file)))
+		if err != nil {
+			return err
+		}
+		if sum != expected {
+			return fmt.Errorf("checksum mismatch of %s", file)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func writeTestFile(t *testing.T, file string, v any) {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteManifest(t *testing.T) {
+	dir := t.TempDir()
+	// a stream backed up in full
+	writeTestFile(t, filepath.Join(dir, "orders", NATSSnapshotMetaFile), jetstream.StreamInfo{
+		Config: jetstream.StreamConfig{Name: "orders"},
+		State:  jetstream.StreamState{FirstSeq: 1, LastSeq: 10, Msgs: 10, Bytes: 1000, Consumers: 1},
+	})
+	// a stream backed up incrementally on top of a full backup stored in an earlier snapshot
+	segment := filepath.Join(NATSIncrementalDir, "events", "00000000000000000021-00000000000000000030.json")
+	writeTestFile(t, filepath.Join(dir, segment), storedMsg{Subject: "events.a", Sequence: 21})
+	writeTestFile(t, filepath.Join(dir, "events", NATSConsumersFile), []jetstream.ConsumerInfo{{Name: "a"}, {Name: "b"}})
+	writeTestFile(t, filepath.Join(dir, NATSBackupStateFile), backupState{
+		Streams: []streamBackupState{
+			{
+				Stream:       "events",
+				LastSeq:      30,
+				BaseLastSeq:  20,
+				BaseFirstSeq: 5,
+				BaseMessages: 16,
+				BaseBytes:    1600,
+				Config:       json.RawMessage(`{"name":"events"}`),
+				Increments: []incrementalSegment{
+					{FromSeq: 21, ToSeq: 30, File: segment, Messages: 8, Bytes: 800},
+				},
+			},
+		},
+	})
+	// the buckets
+	writeTestFile(t, filepath.Join(dir, NATSKVDir, "config", NATSSnapshotMetaFile), jetstream.StreamInfo{
+		State: jetstream.StreamState{Msgs: 3, Bytes: 300},
+	})
+	writeTestFile(t, filepath.Join(dir, NATSObjectDir, "files", objectFileName("a")+NATSObjectMetaSuffix), jetstream.ObjectInfo{
+		ObjectMeta: jetstream.ObjectMeta{Name: "a"},
+		Size:       42,
+	})
+
+	opt := &natsOptions{
+		interimDataDir: dir,
+		snapshotLayout: SnapshotLayoutArchive,
+		kvBuckets:      []string{"config"},
+		objectBuckets:  []string{"files"},
+	}
+	if err := opt.writeManifest(&sessionWrapper{}, []string{"orders", "events"}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(manifest.Streams) != 2 {
+		t.Fatalf("expected 2 streams, got %d", len(manifest.Streams))
+	}
+	events, orders := manifest.Streams[0], manifest.Streams[1]
+	if orders.Name != "orders" || orders.Messages != 10 || orders.LastSeq != 10 || orders.Consumers != 1 || len(orders.Files) != 1 {
+		t.Errorf("unexpected manifest of stream orders: %+v", orders)
+	}
+	config := jetstream.StreamConfig{}
+	if err := json.Unmarshal(events.Config, &config); err != nil {
+		t.Fatal(err)
+	}
+	if events.Name != "events" || events.FirstSeq != 5 || events.LastSeq != 30 || events.Messages != 24 || events.Bytes != 2400 ||
+		events.Consumers != 2 || config.Name != "events" || len(events.Files) != 2 {
+		t.Errorf("unexpected manifest of stream events: %+v", events)
+	}
+	if len(manifest.KVBuckets) != 1 || manifest.KVBuckets[0].Messages != 3 || len(manifest.KVBuckets[0].Files) != 1 {
+		t.Errorf("unexpected manifest of the KV buckets: %+v", manifest.KVBuckets)
+	}
+	if len(manifest.ObjectBuckets) != 1 || manifest.ObjectBuckets[0].Objects != 1 || manifest.ObjectBuckets[0].Bytes != 42 {
+		t.Errorf("unexpected manifest of the object store buckets: %+v", manifest.ObjectBuckets)
+	}
+	if err := verifyBucketManifest(dir, manifest, manifest.findKVBucket("config")); err != nil {
+		t.Errorf("unexpected verification failure: %v", err)
+	}
+	if err := verifyBucketManifest(dir, manifest, manifest.findKVBucket("missing")); err == nil {
+		t.Errorf("expected a bucket missing from the manifest to fail the verification")
+	}
+}
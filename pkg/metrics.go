@@ -0,0 +1,302 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"k8s.io/klog/v2"
+)
+
+const (
+	MetricsOperationBackup  = "backup"
+	MetricsOperationRestore = "restore"
+
+	metricsPushTimeout = 30 * time.Second
+)
+
+// runMetrics holds the metrics of a backup or restore run. The metrics of the run are pushed to the
+// Pushgateway in a group identified by the job and the app binding, so every run replaces the metrics
+// of the previous run of the same app binding.
+type runMetrics struct {
+	registry *prometheus.Registry
+
+	success        prometheus.Gauge
+	duration       prometheus.Gauge
+	endTime        prometheus.Gauge
+	streamsTotal   prometheus.Gauge
+	streamsFailed  prometheus.Gauge
+	streamSuccess  *prometheus.GaugeVec
+	streamDuration *prometheus.GaugeVec
+	streamMessages *prometheus.GaugeVec
+	streamBytes    *prometheus.GaugeVec
+}
+
+func newRunMetrics(operation string) *runMetrics {
+	streamLabels := []string{"account", "stream"}
+	m := &runMetrics{
+		registry: prometheus.NewRegistry(),
+		success: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "nats",
+			Subsystem: operation,
+			Name:      "success",
+			Help:      fmt.Sprintf("Whether the %s run has succeeded for all the streams", operation),
+		}),
+		duration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "nats",
+			Subsystem: operation,
+			Name:      "duration_seconds",
+			Help:      fmt.Sprintf("Time taken by the %s run", operation),
+		}),
+		endTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "nats",
+			Subsystem: operation,
+			Name:      "end_time_seconds",
+			Help:      fmt.Sprintf("Unix time when the %s run has ended", operation),
+		}),
+		streamsTotal: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "nats",
+			Subsystem: operation,
+			Name:      "streams",
+			Help:      fmt.Sprintf("Number of streams processed by the %s run", operation),
+		}),
+		streamsFailed: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "nats",
+			Subsystem: operation,
+			Name:      "streams_failed",
+			Help:      fmt.Sprintf("Number of streams the %s run has failed for", operation),
+		}),
+		streamSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "nats",
+			Subsystem: operation,
+			Name:      "stream_success",
+			Help:      fmt.Sprintf("Whether the %s of the stream has succeeded", operation),
+		}, streamLabels),
+		streamDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "nats",
+			Subsystem: operation,
+			Name:      "stream_duration_seconds",
+			Help:      fmt.Sprintf("Time taken by the %s of the stream", operation),
+		}, streamLabels),
+		streamMessages: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "nats",
+			Subsystem: operation,
+			Name:      "stream_messages",
+			Help:      fmt.Sprintf("Number of messages of the stream at the %s. It is only set if the %s of the stream has succeeded", operation, operation),
+		}, streamLabels),
+		streamBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "nats",
+			Subsystem: operation,
+			Name:      "stream_bytes",
+			Help:      fmt.Sprintf("Size of the messages of the stream at the %s. It is only set if the %s of the stream has succeeded", operation, operation),
+		}, streamLabels),
+	}
+	m.registry.MustRegister(m.success, m.duration, m.endTime, m.streamsTotal, m.streamsFailed,
+		m.streamSuccess, m.streamDuration, m.streamMessages, m.streamBytes)
+	return m
+}
+
+// record sets the metrics from the outcome of the run and of every stream
+func (m *runMetrics) record(phase string, startTime time.Time, results []streamResult) {
+	endTime := time.Now()
+	m.success.Set(boolToFloat(phase == StreamPhaseSucceeded))
+	m.duration.Set(endTime.Sub(startTime).Seconds())
+	m.endTime.Set(float64(endTime.Unix()))
+	m.streamsTotal.Set(float64(len(results)))
+
+	failed := 0
+	for _, result := range results {
+		labels := prometheus.Labels{"account": result.Account, "stream": result.Stream}
+		succeeded := result.Phase != StreamPhaseFailed
+		if !succeeded {
+			failed++
+		}
+		m.streamSuccess.With(labels).Set(boolToFloat(succeeded))
+		if d, err := time.ParseDuration(result.Duration); err == nil {
+			m.streamDuration.With(labels).Set(d.Seconds())
+		}
+		// the size of a failed stream may only have been read partially, so it is not reported
+		if succeeded {
+			m.streamMessages.With(labels).Set(float64(result.Messages))
+			m.streamBytes.With(labels).Set(float64(result.Bytes))
+		}
+	}
+	m.streamsFailed.Set(float64(failed))
+}
+
+// push replaces the metrics of the group in the Pushgateway with the metrics of the run
+func (m *runMetrics) push(ctx context.Context, client *http.Client, gatewayURL string, grouping []string) error {
+	families, err := m.registry.Gather()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	format := expfmt.NewFormat(expfmt.TypeTextPlain)
+	enc := expfmt.NewEncoder(&buf, format)
+	for _, family := range families {
+		if err := enc.Encode(family); err != nil {
+			return err
+		}
+	}
+
+	// the grouping key is passed as /<label>/<value> pairs after the job
+	segments := []string{strings.TrimSuffix(gatewayURL, "/"), "metrics"}
+	for _, v := range grouping {
+		segments = append(segments, url.PathEscape(v))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, strings.Join(segments, "/"), &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", string(format))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("pushgateway returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// pushMetrics pushes the metrics of the run to --pushgateway-url. A failure to push is only
+// logged, so that it does not change the outcome of the run.
+func (opt *natsOptions) pushMetrics(operation string, runErr error, startTime time.Time) {
+	if opt.pushgatewayURL == "" {
+		return
+	}
+	m := newRunMetrics(operation)
+	m.record(opt.streamResults.overallPhase(runErr), startTime, opt.streamResults.list())
+
+	// the metrics of a cancelled run are pushed too
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(opt.ctx), metricsPushTimeout)
+	defer cancel()
+	namespace := opt.appBindingNamespace
+	if namespace == "" {
+		namespace = opt.namespace
+	}
+	grouping := []string{
+		"job", opt.metricsJob,
+		"appbinding_namespace", namespace,
+		"appbinding", opt.appBindingName,
+	}
+	client, err := opt.newPushgatewayClient()
+	if err != nil {
+		klog.Warningf("Failed to push the metrics to %s. Reason: %v", opt.pushgatewayURL, err)
+		return
+	}
+	if err := m.push(ctx, client, opt.pushgatewayURL, grouping); err != nil {
+		klog.Warningf("Failed to push the metrics to %s. Reason: %v", opt.pushgatewayURL, err)
+		return
+	}
+	klog.Infof("Pushed the %s metrics to %s", operation, opt.pushgatewayURL)
+}
+
+// newPushgatewayClient returns the client for pushing the metrics with the TLS and authentication settings of the flags
+func (opt *natsOptions) newPushgatewayClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: opt.pushgatewayInsecureSkipVerify,
+	}
+	if opt.pushgatewayCAFile != "" {
+		ca, err := os.ReadFile(opt.pushgatewayCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in %s", opt.pushgatewayCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if opt.pushgatewayCertFile != "" || opt.pushgatewayKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opt.pushgatewayCertFile, opt.pushgatewayKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate of the Pushgateway: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	auth := &pushgatewayAuth{
+		next:     transport,
+		username: opt.pushgatewayUsername,
+	}
+	if opt.pushgatewayPasswordFile != "" {
+		password, err := os.ReadFile(opt.pushgatewayPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		auth.password = strings.TrimSpace(string(password))
+	}
+	if opt.pushgatewayBearerTokenFile != "" {
+		if auth.username != "" || auth.password != "" {
+			return nil, fmt.Errorf("--pushgateway-bearer-token-file can not be used along with --pushgateway-username or --pushgateway-password-file")
+		}
+		token, err := os.ReadFile(opt.pushgatewayBearerTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		auth.bearerToken = strings.TrimSpace(string(token))
+	}
+	return &http.Client{
+		Timeout:   metricsPushTimeout,
+		Transport: auth,
+	}, nil
+}
+
+// pushgatewayAuth sets the credentials of the Pushgateway on every request
+type pushgatewayAuth struct {
+	next        http.RoundTripper
+	username    string
+	password    string
+	bearerToken string
+}
+
+func (a *pushgatewayAuth) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch {
+	case a.bearerToken != "":
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+a.bearerToken)
+	case a.username != "" || a.password != "":
+		req = req.Clone(req.Context())
+		req.SetBasicAuth(a.username, a.password)
+	}
+	return a.next.RoundTrip(req)
+}
+
+func boolToFloat(v bool) float64 {
+	if v {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,189 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gatherGauges returns the values of the gauges of the registry by their name and stream
+func gatherGauges(t *testing.T, m *runMetrics) map[string]float64 {
+	t.Helper()
+	families, err := m.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]float64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			key := family.GetName()
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "stream" {
+					key += "/" + label.GetValue()
+				}
+			}
+			values[key] = metric.GetGauge().GetValue()
+		}
+	}
+	return values
+}
+
+func TestRecordMetrics(t *testing.T) {
+	m := newRunMetrics(MetricsOperationBackup)
+	m.record(PhasePartiallySucceeded, time.Now(), []streamResult{
+		{Stream: "orders", Phase: StreamPhaseSucceeded, Duration: "2s", Messages: 10, Bytes: 100},
+		{Stream: "events", Phase: StreamPhaseFailed, Duration: "1s", Messages: 3, Bytes: 30},
+	})
+	values := gatherGauges(t, m)
+
+	expected := map[string]float64{
+		"nats_backup_success":                        0,
+		"nats_backup_streams":                        2,
+		"nats_backup_streams_failed":                 1,
+		"nats_backup_stream_success/orders":          1,
+		"nats_backup_stream_success/events":          0,
+		"nats_backup_stream_duration_seconds/orders": 2,
+		"nats_backup_stream_duration_seconds/events": 1,
+		"nats_backup_stream_messages/orders":         10,
+		"nats_backup_stream_bytes/orders":            100,
+	}
+	for key, value := range expected {
+		if v, ok := values[key]; !ok || v != value {
+			t.Errorf("expected %s to be %v, got %v (set: %v)", key, value, v, ok)
+		}
+	}
+	for _, key := range []string{"nats_backup_stream_messages/events", "nats_backup_stream_bytes/events"} {
+		if v, ok := values[key]; ok {
+			t.Errorf("expected %s not to be set for the failed stream, got %v", key, v)
+		}
+	}
+	if _, ok := values["nats_backup_duration_seconds"]; !ok {
+		t.Error("expected the duration of the run to be set")
+	}
+}
+
+func TestPushMetrics(t *testing.T) {
+	var (
+		gotPath string
+		gotAuth string
+	)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		gotPath, gotAuth = r.URL.Path, r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	writeFile := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	caFile := writeFile("ca.crt", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})))
+	tokenFile := writeFile("token", "secret-token\n")
+	passwordFile := writeFile("password", "secret-password\n")
+
+	cases := []struct {
+		name      string
+		opt       natsOptions
+		auth      string
+		clientErr string
+		pushErr   string
+	}{
+		{
+			name: "trusted CA",
+			opt:  natsOptions{pushgatewayCAFile: caFile},
+		},
+		{
+			name: "bearer token",
+			opt:  natsOptions{pushgatewayCAFile: caFile, pushgatewayBearerTokenFile: tokenFile},
+			auth: "Bearer secret-token",
+		},
+		{
+			name: "basic authentication",
+			opt:  natsOptions{pushgatewayCAFile: caFile, pushgatewayUsername: "stash", pushgatewayPasswordFile: passwordFile},
+			auth: "Basic c3Rhc2g6c2VjcmV0LXBhc3N3b3Jk",
+		},
+		{
+			name: "insecure skip verify",
+			opt:  natsOptions{pushgatewayInsecureSkipVerify: true},
+		},
+		{
+			name:    "untrusted certificate",
+			opt:     natsOptions{},
+			pushErr: "certificate",
+		},
+		{
+			name:      "bearer token along with basic authentication",
+			opt:       natsOptions{pushgatewayUsername: "stash", pushgatewayBearerTokenFile: tokenFile},
+			clientErr: "can not be used along with",
+		},
+		{
+			name:      "client certificate without key",
+			opt:       natsOptions{pushgatewayCertFile: caFile},
+			clientErr: "client certificate",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gotPath, gotAuth = "", ""
+			client, err := c.opt.newPushgatewayClient()
+			if c.clientErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.clientErr) {
+					t.Fatalf("expected error containing %q, got %v", c.clientErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			m := newRunMetrics(MetricsOperationBackup)
+			m.record(StreamPhaseSucceeded, time.Now(), nil)
+			err = m.push(context.Background(), client, srv.URL+"/", []string{"job", "stash-nats-backup", "appbinding", "nats"})
+			if c.pushErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.pushErr) {
+					t.Fatalf("expected error containing %q, got %v", c.pushErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if expected := "/metrics/job/stash-nats-backup/appbinding/nats"; gotPath != expected {
+				t.Errorf("expected path %s, got %s", expected, gotPath)
+			}
+			if gotAuth != c.auth {
+				t.Errorf("expected authorization %q, got %q", c.auth, gotAuth)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"k8s.io/klog/v2"
+)
+
+// objectBucket holds the settings of an Object Store bucket
+type objectBucket struct {
+	Bucket      string                `json:"bucket"`
+	Description string                `json:"description,omitempty"`
+	TTL         time.Duration         `json:"ttl"`
+	MaxBytes    int64                 `json:"maxBytes"`
+	Storage     jetstream.StorageType `json:"storage"`
+	Replicas    int                   `json:"replicas"`
+}
+
+func objectStreamName(bucket string) string {
+	return NATSObjectPrefix + bucket
+}
+
+// objectFileName returns a file name that is safe to use for any object name.
+// Object names may contain path separators, so they are encoded instead of used as is.
+func objectFileName(name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+func (opt *natsOptions) dumpObjectBuckets(session *sessionWrapper) error {
+	if len(opt.objectBuckets) == 0 {
+		return nil
+	}
+
+	buckets := make([]objectBucket, 0, len(opt.objectBuckets))
+	for _, bucket := range opt.objectBuckets {
+		info, err := session.getStreamInfo(objectStreamName(bucket))
+		if err != nil {
+			return fmt.Errorf("failed to read object store bucket %q: %w", bucket, err)
+		}
+		buckets = append(buckets, objectBucket{
+			Bucket:      bucket,
+			Description: info.Config.Description,
+			TTL:         info.Config.MaxAge,
+			MaxBytes:    info.Config.MaxBytes,
+			Storage:     info.Config.Storage,
+			Replicas:    info.Config.Replicas,
+		})
+
+		klog.Infoln("Backing up object store bucket: ", bucket)
+		if err := opt.dumpObjects(session, bucket); err != nil {
+			return err
+		}
+	}
+
+	byteBuckets, err := json.Marshal(buckets)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(opt.interimDataDir, NATSObjectBucketsFile), byteBuckets, 0o644)
+}
+
+func (opt *natsOptions) dumpObjects(session *sessionWrapper, bucket string) error {
+	dir := filepath.Join(opt.interimDataDir, NATSObjectDir, bucket)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	obs, err := session.js.ObjectStore(session.ctx, bucket)
+	if err != nil {
+		return fmt.Errorf("failed to open object store bucket %q: %w", bucket, err)
+	}
+	objects, err := obs.List(session.ctx)
+	if err != nil {
+		if errors.Is(err, jetstream.ErrNoObjectsFound) {
+			return nil
+		}
+		return err
+	}
+	for _, object := range objects {
+		if object.Deleted {
+			continue
+		}
+		fileName := objectFileName(object.Name)
+		if object.Opts != nil && object.Opts.Link != nil {
+			klog.Warningf("Skipping data of object %q in bucket %q as it is a link to another object", object.Name, bucket)
+		} else {
+			if err := obs.GetFile(session.ctx, object.Name, filepath.Join(dir, fileName)); err != nil {
+				return fmt.Errorf("failed to read object %q of bucket %q: %w", object.Name, bucket, err)
+			}
+			if err := verifyObjectDigest(filepath.Join(dir, fileName), object); err != nil {
+				return err
+			}
+		}
+
+		byteInfo, err := json.Marshal(object)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, fileName+NATSObjectMetaSuffix), byteInfo, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (opt *natsOptions) restoreObjectBuckets(session *sessionWrapper) error {
+	// like the KV buckets, the object store buckets are restored only when they are selected or when nothing is selected
+	if len(opt.objectBuckets) == 0 && !opt.backupAllStreams() {
+		return nil
+	}
+	byteBuckets, err := os.ReadFile(filepath.Join(opt.interimDataDir, NATSObjectBucketsFile))
+	if err != nil {
+		if os.IsNotExist(err) && len(opt.objectBuckets) == 0 {
+			// the snapshot does not contain any object store bucket
+			return nil
+		}
+		return err
+	}
+	var buckets []objectBucket
+	if err := json.Unmarshal(byteBuckets, &buckets); err != nil {
+		return err
+	}
+	buckets, err = filterObjectBuckets(buckets, opt.objectBuckets)
+	if err != nil {
+		return err
+	}
+
+	if opt.overwrite {
+		streams := make([]string, 0, len(buckets))
+		for i := range buckets {
+			streams = append(streams, objectStreamName(buckets[i].Bucket))
+		}
+		if err := session.removeMatchedStreams(streams); err != nil {
+			return err
+		}
+	}
+
+	// the links are added once all the buckets are restored, as they may refer to objects of another bucket
+	links := make(map[string][]*jetstream.ObjectInfo, len(buckets))
+	stores := make(map[string]jetstream.ObjectStore, len(buckets))
+	for i := range buckets {
+		klog.Infoln("Restoring object store bucket: ", buckets[i].Bucket)
+		obs, err := session.js.ObjectStore(session.ctx, buckets[i].Bucket)
+		if errors.Is(err, jetstream.ErrBucketNotFound) {
+			obs, err = session.js.CreateObjectStore(session.ctx, jetstream.ObjectStoreConfig{
+				Bucket:      buckets[i].Bucket,
+				Description: buckets[i].Description,
+				TTL:         buckets[i].TTL,
+				MaxBytes:    buckets[i].MaxBytes,
+				Storage:     buckets[i].Storage,
+				Replicas:    buckets[i].Replicas,
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("failed to open object store bucket %q: %w", buckets[i].Bucket, err)
+		}
+		stores[buckets[i].Bucket] = obs
+		if links[buckets[i].Bucket], err = opt.restoreObjects(session, obs, buckets[i].Bucket); err != nil {
+			return err
+		}
+	}
+
+	for i := range buckets {
+		bucket := buckets[i].Bucket
+		if err := restoreObjectLinks(session, stores[bucket], bucket, links[bucket]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreObjects puts the objects of the bucket from the interim data dir. It returns the link objects, which are
+// not restored here as the objects they refer to may not exist yet.
+func (opt *natsOptions) restoreObjects(session *sessionWrapper, obs jetstream.ObjectStore, bucket string) ([]*jetstream.ObjectInfo, error) {
+	dir := filepath.Join(opt.interimDataDir, NATSObjectDir, bucket)
+	metaFiles, err := filepath.Glob(filepath.Join(dir, "*"+NATSObjectMetaSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var links []*jetstream.ObjectInfo
+	for _, metaFile := range metaFiles {
+		object, err := readObjectInfo(metaFile)
+		if err != nil {
+			return nil, err
+		}
+		if object.Opts != nil && object.Opts.Link != nil {
+			links = append(links, object)
+			continue
+		}
+
+		dataFile := filepath.Join(dir, objectFileName(object.Name))
+		// make sure that we don't upload a corrupted object
+		if err := verifyObjectDigest(dataFile, object); err != nil {
+			return nil, err
+		}
+
+		restored, err := putObject(session.ctx, obs, object.ObjectMeta, dataFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore object %q in bucket %q: %w", object.Name, bucket, err)
+		}
+		// verify that the server has received the object as it was backed up
+		if restored.Digest != object.Digest {
+			return nil, fmt.Errorf("digest mismatch for object %q in bucket %q. expected: %s, found: %s", object.Name, bucket, object.Digest, restored.Digest)
+		}
+	}
+	return links, nil
+}
+
+// restoreObjectLinks re-creates the link objects of the bucket. A link to a whole bucket is added with AddBucketLink,
+// a link to a single object with AddLink. The bucket fails if the target of a link does not exist.
+func restoreObjectLinks(session *sessionWrapper, obs jetstream.ObjectStore, bucket string, links []*jetstream.ObjectInfo) error {
+	for _, link := range links {
+		target := link.Opts.Link
+		targetObs := obs
+		if target.Bucket != bucket {
+			var err error
+			if targetObs, err = session.js.ObjectStore(session.ctx, target.Bucket); err != nil {
+				return fmt.Errorf("failed to open object store bucket %q linked by object %q of bucket %q: %w", target.Bucket, link.Name, bucket, err)
+			}
+		}
+
+		var err error
+		if target.Name == "" {
+			_, err = obs.AddBucketLink(session.ctx, link.Name, targetObs)
+		} else {
+			var info *jetstream.ObjectInfo
+			if info, err = targetObs.GetInfo(session.ctx, target.Name); err == nil {
+				_, err = obs.AddLink(session.ctx, link.Name, info)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to restore link %q in bucket %q to %s/%s: %w", link.Name, bucket, target.Bucket, target.Name, err)
+		}
+	}
+	return nil
+}
+
+// readObjectInfo reads the object metadata stored along with the object data
+func readObjectInfo(metaFile string) (*jetstream.ObjectInfo, error) {
+	byteInfo, err := os.ReadFile(metaFile)
+	if err != nil {
+		return nil, err
+	}
+	object := &jetstream.ObjectInfo{}
+	if err := json.Unmarshal(byteInfo, object); err != nil {
+		return nil, fmt.Errorf("invalid object metadata %s: %w", filepath.Base(metaFile), err)
+	}
+	return object, nil
+}
+
+func putObject(ctx context.Context, obs jetstream.ObjectStore, meta jetstream.ObjectMeta, file string) (*jetstream.ObjectInfo, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return obs.Put(ctx, meta, f)
+}
+
+func filterObjectBuckets(buckets []objectBucket, names []string) ([]objectBucket, error) {
+	if len(names) == 0 {
+		return buckets, nil
+	}
+	filtered := make([]objectBucket, 0, len(names))
+	for _, name := range names {
+		found := false
+		for i := range buckets {
+			if buckets[i].Bucket == name {
+				filtered = append(filtered, buckets[i])
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("object store bucket %q is not present in the backup", name)
+		}
+	}
+	return filtered, nil
+}
+
+// verifyObjectDigest checks the SHA-256 digest of the file against the digest recorded in the object metadata
+func verifyObjectDigest(file string, object *jetstream.ObjectInfo) error {
+	if object.Digest == "" {
+		return nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	digest := NATSObjectDigestPrefix + base64.URLEncoding.EncodeToString(h.Sum(nil))
+	if digest != object.Digest {
+		return fmt.Errorf("digest mismatch for object %q in bucket %q. expected: %s, found: %s", object.Name, object.Bucket, object.Digest, digest)
+	}
+	return nil
+}
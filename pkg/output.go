@@ -0,0 +1,78 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+)
+
+// natsBackupOutput extends the output of a backup with the NATS specific details.
+// Stash reads only the target status, so the extra fields do not affect it.
+type natsBackupOutput struct {
+	restic.BackupOutput
+	// Phase is the overall phase of the backup. It is PartiallySucceeded when only some of the streams have failed.
+	// Stash does not read it and sees such a backup as failed, as reported in the target status.
+	Phase string `json:"phase,omitempty"`
+	// Streams lists the streams resolved from the stream patterns
+	Streams []string `json:"streams,omitempty"`
+	// StreamResults reports the outcome of every stream
+	StreamResults []streamResult `json:"streamResults,omitempty"`
+}
+
+// natsRestoreOutput extends the output of a restore with the NATS specific details
+type natsRestoreOutput struct {
+	restic.RestoreOutput
+	// Phase is the overall phase of the restore. It is PartiallySucceeded when only some of the streams have failed.
+	// Stash does not read it and sees such a restore as failed, as reported in the target status.
+	Phase string `json:"phase,omitempty"`
+	// Streams lists the streams resolved from the stream patterns
+	Streams []string `json:"streams,omitempty"`
+	// StreamResults reports the outcome of every stream
+	StreamResults []streamResult `json:"streamResults,omitempty"`
+	// Plan reports what the restore would do in dry run mode
+	Plan []streamRestorePlan `json:"plan,omitempty"`
+	// Hooks reports the outcome of the preRestore and postRestore hooks
+	Hooks []hookResult `json:"hooks,omitempty"`
+}
+
+// writeOutput writes the output into "output.json" file in the output directory, the same way restic does
+func (opt *natsOptions) writeOutput(out any) error {
+	fileName := filepath.Join(opt.outputDir, restic.DefaultOutputFileName)
+	jsonOutput, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fileName), restic.FileModeRWXAll); err != nil {
+		return err
+	}
+	newFile := false
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		newFile = true
+	}
+	if err := os.WriteFile(fileName, jsonOutput, restic.FileModeRWXAll); err != nil {
+		return err
+	}
+	// make the file writable to other users
+	if newFile {
+		return os.Chmod(fileName, restic.FileModeRWXAll)
+	}
+	return nil
+}
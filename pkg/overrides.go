@@ -0,0 +1,216 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"sigs.k8s.io/yaml"
+)
+
+// streamOverride holds the stream settings to change while restoring a stream.
+// The zero value of a field keeps the setting recorded in the backup.
+type streamOverride struct {
+	// Name restores the stream under a new name. It can only be set per stream.
+	Name     string   `json:"name,omitempty"`
+	Replicas int      `json:"replicas,omitempty"`
+	Storage  string   `json:"storage,omitempty"`
+	Cluster  string   `json:"cluster,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	MaxBytes int64    `json:"maxBytes,omitempty"`
+	MaxAge   string   `json:"maxAge,omitempty"`
+	Subjects []string `json:"subjects,omitempty"`
+}
+
+// merge returns the override with the fields set in other replacing the ones of o
+func (o streamOverride) merge(other streamOverride) streamOverride {
+	if other.Name != "" {
+		o.Name = other.Name
+	}
+	if other.Replicas != 0 {
+		o.Replicas = other.Replicas
+	}
+	if other.Storage != "" {
+		o.Storage = other.Storage
+	}
+	if other.Cluster != "" {
+		o.Cluster = other.Cluster
+	}
+	if len(other.Tags) != 0 {
+		o.Tags = other.Tags
+	}
+	if other.MaxBytes != 0 {
+		o.MaxBytes = other.MaxBytes
+	}
+	if other.MaxAge != "" {
+		o.MaxAge = other.MaxAge
+	}
+	if len(other.Subjects) != 0 {
+		o.Subjects = other.Subjects
+	}
+	return o
+}
+
+func (o streamOverride) isEmpty() bool {
+	return o.Name == "" && o.Replicas == 0 && o.Storage == "" && o.Cluster == "" && len(o.Tags) == 0 &&
+		o.MaxBytes == 0 && o.MaxAge == "" && len(o.Subjects) == 0
+}
+
+// loadStreamOverrides reads the per stream overrides from --stream-overrides-file.
+// The file maps the backed up stream names to their overrides in YAML or JSON format.
+func (opt *natsOptions) loadStreamOverrides() error {
+	if opt.streamOverridesFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(opt.streamOverridesFile)
+	if err != nil {
+		return err
+	}
+	overrides := map[string]streamOverride{}
+	if err := yaml.UnmarshalStrict(data, &overrides); err != nil {
+		return fmt.Errorf("invalid stream overrides file %s: %w", opt.streamOverridesFile, err)
+	}
+	opt.streamOverrides = overrides
+	return nil
+}
+
+// overrideFor returns the override of a stream. The per stream override takes precedence over the global one.
+func (opt *natsOptions) overrideFor(stream string) streamOverride {
+	override := opt.globalStreamOverride
+	override.Name = ""
+	return override.merge(opt.streamOverrides[stream])
+}
+
+// restoreName returns the name a stream is restored as
+func (opt *natsOptions) restoreName(stream string) string {
+	if name := opt.overrideFor(stream).Name; name != "" {
+		return name
+	}
+	return stream
+}
+
+// streamRestoreConfig returns the name the stream is restored as and the configuration to restore it with.
+// An empty configuration means the configuration recorded in the snapshot is used as is.
+func (opt *natsOptions) streamRestoreConfig(stream string) (string, json.RawMessage, error) {
+	config, err := readSnapshotConfig(filepath.Join(opt.interimDataDir, stream))
+	if err != nil {
+		return "", nil, err
+	}
+	// the mirror and the sources must point to the names their streams are restored as
+	originRenamed := false
+	for _, origin := range streamOrigins(config) {
+		if opt.restoreName(origin) != origin {
+			originRenamed = true
+		}
+	}
+	override := opt.overrideFor(stream)
+	if override.isEmpty() && !originRenamed {
+		return stream, nil, nil
+	}
+
+	byteMeta, err := os.ReadFile(filepath.Join(opt.interimDataDir, stream, NATSSnapshotMetaFile))
+	if err != nil {
+		return "", nil, err
+	}
+	meta := &snapshotResponse{}
+	if err := json.Unmarshal(byteMeta, meta); err != nil {
+		return "", nil, fmt.Errorf("invalid snapshot metadata of stream %s: %w", stream, err)
+	}
+	restoreConfig, err := applyStreamOverride(meta.Config, override, opt.restoreName)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to override configuration of stream %s: %w", stream, err)
+	}
+	return opt.restoreName(stream), restoreConfig, nil
+}
+
+// applyStreamOverride rewrites the stored stream configuration. The mirror and the sources are renamed by rename.
+// The configuration is edited as a generic map, so the fields unknown to the client library are preserved.
+func applyStreamOverride(config json.RawMessage, override streamOverride, rename func(string) string) (json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(config))
+	dec.UseNumber()
+	cfg := map[string]any{}
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, err
+	}
+
+	if override.Name != "" {
+		cfg["name"] = override.Name
+	}
+	if override.Replicas != 0 {
+		cfg["num_replicas"] = override.Replicas
+	}
+	if override.Storage != "" {
+		var storage jetstream.StorageType
+		if err := storage.UnmarshalJSON([]byte(fmt.Sprintf("%q", override.Storage))); err != nil {
+			return nil, err
+		}
+		cfg["storage"] = storage
+	}
+	if override.Cluster != "" || len(override.Tags) != 0 {
+		placement, _ := cfg["placement"].(map[string]any)
+		if placement == nil {
+			placement = map[string]any{}
+		}
+		if override.Cluster != "" {
+			placement["cluster"] = override.Cluster
+		}
+		if len(override.Tags) != 0 {
+			placement["tags"] = override.Tags
+		}
+		cfg["placement"] = placement
+	}
+	if override.MaxBytes != 0 {
+		cfg["max_bytes"] = override.MaxBytes
+	}
+	if override.MaxAge != "" {
+		maxAge, err := time.ParseDuration(override.MaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max age %q: %w", override.MaxAge, err)
+		}
+		cfg["max_age"] = maxAge.Nanoseconds()
+	}
+	if len(override.Subjects) != 0 {
+		cfg["subjects"] = override.Subjects
+	}
+	if mirror, ok := cfg["mirror"].(map[string]any); ok {
+		renameOrigin(mirror, rename)
+	}
+	if sources, ok := cfg["sources"].([]any); ok {
+		for _, source := range sources {
+			if source, ok := source.(map[string]any); ok {
+				renameOrigin(source, rename)
+			}
+		}
+	}
+	return json.Marshal(cfg)
+}
+
+// renameOrigin renames the stream of a mirror or source configuration. An external origin is kept as is.
+func renameOrigin(origin map[string]any, rename func(string) string) {
+	if origin["external"] != nil {
+		return
+	}
+	if name, ok := origin["name"].(string); ok && name != "" {
+		origin["name"] = rename(name)
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// restorePoint is the moment up to which the streams are restored.
+// Either a timestamp or a stream sequence is set.
+type restorePoint struct {
+	time time.Time
+	seq  uint64
+}
+
+// getRestorePoint parses the point-in-time restore flags. It returns nil if none of them has been provided.
+func (opt *natsOptions) getRestorePoint() (*restorePoint, error) {
+	if opt.restoreUntilTime != "" && opt.restoreUntilSeq != 0 {
+		return nil, fmt.Errorf("only one of --restore-until-time and --restore-until-seq can be specified")
+	}
+	if opt.restoreUntilSeq != 0 {
+		return &restorePoint{seq: opt.restoreUntilSeq}, nil
+	}
+	if opt.restoreUntilTime != "" {
+		t, err := time.Parse(time.RFC3339, opt.restoreUntilTime)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --restore-until-time %q. Reason: %v", opt.restoreUntilTime, err)
+		}
+		return &restorePoint{time: t}, nil
+	}
+	return nil, nil
+}
+
+func (rp *restorePoint) String() string {
+	if rp.seq != 0 {
+		return fmt.Sprintf("sequence %d", rp.seq)
+	}
+	return rp.time.Format(time.RFC3339)
+}
+
+// exceeded reports whether a record of a message block is beyond the restore point.
+// Tombstones carry the sequence of the removed message, so only their timestamp is considered.
+func (rp *restorePoint) exceeded(rec *msgRecord) bool {
+	if rp == nil {
+		return false
+	}
+	if rp.seq != 0 {
+		return !rec.tombstone && rec.seq > rp.seq
+	}
+	return rec.ts > rp.time.UnixNano()
+}
+
+func (rp *restorePoint) exceededMsg(msg *storedMsg) bool {
+	if rp.seq != 0 {
+		return msg.Sequence > rp.seq
+	}
+	return msg.Time.After(rp.time)
+}
+
+// applyRestorePoint trims the restored data of the streams in the interim data directory at the restore point.
+// It has to be called before the data is loaded into the server.
+func (opt *natsOptions) applyRestorePoint(rp *restorePoint, streams []string, state *backupState) error {
+	if rp.seq != 0 && len(streams) != 1 {
+		return fmt.Errorf("--restore-until-seq requires exactly one stream to restore as the sequences are not shared among the streams")
+	}
+	for _, stream := range streams {
+		klog.Infof("Trimming stream %s at %s", stream, rp)
+		if err := truncateStreamSnapshot(filepath.Join(opt.interimDataDir, stream), rp, opt.encryption); err != nil {
+			return err
+		}
+		if s := state.find(stream); s != nil {
+			if err := opt.trimIncrements(rp, s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// trimIncrements removes the messages beyond the restore point from the increments of the stream.
+// The increments that start beyond the restore point are dropped altogether.
+func (opt *natsOptions) trimIncrements(rp *restorePoint, s *streamBackupState) error {
+	increments := make([]incrementalSegment, 0, len(s.Increments))
+	for _, segment := range s.Increments {
+		file := filepath.Join(opt.interimDataDir, segment.File)
+		var kept []*storedMsg
+		exceeded := false
+		err := forEachStoredMsg(file, opt.encryption, func(msg *storedMsg) error {
+			if exceeded || rp.exceededMsg(msg) {
+				exceeded = true
+				return nil
+			}
+			kept = append(kept, msg)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(kept) != 0 {
+			segment.ToSeq = kept[len(kept)-1].Sequence
+			if err := writeStoredMsgs(file, kept, opt.encryption); err != nil {
+				return err
+			}
+			increments = append(increments, segment)
+			s.LastSeq = segment.ToSeq
+		}
+		if exceeded {
+			break
+		}
+	}
+	s.Increments = increments
+	return nil
+}
+
+func writeStoredMsgs(file string, msgs []*storedMsg, encryption *archiveEncryption) error {
+	f, err := encryption.create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, msg := range msgs {
+		if err := enc.Encode(msg); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
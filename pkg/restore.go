@@ -19,17 +19,22 @@ package pkg
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	stash "stash.appscode.dev/apimachinery/client/clientset/versioned"
 	"stash.appscode.dev/apimachinery/pkg/restic"
 
+	"github.com/nats-io/nats.go/jetstream"
 	"github.com/spf13/cobra"
 	license "go.bytebuilders.dev/license-verifier/kubernetes"
 	"gomodules.xyz/flags"
-	shell "gomodules.xyz/go-sh"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
@@ -47,8 +52,14 @@ func NewCmdRestore() *cobra.Command {
 				ScratchDir:  restic.DefaultScratchDir,
 				EnableCache: false,
 			},
-			waitTimeout:      300,
-			warningThreshold: "30s",
+			waitTimeout:           300,
+			warningThreshold:      "30s",
+			maxConcurrency:        1,
+			consumerRestorePolicy: ConsumerRestorePolicyResume,
+			invokerKind:           api_v1beta1.ResourceKindRestoreSession,
+			hookTimeout:           10 * time.Minute,
+			metricsJob:            "stash-nats-restore",
+			streamResults:         &streamResults{},
 			restoreOptions: restic.RestoreOptions{
 				Host: restic.DefaultHost,
 			},
@@ -62,6 +73,12 @@ func NewCmdRestore() *cobra.Command {
 		RunE: func(cmd *cobra.Command, args []string) error {
 			flags.EnsureRequiredFlags(cmd, "appbinding", "provider", "storage-secret-name", "storage-secret-namespace")
 
+			// cancelled when the pod is terminated, so that a partial run still reports its failure
+			ctx, cancel := newRunContext(cmd)
+			defer cancel()
+			opt.ctx = ctx
+			startTime := time.Now()
+
 			// prepare client
 			config, err := clientcmd.BuildConfigFromFlags(masterURL, kubeconfigPath)
 			if err != nil {
@@ -73,6 +90,10 @@ func NewCmdRestore() *cobra.Command {
 			if err != nil {
 				return err
 			}
+			opt.stashClient, err = stash.NewForConfig(config)
+			if err != nil {
+				return err
+			}
 			opt.catalogClient, err = appcatalog_cs.NewForConfig(config)
 			if err != nil {
 				return err
@@ -87,7 +108,15 @@ func NewCmdRestore() *cobra.Command {
 
 			var restoreOutput *restic.RestoreOutput
 			restoreOutput, err = opt.restoreNATS(targetRef)
-			if err != nil {
+			if err == nil {
+				// Stash sees the restore as failed, even though the other streams have been restored
+				if ferr := opt.streamResults.partialOutcomeError(); ferr != nil {
+					for i := range restoreOutput.RestoreTargetStatus.Stats {
+						restoreOutput.RestoreTargetStatus.Stats[i].Phase = api_v1beta1.HostRestoreFailed
+						restoreOutput.RestoreTargetStatus.Stats[i].Error = ferr.Error()
+					}
+				}
+			} else {
 				restoreOutput = &restic.RestoreOutput{
 					RestoreTargetStatus: api_v1beta1.RestoreMemberStatus{
 						Ref: targetRef,
@@ -101,9 +130,19 @@ func NewCmdRestore() *cobra.Command {
 					},
 				}
 			}
+			opt.pushMetrics(MetricsOperationRestore, err, startTime)
+			opt.events.completed(context.WithoutCancel(ctx), opt.streamResults.overallPhase(err), err, opt.streamResults.list())
+
 			// If output directory specified, then write the output in "output.json" file in the specified directory
 			if opt.outputDir != "" {
-				return restoreOutput.WriteOutput(filepath.Join(opt.outputDir, restic.DefaultOutputFileName))
+				return opt.writeOutput(natsRestoreOutput{
+					RestoreOutput: *restoreOutput,
+					Phase:         opt.streamResults.overallPhase(err),
+					Streams:       opt.resolvedStreams,
+					StreamResults: opt.streamResults.list(),
+					Plan:          opt.restorePlan,
+					Hooks:         opt.restoreHooks.list(),
+				})
 			}
 
 			return nil
@@ -111,6 +150,7 @@ func NewCmdRestore() *cobra.Command {
 	}
 
 	cmd.Flags().StringVar(&opt.natsArgs, "nats-args", opt.natsArgs, "Additional arguments")
+	_ = cmd.Flags().MarkDeprecated("nats-args", "the nats CLI is not used anymore, so the value is ignored")
 	cmd.Flags().Int32Var(&opt.waitTimeout, "wait-timeout", opt.waitTimeout, "Time limit to wait for the database to be ready")
 	cmd.Flags().StringVar(&opt.warningThreshold, "warning-threshold", opt.warningThreshold, "Warning threshold to allow for establishing connections")
 
@@ -121,6 +161,8 @@ func NewCmdRestore() *cobra.Command {
 	cmd.Flags().StringVar(&opt.appBindingNamespace, "appbinding-namespace", opt.appBindingNamespace, "Namespace of the app binding")
 	cmd.Flags().StringVar(&opt.storageSecret.Name, "storage-secret-name", opt.storageSecret.Name, "Name of the storage secret")
 	cmd.Flags().StringVar(&opt.storageSecret.Namespace, "storage-secret-namespace", opt.storageSecret.Namespace, "Namespace of the storage secret")
+	cmd.Flags().StringVar(&opt.encryptionSecret.Name, "encryption-secret-name", opt.encryptionSecret.Name, "Name of the secret holding the keys the stream archives have been encrypted with. The key recorded in each archive is used to decrypt it")
+	cmd.Flags().StringVar(&opt.encryptionSecret.Namespace, "encryption-secret-namespace", opt.encryptionSecret.Namespace, "Namespace of the encryption secret")
 
 	cmd.Flags().StringVar(&opt.setupOptions.Provider, "provider", opt.setupOptions.Provider, "Backend provider (i.e. gcs, s3, azure etc)")
 	cmd.Flags().StringVar(&opt.setupOptions.Bucket, "bucket", opt.setupOptions.Bucket, "Name of the cloud bucket/container (keep empty for local backend)")
@@ -137,9 +179,42 @@ func NewCmdRestore() *cobra.Command {
 	cmd.Flags().StringSliceVar(&opt.restoreOptions.Snapshots, "snapshot", opt.restoreOptions.Snapshots, "Snapshot to restore")
 
 	cmd.Flags().StringVar(&opt.interimDataDir, "interim-data-dir", opt.interimDataDir, "Directory where the restored data will be stored temporarily before injecting into the desired NATS Server")
+	cmd.Flags().StringVar(&opt.pushgatewayURL, "pushgateway-url", opt.pushgatewayURL, "URL of a Pushgateway compatible endpoint to push the metrics of the run to (keep empty to push no metric)")
+	cmd.Flags().StringVar(&opt.metricsJob, "metrics-job", opt.metricsJob, "Job name to push the metrics with")
+	cmd.Flags().StringVar(&opt.pushgatewayCAFile, "pushgateway-ca-file", opt.pushgatewayCAFile, "Path of the CA bundle to verify the certificate of the Pushgateway with")
+	cmd.Flags().StringVar(&opt.pushgatewayCertFile, "pushgateway-cert-file", opt.pushgatewayCertFile, "Path of the client certificate to authenticate to the Pushgateway with")
+	cmd.Flags().StringVar(&opt.pushgatewayKeyFile, "pushgateway-key-file", opt.pushgatewayKeyFile, "Path of the key of the client certificate of the Pushgateway")
+	cmd.Flags().BoolVar(&opt.pushgatewayInsecureSkipVerify, "pushgateway-insecure-skip-verify", opt.pushgatewayInsecureSkipVerify, "Specify whether to skip the verification of the certificate of the Pushgateway")
+	cmd.Flags().StringVar(&opt.pushgatewayUsername, "pushgateway-username", opt.pushgatewayUsername, "Username for the basic authentication to the Pushgateway")
+	cmd.Flags().StringVar(&opt.pushgatewayPasswordFile, "pushgateway-password-file", opt.pushgatewayPasswordFile, "Path of the file holding the password for the basic authentication to the Pushgateway")
+	cmd.Flags().StringVar(&opt.pushgatewayBearerTokenFile, "pushgateway-bearer-token-file", opt.pushgatewayBearerTokenFile, "Path of the file holding the bearer token to authenticate to the Pushgateway with. It can not be combined with the basic authentication")
 	cmd.Flags().StringVar(&opt.outputDir, "output-dir", opt.outputDir, "Directory where output.json file will be written (keep empty if you don't need to write output in file)")
 	cmd.Flags().StringSliceVar(&opt.streams, "streams", opt.streams, "List of streams to restore. Keep empty to restore all the backed up streams")
+	cmd.Flags().StringSliceVar(&opt.includeStreams, "include-streams", opt.includeStreams, "Restore the backed up streams matching these glob patterns, or regular expressions enclosed in slashes (i.e. /^orders-.*$/)")
+	cmd.Flags().StringSliceVar(&opt.excludeStreams, "exclude-streams", opt.excludeStreams, "Skip the backed up streams matching these glob patterns, or regular expressions enclosed in slashes")
+	cmd.Flags().StringVar(&opt.accountsSecret, "accounts-secret", opt.accountsSecret, "Name of the secret in the namespace of the app binding holding the credentials (creds file) of each account to restore, keyed by the account name")
+	cmd.Flags().StringSliceVar(&opt.accounts, "accounts", opt.accounts, "List of the backed up accounts to restore. Keep empty to restore all the backed up accounts")
+	cmd.Flags().StringSliceVar(&opt.kvBuckets, "kv-buckets", opt.kvBuckets, "List of Key-Value buckets to restore. Keep empty to restore all the backed up buckets")
+	cmd.Flags().StringSliceVar(&opt.objectBuckets, "object-buckets", opt.objectBuckets, "List of Object Store buckets to restore. Keep empty to restore all the backed up buckets")
 	cmd.Flags().BoolVar(&opt.overwrite, "overwrite", opt.overwrite, "Specify whether to delete a stream before restoring if it already exist")
+	cmd.Flags().IntVar(&opt.globalStreamOverride.Replicas, "override-replicas", opt.globalStreamOverride.Replicas, "Restore the streams with this number of replicas")
+	cmd.Flags().StringVar(&opt.globalStreamOverride.Storage, "override-storage", opt.globalStreamOverride.Storage, "Restore the streams with this storage type (file or memory)")
+	cmd.Flags().StringVar(&opt.globalStreamOverride.Cluster, "override-placement-cluster", opt.globalStreamOverride.Cluster, "Place the restored streams in this cluster")
+	cmd.Flags().StringSliceVar(&opt.globalStreamOverride.Tags, "override-placement-tags", opt.globalStreamOverride.Tags, "Place the restored streams on the servers with these tags")
+	cmd.Flags().Int64Var(&opt.globalStreamOverride.MaxBytes, "override-max-bytes", opt.globalStreamOverride.MaxBytes, "Restore the streams with this size limit. Use -1 for no limit")
+	cmd.Flags().StringVar(&opt.globalStreamOverride.MaxAge, "override-max-age", opt.globalStreamOverride.MaxAge, "Restore the streams with this message age limit (i.e. 24h). Use 0s for no limit")
+	cmd.Flags().StringSliceVar(&opt.globalStreamOverride.Subjects, "override-subjects", opt.globalStreamOverride.Subjects, "Restore the streams with this subject list")
+	cmd.Flags().StringVar(&opt.streamOverridesFile, "stream-overrides-file", opt.streamOverridesFile, "Path of a YAML or JSON file mapping the backed up stream names to the settings to override, including a new name. They take precedence over the global overrides")
+	cmd.Flags().BoolVar(&opt.dryRun, "dry-run", opt.dryRun, "Report whether each backed up stream would be created, overwritten, skipped or conflict with an existing stream without changing anything on the server")
+	cmd.Flags().StringVar(&opt.consumerRestorePolicy, "consumer-restore-policy", opt.consumerRestorePolicy, "How to restore the durable consumers of the streams. One of: resume (continue from the recorded ack floor), restart (deliver from the start of the stream) or skip (restore no consumer)")
+	cmd.Flags().BoolVar(&opt.continueOnError, "continue-on-error", opt.continueOnError, "Specify whether to keep restoring the remaining streams when a stream fails. The restore is reported to Stash as failed")
+	cmd.Flags().IntVar(&opt.maxConcurrency, "max-concurrency", opt.maxConcurrency, "Maximum number of streams to restore at the same time. A stream is restored only after the streams it mirrors or sources from")
+	cmd.Flags().BoolVar(&opt.streamFromRestic, "stream-from-restic", opt.streamFromRestic, "Specify whether to pipe the snapshot of each stream directly from restic into the server. Use it for the backups taken with --stream-to-restic")
+	cmd.Flags().StringVar(&opt.invokerKind, "invoker-kind", opt.invokerKind, "Kind of the restore invoker (RestoreSession or RestoreBatch) whose preRestore and postRestore hooks are executed. Only the HTTP and TCP socket handlers are supported")
+	cmd.Flags().StringVar(&opt.invokerName, "invoker-name", opt.invokerName, "Name of the restore invoker. Keep empty to execute no hook")
+	cmd.Flags().DurationVar(&opt.hookTimeout, "hook-timeout", opt.hookTimeout, "Time limit for the execution of each hook")
+	cmd.Flags().StringVar(&opt.restoreUntilTime, "restore-until-time", opt.restoreUntilTime, "Restore the streams only up to this time (RFC3339 format). Messages published after it are discarded")
+	cmd.Flags().Uint64Var(&opt.restoreUntilSeq, "restore-until-seq", opt.restoreUntilSeq, "Restore the stream only up to this sequence. Messages with a higher sequence are discarded")
 	return cmd
 }
 
@@ -150,11 +225,32 @@ func (opt *natsOptions) restoreNATS(targetRef api_v1beta1.TargetRef) (*restic.Re
 		return nil, err
 	}
 
-	opt.setupOptions.StorageSecret, err = opt.kubeClient.CoreV1().Secrets(opt.storageSecret.Namespace).Get(context.TODO(), opt.storageSecret.Name, metav1.GetOptions{})
+	rp, err := opt.getRestorePoint()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := opt.loadStreamOverrides(); err != nil {
+		return nil, err
+	}
+
+	if err := validateConsumerRestorePolicy(opt.consumerRestorePolicy); err != nil {
+		return nil, err
+	}
+
+	if opt.dryRun && (opt.accountsSecret != "" || opt.streamFromRestic) {
+		return nil, fmt.Errorf("--dry-run can not be used along with --accounts-secret or --stream-from-restic")
+	}
+
+	opt.setupOptions.StorageSecret, err = opt.kubeClient.CoreV1().Secrets(opt.storageSecret.Namespace).Get(opt.ctx, opt.storageSecret.Name, metav1.GetOptions{})
 	if err != nil {
 		return nil, err
 	}
 
+	if err := opt.loadEncryption(); err != nil {
+		return nil, err
+	}
+
 	// apply nice, ionice settings from env
 	opt.setupOptions.Nice, err = v1.NiceSettingsFromEnv()
 	if err != nil {
@@ -165,108 +261,235 @@ func (opt *natsOptions) restoreNATS(targetRef api_v1beta1.TargetRef) (*restic.Re
 		return nil, err
 	}
 
-	appBinding, err := opt.catalogClient.AppcatalogV1alpha1().AppBindings(opt.appBindingNamespace).Get(context.TODO(), opt.appBindingName, metav1.GetOptions{})
+	appBinding, err := opt.catalogClient.AppcatalogV1alpha1().AppBindings(opt.appBindingNamespace).Get(opt.ctx, opt.appBindingName, metav1.GetOptions{})
 	if err != nil {
 		return nil, err
 	}
 
-	klog.Infoln("Cleaning up temporary data directory: ", opt.interimDataDir)
-	if err := clearDir(opt.interimDataDir); err != nil {
+	if !opt.dryRun {
+		opt.events = opt.newRunEvents(EventOperationRestore, appBinding, opt.invokerKind, opt.invokerName)
+		opt.events.started(opt.ctx)
+
+		opt.restoreHooks, err = opt.loadRestoreHooks(appBinding, targetRef)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := opt.restoreHooks.executePreRestore(opt.ctx); err != nil {
 		return nil, err
 	}
 
-	session := opt.newSessionWrapper(NATSCMD)
+	restoreOutput, err := opt.restoreApp(appBinding, rp, targetRef)
+	// the postRestore hook runs even if the run has been cancelled, so that the app is not left paused
+	restoreSucceeded := err == nil && opt.streamResults.failedStreamsError() == nil
+	if herr := opt.restoreHooks.executePostRestore(context.WithoutCancel(opt.ctx), restoreSucceeded); herr != nil {
+		if err != nil {
+			return nil, utilerrors.NewAggregate([]error{err, herr})
+		}
+		return nil, herr
+	}
+	return restoreOutput, err
+}
 
-	err = opt.setNATSCredentials(session.sh, appBinding)
-	if err != nil {
-		return nil, err
+// restoreApp restores the backed up data into the server of the app binding using a directory for the credential files of the run
+func (opt *natsOptions) restoreApp(appBinding *appcatalog.AppBinding, rp *restorePoint, targetRef api_v1beta1.TargetRef) (*restic.RestoreOutput, error) {
+	var restoreOutput *restic.RestoreOutput
+	err := opt.withCredentialsDir(func() error {
+		var err error
+		restoreOutput, err = opt.restoreServer(appBinding, rp, targetRef)
+		return err
+	})
+	return restoreOutput, err
+}
+
+// restoreServer restores the backed up data into the server of the app binding
+func (opt *natsOptions) restoreServer(appBinding *appcatalog.AppBinding, rp *restorePoint, targetRef api_v1beta1.TargetRef) (*restic.RestoreOutput, error) {
+	if !opt.streamFromRestic && !opt.dryRun {
+		klog.Infoln("Cleaning up temporary data directory: ", opt.interimDataDir)
+		if err := clearDir(opt.interimDataDir); err != nil {
+			return nil, err
+		}
 	}
 
-	err = session.setNATSConnectionParameters(appBinding)
-	if err != nil {
-		return nil, err
+	if opt.accountsSecret != "" {
+		return opt.restoreAccounts(appBinding, rp, targetRef)
 	}
 
-	err = session.setTLSParameters(appBinding, opt.setupOptions.ScratchDir)
+	session, err := opt.connectAppBinding(appBinding)
 	if err != nil {
 		return nil, err
 	}
+	defer session.close()
 
-	err = session.waitForNATSReady(opt.warningThreshold)
-	if err != nil {
-		return nil, err
+	if opt.dryRun {
+		return opt.planRestore(session, targetRef)
+	}
+
+	if opt.streamFromRestic {
+		return opt.restoreStreamsFromRestic(session, targetRef)
 	}
 
 	// we will restore the desired data into the interim data dir before restoring the streams
 	opt.restoreOptions.RestorePaths = []string{opt.interimDataDir}
 
-	resticWrapper, err := restic.NewResticWrapper(opt.setupOptions)
+	resticWrapper, err := opt.newResticWrapper()
 	if err != nil {
 		return nil, err
 	}
 
-	restoreOutput, err := resticWrapper.RunRestore(opt.restoreOptions, targetRef)
+	// an incremental backup has to be restored along with the snapshots it has been taken on top of
+	chain, err := opt.resolveSnapshotChain(resticWrapper)
 	if err != nil {
 		return nil, err
 	}
-	session.cmd.Args = append(session.cmd.Args, "stream", "restore")
-	session.setUserArgs(opt.natsArgs)
+	if len(chain) != 0 {
+		opt.restoreOptions.Snapshots = chain
+	}
 
+	var restoreOutput *restic.RestoreOutput
+	if len(opt.restoreOptions.Snapshots) > 1 {
+		restoreOutput, err = opt.restoreSnapshotChain(resticWrapper, opt.restoreOptions.Snapshots, targetRef)
+	} else {
+		restoreOutput, err = resticWrapper.RunRestore(opt.restoreOptions, targetRef)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := opt.restoreData(session, rp); err != nil {
+		return nil, err
+	}
+	return restoreOutput, nil
+}
+
+// restoreData restores the selected streams and buckets from the interim data dir
+func (opt *natsOptions) restoreData(session *sessionWrapper, rp *restorePoint) error {
+	state, err := opt.readBackupStateFile()
+	if err != nil {
+		return err
+	}
 	var streams []string
-	if len(opt.streams) != 0 {
+	if len(opt.streams) != 0 && !opt.hasStreamPatterns() {
 		streams = opt.streams
 	} else {
 		byteStreams, err := os.ReadFile(filepath.Join(opt.interimDataDir, NATSStreamsFile))
 		if err != nil {
-			return nil, err
+			return err
 		}
 		err = json.Unmarshal(byteStreams, &streams)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if opt.hasStreamPatterns() {
+			if err := opt.resolveStreams(streams); err != nil {
+				return err
+			}
+			klog.Infof("Selected streams: %v", opt.streams)
+			streams = opt.streams
+		}
+	}
+	if rp != nil {
+		if err := opt.applyRestorePoint(rp, streams, state); err != nil {
+			return err
 		}
 	}
+	// the origin streams must exist before the mirrors and the sourced streams pointing at them are created
+	waves, err := opt.restoreWaves(streams)
+	if err != nil {
+		return err
+	}
 	if opt.overwrite {
-		err := removeMatchedStreams(session.sh, streams)
+		// the streams may be restored under new names
+		var names []string
+		for _, wave := range waves {
+			for _, stream := range wave {
+				names = append(names, opt.restoreName(stream))
+			}
+		}
+		err := session.removeMatchedStreams(names)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
-
-	for i := range streams {
-		args := append(session.cmd.Args, filepath.Join(opt.interimDataDir, streams[i]))
-		session.sh.Command(NATSCMD, args...)
-		if err := session.sh.Run(); err != nil {
-			return nil, err
+	for _, wave := range waves {
+		err := opt.forEachStream(wave, func(stream string, result *streamResult) error {
+			name, config, err := opt.streamRestoreConfig(stream)
+			if err != nil {
+				return err
+			}
+			if name != stream {
+				klog.Infof("Restoring stream %s as %s", stream, name)
+			} else {
+				klog.Infoln("Restoring stream: ", stream)
+			}
+			dir := filepath.Join(opt.interimDataDir, stream)
+			var renamed *streamBackupState
+			if s := state.find(stream); s != nil {
+				renamed = new(streamBackupState)
+				*renamed = *s
+				renamed.Stream = name
+				restoreConfig, err := restoredStreamConfig(dir, config)
+				if err != nil {
+					return err
+				}
+				if err := opt.checkIncrements(restoreConfig, renamed); err != nil {
+					return err
+				}
+			}
+			return session.removeOnCancel(name, func() error {
+				if err := restoreFromDir(session.ctx, session.nc, name, dir, config, opt.encryption); err != nil {
+					return err
+				}
+				var floors *restoredAckFloors
+				if renamed != nil {
+					floors, err = trackAckFloors(session, name, dir, renamed)
+					if err != nil {
+						return err
+					}
+					if err := opt.applyIncrements(session, renamed, floors); err != nil {
+						return err
+					}
+				}
+				if info, err := session.getStreamInfo(name); err == nil {
+					result.Messages, result.Bytes = info.State.Msgs, info.State.Bytes
+				}
+				return opt.restoreConsumers(session, name, dir, floors)
+			})
+		})
+		if err != nil {
+			return err
 		}
 	}
 
-	return restoreOutput, nil
+	if err := opt.restoreKVBuckets(session); err != nil {
+		return err
+	}
+
+	return opt.restoreObjectBuckets(session)
 }
 
-func removeMatchedStreams(sh *shell.Session, streams []string) error {
-	lsArgs := []any{
-		"stream",
-		"ls",
-		"--json",
+// restoredStreamConfig returns the configuration a stream stored in dir is restored with.
+// config is the overridden configuration, if any.
+func restoredStreamConfig(dir string, config json.RawMessage) (*jetstream.StreamConfig, error) {
+	if config == nil {
+		return readSnapshotConfig(dir)
 	}
-	byteStreams, err := sh.Command(NATSCMD, lsArgs...).Output()
-	if err != nil {
-		return err
+	restored := &jetstream.StreamConfig{}
+	if err := json.Unmarshal(config, restored); err != nil {
+		return nil, err
 	}
-	var currStreams []string
-	if err := json.Unmarshal(byteStreams, &currStreams); err != nil {
+	return restored, nil
+}
+
+func (session *sessionWrapper) removeMatchedStreams(streams []string) error {
+	currStreams, err := session.listStreams()
+	if err != nil {
 		return err
 	}
-	rmArgs := []any{
-		"stream",
-		"rm",
-		"-f",
-	}
 	for i := range streams {
 		if streamExists(streams[i], currStreams) {
-			args := append(rmArgs, streams[i])
-			sh.Command(NATSCMD, args...)
-			if err := sh.Run(); err != nil {
+			klog.Infoln("Deleting stream: ", streams[i])
+			if err := session.js.DeleteStream(session.ctx, streams[i]); err != nil && !errors.Is(err, jetstream.ErrStreamNotFound) {
 				return err
 			}
 		}
@@ -274,6 +497,26 @@ func removeMatchedStreams(sh *shell.Session, streams []string) error {
 	return nil
 }
 
+// removeOnCancel restores a stream with fn. If the run is cancelled in the middle, the partially restored
+// stream is deleted so that a later restore can start over. A stream that existed before is never deleted.
+func (session *sessionWrapper) removeOnCancel(stream string, fn func() error) error {
+	_, err := session.getStreamInfo(stream)
+	existed := !errors.Is(err, jetstream.ErrStreamNotFound)
+
+	err = fn()
+	if err == nil || existed || session.ctx.Err() == nil {
+		return err
+	}
+	// the run context is already cancelled, so the stream is deleted within a grace period of its own
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(session.ctx), cleanupTimeout)
+	defer cancel()
+	klog.Warningf("Restore of stream %s has been cancelled. Deleting the partially restored stream", stream)
+	if derr := session.js.DeleteStream(ctx, stream); derr != nil && !errors.Is(derr, jetstream.ErrStreamNotFound) {
+		klog.Errorf("Failed to delete the partially restored stream %s. Reason: %v", stream, derr)
+	}
+	return err
+}
+
 func streamExists(s1 string, list []string) bool {
 	for _, s2 := range list {
 		if s2 == s1 {
@@ -0,0 +1,197 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog/v2"
+)
+
+const (
+	StreamPhaseSucceeded = "Succeeded"
+	StreamPhaseFailed    = "Failed"
+
+	// PhasePartiallySucceeded is the overall phase of a run where only some of the streams have failed
+	PhasePartiallySucceeded = "PartiallySucceeded"
+)
+
+// streamResult is the outcome of backing up or restoring a single stream
+type streamResult struct {
+	Stream   string `json:"stream"`
+	Account  string `json:"account,omitempty"`
+	Phase    string `json:"phase"`
+	Duration string `json:"duration,omitempty"`
+	Messages uint64 `json:"messages"`
+	Bytes    uint64 `json:"bytes"`
+	Error    string `json:"error,omitempty"`
+}
+
+type streamResults struct {
+	mu    sync.Mutex
+	items []streamResult
+}
+
+func (r *streamResults) add(result streamResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.items = append(r.items, result)
+}
+
+func (r *streamResults) list() []streamResult {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]streamResult(nil), r.items...)
+}
+
+// failed returns the names of the failed streams, prefixed by their account
+func (r *streamResults) failed() []string {
+	var names []string
+	for _, result := range r.list() {
+		if result.Phase != StreamPhaseFailed {
+			continue
+		}
+		if result.Account != "" {
+			names = append(names, result.Account+"/"+result.Stream)
+		} else {
+			names = append(names, result.Stream)
+		}
+	}
+	return names
+}
+
+// overallPhase reports the phase of the whole run from the error of the run and the outcome of the streams
+func (r *streamResults) overallPhase(err error) string {
+	switch {
+	case err != nil:
+		return StreamPhaseFailed
+	case len(r.failed()) != 0:
+		return PhasePartiallySucceeded
+	}
+	return StreamPhaseSucceeded
+}
+
+// failedStreamsError returns an error naming the failed streams, or nil if there is none
+func (r *streamResults) failedStreamsError() error {
+	if failed := r.failed(); len(failed) != 0 {
+		return fmt.Errorf("failed streams: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// partialOutcomeError describes a run that has succeeded only for some of the streams, or returns nil if no stream has failed.
+// Stash only knows whether a host has succeeded or failed, so such a run is always reported to Stash as failed with
+// this error. The outcome of every stream is reported in the output, the events and the annotations of the session.
+func (r *streamResults) partialOutcomeError() error {
+	failed := r.failed()
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s: %d of %d streams have failed: %s. The other streams have been processed",
+		PhasePartiallySucceeded, len(failed), len(r.list()), strings.Join(failed, ", "))
+}
+
+// processStream calls fn for the stream and records its outcome. fn may fill the size of the stream in the result.
+// With --continue-on-error the failure is only recorded, so the remaining streams are still processed.
+func (opt *natsOptions) processStream(stream string, fn func(result *streamResult) error) error {
+	startTime := time.Now()
+	result := streamResult{
+		Stream:  stream,
+		Account: opt.account,
+	}
+	err := fn(&result)
+	result.Duration = time.Since(startTime).String()
+	if err != nil {
+		klog.Errorf("Failed to process stream %s. Reason: %v", stream, err)
+		result.Phase = StreamPhaseFailed
+		result.Error = err.Error()
+	} else {
+		klog.Infof("Successfully processed stream %s", stream)
+		result.Phase = StreamPhaseSucceeded
+	}
+	if opt.streamResults != nil {
+		opt.streamResults.add(result)
+	}
+	opt.events.streamProcessed(context.WithoutCancel(opt.ctx), result)
+	// a cancelled run stops regardless of --continue-on-error
+	if err != nil && (!opt.continueOnError || opt.ctx.Err() != nil) {
+		return fmt.Errorf("stream %s: %w", stream, err)
+	}
+	return nil
+}
+
+// forEachStream processes every stream, running at most --max-concurrency streams at a time.
+// The failures are returned as an aggregated error.
+func (opt *natsOptions) forEachStream(streams []string, fn func(stream string, result *streamResult) error) error {
+	maxConcurrency := opt.maxConcurrency
+	if maxConcurrency < 1 {
+		maxConcurrency = 1
+	}
+	// concurrencyLimiter channel is used to limit maximum number of simultaneous go routines
+	concurrencyLimiter := make(chan struct{}, maxConcurrency)
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for _, stream := range streams {
+		concurrencyLimiter <- struct{}{}
+		// no new stream is started once the run has been cancelled
+		if err := opt.ctx.Err(); err != nil {
+			<-concurrencyLimiter
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+			break
+		}
+		wg.Add(1)
+		go func(stream string) {
+			defer func() {
+				<-concurrencyLimiter
+				wg.Done()
+			}()
+			err := opt.processStream(stream, func(result *streamResult) error {
+				return fn(stream, result)
+			})
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}(stream)
+	}
+	wg.Wait()
+	return utilerrors.NewAggregate(errs)
+}
+
+// streamFailed reports whether the stream of the current account has failed
+func (opt *natsOptions) streamFailed(stream string) bool {
+	for _, result := range opt.streamResults.list() {
+		if result.Stream == stream && result.Account == opt.account && result.Phase == StreamPhaseFailed {
+			return true
+		}
+	}
+	return false
+}
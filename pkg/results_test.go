@@ -0,0 +1,72 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestOutcome(t *testing.T) {
+	cases := []struct {
+		name       string
+		phases     []string
+		runErr     error
+		phase      string
+		partialErr string
+	}{
+		{
+			name:   "all succeeded",
+			phases: []string{StreamPhaseSucceeded, StreamPhaseSucceeded},
+			phase:  StreamPhaseSucceeded,
+		},
+		{
+			name:       "some failed",
+			phases:     []string{StreamPhaseSucceeded, StreamPhaseFailed, StreamPhaseFailed},
+			phase:      PhasePartiallySucceeded,
+			partialErr: "PartiallySucceeded: 2 of 3 streams have failed: s1, s2. The other streams have been processed",
+		},
+		{
+			name:   "run failed",
+			phases: []string{StreamPhaseFailed},
+			runErr: errors.New("connection lost"),
+			phase:  StreamPhaseFailed,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &streamResults{}
+			for i, phase := range tc.phases {
+				r.add(streamResult{Stream: "s" + string(rune('0'+i)), Phase: phase})
+			}
+			if phase := r.overallPhase(tc.runErr); phase != tc.phase {
+				t.Errorf("expected phase %s, got %s", tc.phase, phase)
+			}
+			if tc.runErr != nil {
+				// the outcome of the streams is not reported when the whole run has failed
+				return
+			}
+			err := r.partialOutcomeError()
+			switch {
+			case tc.partialErr == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tc.partialErr != "" && (err == nil || err.Error() != tc.partialErr):
+				t.Errorf("expected error %q, got %v", tc.partialErr, err)
+			}
+		})
+	}
+}
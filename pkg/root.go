@@ -43,6 +43,9 @@ func NewRootCmd() *cobra.Command {
 	rootCmd.AddCommand(v.NewCmdVersion())
 	rootCmd.AddCommand(NewCmdBackup())
 	rootCmd.AddCommand(NewCmdRestore())
+	rootCmd.AddCommand(NewCmdVerify())
+	rootCmd.AddCommand(NewCmdSnapshotStream())
+	rootCmd.AddCommand(NewCmdRestoreSnapshot())
 
 	return rootCmd
 }
@@ -0,0 +1,122 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// streamPattern matches stream names. A pattern enclosed in slashes (i.e. /^orders-(eu|us)-.*$/) is a
+// regular expression, anything else is a glob pattern (i.e. orders-*).
+type streamPattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+func parseStreamPatterns(patterns []string) ([]streamPattern, error) {
+	result := make([]streamPattern, 0, len(patterns))
+	for _, p := range patterns {
+		if len(p) > 1 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+			re, err := regexp.Compile(p[1 : len(p)-1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid stream pattern %q: %w", p, err)
+			}
+			result = append(result, streamPattern{re: re})
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid stream pattern %q: %w", p, err)
+		}
+		result = append(result, streamPattern{glob: p})
+	}
+	return result, nil
+}
+
+func (p streamPattern) match(stream string) bool {
+	if p.re != nil {
+		return p.re.MatchString(stream)
+	}
+	ok, _ := path.Match(p.glob, stream)
+	return ok
+}
+
+func matchAny(patterns []streamPattern, stream string) bool {
+	for _, p := range patterns {
+		if p.match(stream) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasStreamPatterns reports whether the streams are selected with --include-streams or --exclude-streams
+func (opt *natsOptions) hasStreamPatterns() bool {
+	return len(opt.includeStreams) != 0 || len(opt.excludeStreams) != 0
+}
+
+// selectStreams resolves the stream selection against the available streams.
+// A stream is selected if it is listed in --streams or matches --include-streams, and does not match
+// --exclude-streams. When neither --streams nor --include-streams is given, every available stream is a candidate.
+func (opt *natsOptions) selectStreams(available []string) ([]string, error) {
+	include, err := parseStreamPatterns(opt.includeStreams)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := parseStreamPatterns(opt.excludeStreams)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := slices.Clone(opt.streams)
+	for _, stream := range available {
+		if slices.Contains(candidates, stream) {
+			continue
+		}
+		if (len(opt.streams) == 0 && len(include) == 0) || matchAny(include, stream) {
+			candidates = append(candidates, stream)
+		}
+	}
+
+	var selected []string
+	for _, stream := range candidates {
+		if !matchAny(exclude, stream) {
+			selected = append(selected, stream)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no stream matched the selection")
+	}
+	return selected, nil
+}
+
+// resolveStreams replaces --streams with the streams selected by the patterns
+func (opt *natsOptions) resolveStreams(available []string) error {
+	if !opt.hasStreamPatterns() {
+		return nil
+	}
+	streams, err := opt.selectStreams(available)
+	if err != nil {
+		return err
+	}
+	opt.streams = streams
+	opt.resolvedStreams = streams
+	return nil
+}
@@ -0,0 +1,435 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/spf13/cobra"
+)
+
+const (
+	jsAPIStreamSnapshot = "$JS.API.STREAM.SNAPSHOT.%s"
+	jsAPIStreamRestore  = "$JS.API.STREAM.RESTORE.%s"
+	snapshotChunkSize   = 128 * 1024
+	snapshotTimeout     = time.Minute
+
+	// statusHeader and descriptionHeader hold the inline status of a message that carries no data
+	statusHeader      = "Status"
+	descriptionHeader = "Description"
+	// statusNoContent marks the end of the snapshot data
+	statusNoContent = "204"
+	// statusControl is used by the flow control and idle heartbeat messages
+	statusControl = "100"
+)
+
+// snapshotRequest asks JetStream to deliver a snapshot of a stream to the given subject
+type snapshotRequest struct {
+	DeliverSubject string `json:"deliver_subject"`
+	ChunkSize      int    `json:"chunk_size,omitempty"`
+	CheckMsgs      bool   `json:"jsck,omitempty"`
+}
+
+// snapshotResponse holds the configuration and the state of the stream at the time of the snapshot.
+// It is stored as the metadata of the snapshot in the same format as "nats stream backup" does.
+type snapshotResponse struct {
+	Config json.RawMessage `json:"config,omitempty"`
+	State  json.RawMessage `json:"state,omitempty"`
+	Error  *apiError       `json:"error,omitempty"`
+}
+
+// restoreResponse tells where to send the snapshot data of a stream being restored
+type restoreResponse struct {
+	DeliverSubject string    `json:"deliver_subject"`
+	Error          *apiError `json:"error,omitempty"`
+}
+
+// apiResponse is the common part of the JetStream API responses
+type apiResponse struct {
+	Error *apiError `json:"error,omitempty"`
+}
+
+type apiError struct {
+	Code        int    `json:"code"`
+	ErrCode     int    `json:"err_code,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Description, e.ErrCode)
+}
+
+// Unwrap maps the error to the API error of the jetstream package,
+// so that it can be matched with errors.Is against the jetstream errors, i.e. jetstream.ErrStreamNotFound.
+func (e *apiError) Unwrap() error {
+	return &jetstream.APIError{
+		Code:        e.Code,
+		ErrorCode:   jetstream.ErrorCode(e.ErrCode),
+		Description: e.Description,
+	}
+}
+
+// NewCmdSnapshotStream writes the snapshot of a stream to stdout.
+// It is used as a stdin pipe command of restic and reads the connection parameters from the environment.
+func NewCmdSnapshotStream() *cobra.Command {
+	var stream string
+
+	cmd := &cobra.Command{
+		Use:               "snapshot-stream",
+		Short:             "Writes the snapshot of a stream to stdout",
+		Hidden:            true,
+		DisableAutoGenTag: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := newRunContext(cmd)
+			defer cancel()
+
+			nc, err := connectFromEnv()
+			if err != nil {
+				return err
+			}
+			defer nc.Close()
+
+			w := bufio.NewWriter(os.Stdout)
+			if err := snapshotStream(ctx, nc, stream, w); err != nil {
+				return err
+			}
+			return w.Flush()
+		},
+	}
+
+	cmd.Flags().StringVar(&stream, "stream", stream, "Name of the stream")
+	_ = cmd.MarkFlagRequired("stream")
+	return cmd
+}
+
+// NewCmdRestoreSnapshot restores a stream from a snapshot read from stdin.
+// It is used as a stdout pipe command of restic dump and reads the connection parameters from the environment.
+func NewCmdRestoreSnapshot() *cobra.Command {
+	var stream string
+
+	cmd := &cobra.Command{
+		Use:               "restore-snapshot",
+		Short:             "Restores a stream from the snapshot read from stdin",
+		Hidden:            true,
+		DisableAutoGenTag: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := newRunContext(cmd)
+			defer cancel()
+
+			nc, err := connectFromEnv()
+			if err != nil {
+				return err
+			}
+			defer nc.Close()
+
+			return restoreSnapshot(ctx, nc, stream, bufio.NewReader(os.Stdin))
+		},
+	}
+
+	cmd.Flags().StringVar(&stream, "stream", stream, "Name of the stream")
+	_ = cmd.MarkFlagRequired("stream")
+	return cmd
+}
+
+// snapshotStream writes the metadata of the stream as a single JSON line followed by the snapshot data (tar.s2) into w
+func snapshotStream(ctx context.Context, nc *nats.Conn, stream string, w io.Writer) error {
+	meta, sub, err := requestSnapshot(ctx, nc, stream)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+
+	byteMeta, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(append(byteMeta, '\n')); err != nil {
+		return err
+	}
+	return receiveSnapshot(ctx, subscriptionSource{sub}, stream, w)
+}
+
+// snapshotToDir stores the snapshot of the stream in dir. The archive layout is the same as "nats stream backup" uses,
+// the blocks layout unpacks the snapshot data into the blocks directory.
+// The snapshot data is encrypted as it is written if encryption is set.
+func snapshotToDir(ctx context.Context, nc *nats.Conn, stream, dir, layout string, encryption *archiveEncryption) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	meta, sub, err := requestSnapshot(ctx, nc, stream)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+
+	byteMeta, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, NATSSnapshotMetaFile), byteMeta, 0o644); err != nil {
+		return err
+	}
+
+	if layout == SnapshotLayoutBlocks {
+		return receiveSnapshotBlocks(ctx, subscriptionSource{sub}, stream, filepath.Join(dir, NATSSnapshotBlocksDir))
+	}
+
+	f, err := encryption.create(filepath.Join(dir, NATSSnapshotDataFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	if err := receiveSnapshot(ctx, subscriptionSource{sub}, stream, w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// requestSnapshot asks the server for a snapshot of the stream.
+// The snapshot data is delivered to the returned subscription.
+func requestSnapshot(ctx context.Context, nc *nats.Conn, stream string) (*snapshotResponse, *nats.Subscription, error) {
+	inbox := nats.NewInbox()
+	sub, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := json.Marshal(snapshotRequest{
+		DeliverSubject: inbox,
+		ChunkSize:      snapshotChunkSize,
+	})
+	if err != nil {
+		_ = sub.Unsubscribe()
+		return nil, nil, err
+	}
+	msg, err := request(ctx, nc, fmt.Sprintf(jsAPIStreamSnapshot, stream), req)
+	if err != nil {
+		_ = sub.Unsubscribe()
+		return nil, nil, fmt.Errorf("failed to request snapshot of stream %s: %w", stream, err)
+	}
+	resp := &snapshotResponse{}
+	if err := json.Unmarshal(msg.Data, resp); err != nil {
+		_ = sub.Unsubscribe()
+		return nil, nil, err
+	}
+	if resp.Error != nil {
+		_ = sub.Unsubscribe()
+		return nil, nil, fmt.Errorf("failed to take snapshot of stream %s: %w", stream, resp.Error)
+	}
+	return &snapshotResponse{Config: resp.Config, State: resp.State}, sub, nil
+}
+
+// snapshotSource delivers the messages of a snapshot and sends the replies the server expects
+type snapshotSource interface {
+	next(ctx context.Context) (*nats.Msg, error)
+	respond(msg *nats.Msg) error
+}
+
+// subscriptionSource receives the snapshot through the subscription to its deliver subject
+type subscriptionSource struct {
+	sub *nats.Subscription
+}
+
+func (s subscriptionSource) next(ctx context.Context) (*nats.Msg, error) {
+	return nextMsg(ctx, s.sub)
+}
+
+func (s subscriptionSource) respond(msg *nats.Msg) error {
+	return msg.Respond(nil)
+}
+
+func receiveSnapshot(ctx context.Context, src snapshotSource, stream string, w io.Writer) error {
+	for {
+		chunk, err := src.next(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to receive snapshot of stream %s: %w", stream, err)
+		}
+		// an empty message marks the end of the snapshot or reports an error in its status.
+		// The older servers end the snapshot with an empty message that has no status at all.
+		if len(chunk.Data) == 0 {
+			switch status := chunk.Header.Get(statusHeader); status {
+			case "", statusNoContent:
+				return nil
+			case statusControl:
+				// a flow control request expects a reply, an idle heartbeat does not
+				if chunk.Reply != "" {
+					if err := src.respond(chunk); err != nil {
+						return err
+					}
+				}
+				continue
+			default:
+				return fmt.Errorf("failed to receive snapshot of stream %s: %s %s", stream, status, chunk.Header.Get(descriptionHeader))
+			}
+		}
+		if _, err := w.Write(chunk.Data); err != nil {
+			return err
+		}
+		// acknowledge the chunk so that the server keeps sending the rest
+		if chunk.Reply != "" {
+			if err := src.respond(chunk); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// receiveSnapshotBlocks unpacks the snapshot data into root as it is received
+func receiveSnapshotBlocks(ctx context.Context, src snapshotSource, stream, root string) error {
+	pr, pw := io.Pipe()
+	received := make(chan error, 1)
+	go func() {
+		err := receiveSnapshot(ctx, src, stream, pw)
+		pw.CloseWithError(err)
+		received <- err
+	}()
+
+	err := extractSnapshot(pr, root)
+	if err == nil {
+		// the end of the archive may be followed by padding
+		_, err = io.Copy(io.Discard, pr)
+	}
+	// stop receiving if the extraction has failed
+	pr.CloseWithError(err)
+	if rerr := <-received; rerr != nil {
+		return rerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to unpack snapshot of stream %s: %w", stream, err)
+	}
+	return nil
+}
+
+// restoreSnapshot restores a stream from the data written by snapshotStream
+func restoreSnapshot(ctx context.Context, nc *nats.Conn, stream string, r *bufio.Reader) error {
+	byteMeta, err := r.ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot metadata of stream %s: %w", stream, err)
+	}
+	meta := &snapshotResponse{}
+	if err := json.Unmarshal(byteMeta, meta); err != nil {
+		return fmt.Errorf("invalid snapshot metadata of stream %s: %w", stream, err)
+	}
+	return sendSnapshot(ctx, nc, stream, meta, r)
+}
+
+// restoreFromDir restores a stream from a snapshot stored by snapshotToDir or "nats stream backup".
+// If config is not empty, it replaces the stream configuration recorded in the snapshot.
+// An encrypted snapshot is decrypted as it is sent, so no plain copy is stored on the disk.
+func restoreFromDir(ctx context.Context, nc *nats.Conn, stream, dir string, config json.RawMessage, encryption *archiveEncryption) error {
+	byteMeta, err := os.ReadFile(filepath.Join(dir, NATSSnapshotMetaFile))
+	if err != nil {
+		return err
+	}
+	meta := &snapshotResponse{}
+	if err := json.Unmarshal(byteMeta, meta); err != nil {
+		return fmt.Errorf("invalid snapshot metadata of stream %s: %w", stream, err)
+	}
+	if len(config) != 0 {
+		meta.Config = config
+	}
+
+	f, err := openSnapshotData(dir, encryption)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return sendSnapshot(ctx, nc, stream, meta, bufio.NewReader(f))
+}
+
+// sendSnapshot uploads the snapshot data to the server which re-creates the stream from it
+func sendSnapshot(ctx context.Context, nc *nats.Conn, stream string, meta *snapshotResponse, r io.Reader) error {
+	req, err := json.Marshal(snapshotResponse{Config: meta.Config, State: meta.State})
+	if err != nil {
+		return err
+	}
+	msg, err := request(ctx, nc, fmt.Sprintf(jsAPIStreamRestore, stream), req)
+	if err != nil {
+		return fmt.Errorf("failed to request restore of stream %s: %w", stream, err)
+	}
+	resp := &restoreResponse{}
+	if err := json.Unmarshal(msg.Data, resp); err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("failed to restore stream %s: %w", stream, resp.Error)
+	}
+
+	chunk := make([]byte, snapshotChunkSize)
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			// every chunk is acknowledged by the server before the next one is sent
+			if _, err := request(ctx, nc, resp.DeliverSubject, chunk[:n]); err != nil {
+				return fmt.Errorf("failed to send snapshot of stream %s: %w", stream, err)
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// an empty message marks the end of the snapshot. The server replies once the stream has been restored.
+	msg, err = request(ctx, nc, resp.DeliverSubject, nil)
+	if err != nil {
+		return fmt.Errorf("failed to complete restore of stream %s: %w", stream, err)
+	}
+	result := &apiResponse{}
+	if err := json.Unmarshal(msg.Data, result); err != nil {
+		return err
+	}
+	if result.Error != nil {
+		return fmt.Errorf("failed to restore stream %s: %w", stream, result.Error)
+	}
+	return nil
+}
+
+// request sends a request to the server and waits for the reply until snapshotTimeout or the cancellation of ctx
+func request(ctx context.Context, nc *nats.Conn, subject string, data []byte) (*nats.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, snapshotTimeout)
+	defer cancel()
+	return nc.RequestWithContext(ctx, subject, data)
+}
+
+// nextMsg waits for the next message of the subscription until snapshotTimeout or the cancellation of ctx
+func nextMsg(ctx context.Context, sub *nats.Subscription) (*nats.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, snapshotTimeout)
+	defer cancel()
+	return sub.NextMsgWithContext(ctx)
+}
@@ -0,0 +1,402 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// fakeMsg is a message delivered by the fake server to the first subscription
+type fakeMsg struct {
+	reply  string
+	header string
+	data   string
+}
+
+// startFakeServer starts a minimal NATS server that delivers msgs to the first subscription it receives.
+// It speaks just enough of the protocol for a client to connect, subscribe and reply.
+func startFakeServer(t *testing.T, msgs []fakeMsg) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\",\"version\":\"2.10.0\",\"proto\":1,\"headers\":true,\"max_payload\":1048576}\r\n")
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			switch strings.ToUpper(fields[0]) {
+			case "PING":
+				fmt.Fprint(conn, "PONG\r\n")
+			case "PUB", "HPUB":
+				// skip the payload of the replies
+				size, _ := strconv.Atoi(fields[len(fields)-1])
+				if _, err := r.Discard(size + 2); err != nil {
+					return
+				}
+			case "SUB":
+				subject, sid := fields[1], fields[len(fields)-1]
+				var buf bytes.Buffer
+				for _, msg := range msgs {
+					writeFakeMsg(&buf, subject, sid, msg)
+				}
+				if _, err := conn.Write(buf.Bytes()); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return "nats://" + ln.Addr().String()
+}
+
+func writeFakeMsg(buf *bytes.Buffer, subject, sid string, msg fakeMsg) {
+	reply := ""
+	if msg.reply != "" {
+		reply = " " + msg.reply
+	}
+	if msg.header == "" {
+		fmt.Fprintf(buf, "MSG %s %s%s %d\r\n%s\r\n", subject, sid, reply, len(msg.data), msg.data)
+		return
+	}
+	fmt.Fprintf(buf, "HMSG %s %s%s %d %d\r\n%s%s\r\n", subject, sid, reply, len(msg.header), len(msg.header)+len(msg.data), msg.header, msg.data)
+}
+
+func TestReceiveSnapshot(t *testing.T) {
+	cases := []struct {
+		name    string
+		msgs    []fakeMsg
+		want    string
+		wantErr string
+	}{
+		{
+			name: "ends with no content status",
+			msgs: []fakeMsg{
+				{reply: "ack.1", data: "first"},
+				{reply: "ack.2", data: "second"},
+				{header: "NATS/1.0 204\r\n\r\n"},
+			},
+			want: "firstsecond",
+		},
+		{
+			name: "ends with an empty message without status",
+			msgs: []fakeMsg{
+				{reply: "ack.1", data: "first"},
+				{},
+			},
+			want: "first",
+		},
+		{
+			name: "skips heartbeats and answers flow control",
+			msgs: []fakeMsg{
+				{header: "NATS/1.0 100 Idle Heartbeat\r\n\r\n"},
+				{reply: "ack.1", data: "first"},
+				{reply: "fc.1", header: "NATS/1.0 100 FlowControl Request\r\n\r\n"},
+				{reply: "ack.2", data: "second"},
+				{header: "NATS/1.0 204\r\n\r\n"},
+			},
+			want: "firstsecond",
+		},
+		{
+			name: "ignores the messages after the end",
+			msgs: []fakeMsg{
+				{data: "first"},
+				{header: "NATS/1.0 204\r\n\r\n"},
+				{data: "late"},
+			},
+			want: "first",
+		},
+		{
+			name: "fails on error status",
+			msgs: []fakeMsg{
+				{reply: "ack.1", data: "first"},
+				{header: "NATS/1.0 500 snapshot failed\r\n\r\n"},
+			},
+			want:    "first",
+			wantErr: "500 snapshot failed",
+		},
+		{
+			name: "fails on timeout status",
+			msgs: []fakeMsg{
+				{header: "NATS/1.0 408 Request Timeout\r\n\r\n"},
+			},
+			wantErr: "408 Request Timeout",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			nc, err := nats.Connect(startFakeServer(t, tc.msgs), nats.NoReconnect())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer nc.Close()
+			sub, err := nc.SubscribeSync("snapshot.test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			err = receiveSnapshot(context.Background(), subscriptionSource{sub}, "test", &buf)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+			}
+			if got := buf.String(); got != tc.want {
+				t.Errorf("expected data %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+// fakeSnapshotSource delivers the messages of a snapshot from a slice and records the replies sent to them
+type fakeSnapshotSource struct {
+	msgs       []*nats.Msg
+	replies    []string
+	respondErr error
+}
+
+func (s *fakeSnapshotSource) next(ctx context.Context) (*nats.Msg, error) {
+	if len(s.msgs) == 0 {
+		return nil, nats.ErrTimeout
+	}
+	msg := s.msgs[0]
+	s.msgs = s.msgs[1:]
+	return msg, nil
+}
+
+func (s *fakeSnapshotSource) respond(msg *nats.Msg) error {
+	if s.respondErr != nil {
+		return s.respondErr
+	}
+	s.replies = append(s.replies, msg.Reply)
+	return nil
+}
+
+func snapshotChunk(reply, data string) *nats.Msg {
+	return &nats.Msg{Reply: reply, Data: []byte(data)}
+}
+
+func snapshotStatus(reply, status, description string) *nats.Msg {
+	header := nats.Header{}
+	header.Set(statusHeader, status)
+	if description != "" {
+		header.Set(descriptionHeader, description)
+	}
+	return &nats.Msg{Reply: reply, Header: header}
+}
+
+func TestReceiveSnapshotFromSource(t *testing.T) {
+	respondErr := errors.New("connection closed")
+	cases := []struct {
+		name        string
+		msgs        []*nats.Msg
+		respondErr  error
+		wantData    string
+		wantReplies []string
+		wantLeft    int
+		wantErr     string
+	}{
+		{
+			name: "end of snapshot",
+			msgs: []*nats.Msg{
+				snapshotChunk("ack.1", "first"),
+				snapshotChunk("ack.2", "second"),
+				snapshotStatus("", statusNoContent, ""),
+				snapshotChunk("", "late"),
+			},
+			wantData:    "firstsecond",
+			wantReplies: []string{"ack.1", "ack.2"},
+			wantLeft:    1,
+		},
+		{
+			name: "end of snapshot without status",
+			msgs: []*nats.Msg{
+				snapshotChunk("ack.1", "first"),
+				{},
+			},
+			wantData:    "first",
+			wantReplies: []string{"ack.1"},
+		},
+		{
+			name: "flow control with a reply",
+			msgs: []*nats.Msg{
+				snapshotChunk("ack.1", "first"),
+				snapshotStatus("fc.1", statusControl, "FlowControl Request"),
+				snapshotChunk("ack.2", "second"),
+				snapshotStatus("", statusNoContent, ""),
+			},
+			wantData:    "firstsecond",
+			wantReplies: []string{"ack.1", "fc.1", "ack.2"},
+		},
+		{
+			name: "idle heartbeat without a reply",
+			msgs: []*nats.Msg{
+				snapshotStatus("", statusControl, "Idle Heartbeat"),
+				snapshotChunk("", "first"),
+				snapshotStatus("", statusNoContent, ""),
+			},
+			wantData: "first",
+		},
+		{
+			name: "error status",
+			msgs: []*nats.Msg{
+				snapshotChunk("ack.1", "first"),
+				snapshotStatus("", "500", "snapshot failed"),
+				snapshotChunk("ack.2", "second"),
+			},
+			wantData:    "first",
+			wantReplies: []string{"ack.1"},
+			wantLeft:    1,
+			wantErr:     "failed to receive snapshot of stream test: 500 snapshot failed",
+		},
+		{
+			name: "no responders status",
+			msgs: []*nats.Msg{
+				snapshotStatus("", "503", ""),
+			},
+			wantErr: "failed to receive snapshot of stream test: 503",
+		},
+		{
+			name: "no end of snapshot",
+			msgs: []*nats.Msg{
+				snapshotChunk("ack.1", "first"),
+			},
+			wantData:    "first",
+			wantReplies: []string{"ack.1"},
+			wantErr:     nats.ErrTimeout.Error(),
+		},
+		{
+			name: "failed acknowledgement",
+			msgs: []*nats.Msg{
+				snapshotChunk("ack.1", "first"),
+				snapshotChunk("ack.2", "second"),
+			},
+			respondErr: respondErr,
+			wantData:   "first",
+			wantLeft:   1,
+			wantErr:    respondErr.Error(),
+		},
+		{
+			name: "failed flow control reply",
+			msgs: []*nats.Msg{
+				snapshotStatus("fc.1", statusControl, "FlowControl Request"),
+				snapshotChunk("ack.1", "first"),
+			},
+			respondErr: respondErr,
+			wantLeft:   1,
+			wantErr:    respondErr.Error(),
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			src := &fakeSnapshotSource{msgs: tc.msgs, respondErr: tc.respondErr}
+			var buf bytes.Buffer
+			err := receiveSnapshot(context.Background(), src, "test", &buf)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+			}
+			if got := buf.String(); got != tc.wantData {
+				t.Errorf("expected data %q, got %q", tc.wantData, got)
+			}
+			if !reflect.DeepEqual(src.replies, tc.wantReplies) {
+				t.Errorf("expected replies %v, got %v", tc.wantReplies, src.replies)
+			}
+			if len(src.msgs) != tc.wantLeft {
+				t.Errorf("expected %d messages left unread, got %d", tc.wantLeft, len(src.msgs))
+			}
+		})
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	cases := []struct {
+		name     string
+		err      *apiError
+		target   error
+		expected bool
+	}{
+		{
+			name:     "stream not found",
+			err:      &apiError{Code: 404, ErrCode: 10059, Description: "stream not found"},
+			target:   jetstream.ErrStreamNotFound,
+			expected: true,
+		},
+		{
+			name:     "stream name in use",
+			err:      &apiError{Code: 400, ErrCode: 10058, Description: "stream name already in use"},
+			target:   jetstream.ErrStreamNameAlreadyInUse,
+			expected: true,
+		},
+		{
+			name:   "different error code",
+			err:    &apiError{Code: 400, ErrCode: 10058, Description: "stream name already in use"},
+			target: jetstream.ErrStreamNotFound,
+		},
+		{
+			name:   "no error code",
+			err:    &apiError{Code: 500, Description: "internal error"},
+			target: jetstream.ErrStreamNotFound,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := errors.Is(tc.err, tc.target); got != tc.expected {
+				t.Errorf("errors.Is(%v, %v) = %v, expected %v", tc.err, tc.target, got, tc.expected)
+			}
+			// the errors are returned wrapped with the name of the stream
+			wrapped := fmt.Errorf("failed to restore stream test: %w", tc.err)
+			if got := errors.Is(wrapped, tc.target); got != tc.expected {
+				t.Errorf("errors.Is(%v, %v) = %v, expected %v", wrapped, tc.target, got, tc.expected)
+			}
+			var aerr *jetstream.APIError
+			if !errors.As(tc.err, &aerr) || aerr.Code != tc.err.Code || int(aerr.ErrorCode) != tc.err.ErrCode {
+				t.Errorf("expected %v to map to an API error with the same codes, got %v", tc.err, aerr)
+			}
+		})
+	}
+}
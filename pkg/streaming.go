@@ -0,0 +1,271 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"github.com/nats-io/nats.go/jetstream"
+	shell "gomodules.xyz/go-sh"
+	"k8s.io/klog/v2"
+)
+
+// streamSnapshotFileName returns the name of the file that holds the snapshot of a stream in a restic snapshot
+func streamSnapshotFileName(stream string) string {
+	return stream + NATSStreamSnapshotSuffix
+}
+
+// newResticWrapperFromSession creates a restic wrapper that passes the connection parameters of the session to
+// the commands restic runs in a pipe.
+func (opt *natsOptions) newResticWrapperFromSession(session *sessionWrapper) (*restic.ResticWrapper, error) {
+	sh := shell.NewSession()
+	for k, v := range session.sh.Env {
+		sh.SetEnv(k, v)
+	}
+	return opt.newResticWrapperFromShell(sh)
+}
+
+// backupStreamsToRestic pipes the snapshot of every selected stream directly into restic.
+// Each stream is stored as a separate stdin file so that no copy of the stream is kept on the local disk.
+func (opt *natsOptions) backupStreamsToRestic(session *sessionWrapper, targetRef api_v1beta1.TargetRef) (*restic.BackupOutput, error) {
+	if opt.incremental || len(opt.kvBuckets) != 0 || len(opt.objectBuckets) != 0 {
+		return nil, fmt.Errorf("--stream-to-restic can not be used along with --incremental, --kv-buckets or --object-buckets")
+	}
+
+	streams := opt.streams
+	if len(streams) == 0 {
+		var err error
+		streams, err = session.listStreams()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(streams) == 0 {
+		return nil, fmt.Errorf("no stream found to backup")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	resticWrapper, err := opt.newResticWrapperFromSession(session)
+	if err != nil {
+		return nil, err
+	}
+
+	err = resticWrapper.EnsureNoExclusiveLock(opt.kubeClient, opt.namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	startTime := time.Now()
+	var (
+		backupOutput *restic.BackupOutput
+		infos        []*jetstream.StreamInfo
+	)
+	for _, stream := range streams {
+		klog.Infoln("Streaming snapshot of stream into the repository: ", stream)
+		backupOptions := opt.backupOptions
+		backupOptions.BackupPaths = nil
+		backupOptions.StdinFileName = streamSnapshotFileName(stream)
+		backupOptions.StdinPipeCommands = []restic.Command{
+			{
+				Name: executable,
+				Args: []any{"snapshot-stream", "--stream", stream},
+			},
+		}
+		var out *restic.BackupOutput
+		err := opt.processStream(stream, func(result *streamResult) error {
+			info, err := session.getStreamInfo(stream)
+			if err != nil {
+				return err
+			}
+			if out, err = resticWrapper.RunBackup(backupOptions, targetRef); err != nil {
+				return err
+			}
+			infos = append(infos, info)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to backup stream %s: %v", stream, err)
+		}
+		if out == nil {
+			// the stream has failed, but --continue-on-error is set
+			continue
+		}
+		if backupOutput == nil {
+			backupOutput = out
+			continue
+		}
+		// all the streams are backed up under the same host, so merge their snapshots into a single host stats
+		backupOutput.BackupTargetStatus.Stats[0].Snapshots = append(backupOutput.BackupTargetStatus.Stats[0].Snapshots, out.BackupTargetStatus.Stats[0].Snapshots...)
+	}
+	if backupOutput == nil {
+		return nil, opt.streamResults.failedStreamsError()
+	}
+	out, err := opt.writeStreamingManifest(session, resticWrapper, targetRef, infos, startTime)
+	if err != nil {
+		return nil, fmt.Errorf("failed to backup the manifest: %v", err)
+	}
+	backupOutput.BackupTargetStatus.Stats[0].Snapshots = append(backupOutput.BackupTargetStatus.Stats[0].Snapshots, out.BackupTargetStatus.Stats[0].Snapshots...)
+	backupOutput.BackupTargetStatus.Stats[0].Duration = time.Since(startTime).String()
+	return backupOutput, nil
+}
+
+// restoreStreamsFromRestic pipes the snapshot of every selected stream from restic dump directly into the server.
+// The streams must have been backed up with --stream-to-restic.
+func (opt *natsOptions) restoreStreamsFromRestic(session *sessionWrapper, targetRef api_v1beta1.TargetRef) (*restic.RestoreOutput, error) {
+	if len(opt.kvBuckets) != 0 || len(opt.objectBuckets) != 0 || opt.restoreUntilTime != "" || opt.restoreUntilSeq != 0 {
+		return nil, fmt.Errorf("--stream-from-restic can not be used along with --kv-buckets, --object-buckets, --restore-until-time or --restore-until-seq")
+	}
+	if !opt.globalStreamOverride.isEmpty() || len(opt.streamOverrides) != 0 {
+		return nil, fmt.Errorf("--stream-from-restic can not be used along with the stream configuration overrides")
+	}
+	if opt.consumerRestorePolicy != ConsumerRestorePolicyResume {
+		return nil, fmt.Errorf("--stream-from-restic restores the consumers as they are in the stream snapshots, so --consumer-restore-policy can not be changed")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	resticWrapper, err := opt.newResticWrapperFromSession(session)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := opt.findStreamSnapshots(resticWrapper)
+	if err != nil {
+		return nil, err
+	}
+	streams := make([]string, 0, len(snapshots))
+	for stream := range snapshots {
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+
+	if opt.overwrite {
+		if err := session.removeMatchedStreams(streams); err != nil {
+			return nil, err
+		}
+	}
+
+	startTime := time.Now()
+	for _, stream := range streams {
+		klog.Infoln("Streaming snapshot of stream from the repository: ", stream)
+		err := opt.processStream(stream, func(result *streamResult) error {
+			_, err := resticWrapper.DumpOnce(restic.DumpOptions{
+				Snapshot: snapshots[stream],
+				FileName: "/" + streamSnapshotFileName(stream),
+				StdoutPipeCommands: []restic.Command{
+					{
+						Name: executable,
+						Args: []any{"restore-snapshot", "--stream", stream},
+					},
+				},
+			})
+			if err != nil {
+				return err
+			}
+			if info, err := session.getStreamInfo(stream); err == nil {
+				result.Messages, result.Bytes = info.State.Msgs, info.State.Bytes
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore stream %s: %v", stream, err)
+		}
+	}
+
+	return &restic.RestoreOutput{
+		RestoreTargetStatus: api_v1beta1.RestoreMemberStatus{
+			Ref: targetRef,
+			Stats: []api_v1beta1.HostRestoreStats{
+				{
+					Hostname: opt.restoreOptions.Host,
+					Phase:    api_v1beta1.HostRestoreSucceeded,
+					Duration: time.Since(startTime).String(),
+				},
+			},
+		},
+	}, nil
+}
+
+// findStreamSnapshots maps the selected streams to the snapshots holding them.
+// It uses the snapshots given by the user, or the latest snapshot of each stream taken from the source host.
+func (opt *natsOptions) findStreamSnapshots(w *restic.ResticWrapper) (map[string]string, error) {
+	snapshots, err := w.ListSnapshots(opt.restoreOptions.Snapshots)
+	if err != nil {
+		return nil, err
+	}
+	host := opt.restoreOptions.SourceHost
+	if host == "" {
+		host = opt.restoreOptions.Host
+	}
+
+	latest := map[string]*restic.Snapshot{}
+	for i := range snapshots {
+		if len(opt.restoreOptions.Snapshots) == 0 && snapshots[i].Hostname != host {
+			continue
+		}
+		for _, p := range snapshots[i].Paths {
+			name := strings.TrimPrefix(p, "/")
+			if !strings.HasSuffix(name, NATSStreamSnapshotSuffix) {
+				continue
+			}
+			stream := strings.TrimSuffix(name, NATSStreamSnapshotSuffix)
+			if cur, ok := latest[stream]; !ok || snapshots[i].Time.After(cur.Time) {
+				latest[stream] = &snapshots[i]
+			}
+		}
+	}
+
+	if len(latest) == 0 {
+		return nil, fmt.Errorf("no stream snapshot found in the repository")
+	}
+	if opt.hasStreamPatterns() {
+		available := make([]string, 0, len(latest))
+		for stream := range latest {
+			available = append(available, stream)
+		}
+		sort.Strings(available)
+		if err := opt.resolveStreams(available); err != nil {
+			return nil, err
+		}
+	}
+
+	ids := make(map[string]string, len(latest))
+	for stream, snapshot := range latest {
+		if len(opt.streams) == 0 || slices.Contains(opt.streams, stream) {
+			ids[stream] = snapshot.ID
+		}
+	}
+	for _, stream := range opt.streams {
+		if _, ok := ids[stream]; !ok {
+			return nil, fmt.Errorf("no snapshot found for stream %q", stream)
+		}
+	}
+	return ids, nil
+}
@@ -20,13 +20,17 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"strings"
+	"syscall"
 	"time"
 
 	stash "stash.appscode.dev/apimachinery/client/clientset/versioned"
 	"stash.appscode.dev/apimachinery/pkg/restic"
 
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/spf13/cobra"
 	shell "gomodules.xyz/go-sh"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
@@ -41,138 +45,247 @@ import (
 const (
 	NATSUser        = "username"
 	NATSCreds       = "creds"
+	NATSJWT         = "jwt"
+	NATSContext     = "context"
 	NATSPassword    = "password"
 	NATSToken       = "token"
 	NATSNkey        = "nkey"
-	NATSCMD         = "nats"
 	NATSCert        = "tls.crt"
 	NATSKey         = "tls.key"
 	NATSStreamsFile = "streams.json"
 	NATSCredsFile   = "user.creds"
 	NATSCACertFile  = "ca.crt"
 	NATSNkeyFile    = "user.nk"
+	NATSJWTFile     = "user.jwt"
 	NATSCertFile    = "tls.crt"
 	NATSKeyFile     = "tls.key"
 	EnvNATSUrl      = "NATS_URL"
 	EnvNATSUser     = "NATS_USER"
 	EnvNATSPassword = "NATS_PASSWORD"
+	EnvNATSToken    = "NATS_TOKEN"
+	EnvNATSJWT      = "NATS_JWT"
 	EnvNATSCreds    = "NATS_CREDS"
 	EnvNATSCA       = "NATS_CA"
 	EnvNATSNkey     = "NATS_NKEY"
 	EnvNATSCert     = "NATS_CERT"
 	EnvNATSKey      = "NATS_KEY"
+
+	EnvNATSTLSServerName = "NATS_TLS_SERVER_NAME"
+
+	NATSKVFile   = "kv.json"
+	NATSKVDir    = "kv"
+	NATSKVPrefix = "KV_"
+
+	NATSObjectBucketsFile  = "object_buckets.json"
+	NATSObjectDir          = "objects"
+	NATSObjectPrefix       = "OBJ_"
+	NATSObjectMetaSuffix   = ".meta.json"
+	NATSObjectDigestPrefix = "SHA-256="
+
+	NATSSnapshotMetaFile = "backup.json"
+	NATSSnapshotDataFile = "stream.tar.s2"
+	// NATSSnapshotBlocksDir holds the unpacked snapshot data in the blocks layout
+	NATSSnapshotBlocksDir = "blocks"
+	NATSConsumersFile     = "consumers.json"
+	NATSManifestFile      = "manifest.json"
+	NATSBackupStateFile   = "backup_state.json"
+	NATSIncrementalDir    = "incremental"
+
+	NATSStreamSnapshotSuffix = ".snapshot"
+
+	// NATSCredentialsDirPattern is the name pattern of the directory holding the credential files of a run
+	NATSCredentialsDirPattern = "nats-credentials-*"
+
+	NATSAccountsDir      = "accounts"
+	NATSAccountCredsFile = "account-%s.creds"
+
+	// cleanupTimeout bounds the clean up done after the run has been cancelled
+	cleanupTimeout = 30 * time.Second
 )
 
 type natsOptions struct {
+	// ctx is the context of the whole run. It is cancelled when the process is asked to terminate.
+	ctx context.Context
+
 	kubeClient    kubernetes.Interface
 	stashClient   stash.Interface
 	catalogClient appcatalog_cs.Interface
 
-	namespace           string
-	backupSessionName   string
-	interimDataDir      string
-	streams             []string
-	overwrite           bool
-	appBindingName      string
-	appBindingNamespace string
-	natsArgs            string
-	waitTimeout         int32
-	warningThreshold    string
-	outputDir           string
-	storageSecret       kmapi.ObjectReference
-	setupOptions        restic.SetupOptions
-	backupOptions       restic.BackupOptions
-	restoreOptions      restic.RestoreOptions
-	config              *restclient.Config
+	namespace         string
+	backupSessionName string
+	interimDataDir    string
+	streams           []string
+	includeStreams    []string
+	excludeStreams    []string
+	// resolvedStreams holds the streams selected by includeStreams and excludeStreams
+	resolvedStreams       []string
+	kvBuckets             []string
+	objectBuckets         []string
+	overwrite             bool
+	incremental           bool
+	maxIncrementalChain   int
+	maxConcurrency        int
+	restoreUntilTime      string
+	restoreUntilSeq       uint64
+	streamToRestic        bool
+	streamFromRestic      bool
+	consumerRestorePolicy string
+	dryRun                bool
+	continueOnError       bool
+	// streamResults collects the outcome of every processed stream. It is shared by the options of all the accounts.
+	streamResults *streamResults
+	// account is the account whose streams are processed in a multi-account backup or restore
+	account     string
+	restorePlan []streamRestorePlan
+	// globalStreamOverride is applied to every restored stream, streamOverrides to the individual streams
+	globalStreamOverride streamOverride
+	streamOverridesFile  string
+	streamOverrides      map[string]streamOverride
+	accountsSecret       string
+	accounts             []string
+	appBindingName       string
+	appBindingNamespace  string
+	natsArgs             string
+	waitTimeout          int32
+	warningThreshold     string
+	outputDir            string
+	storageSecret        kmapi.ObjectReference
+	setupOptions         restic.SetupOptions
+	backupOptions        restic.BackupOptions
+	restoreOptions       restic.RestoreOptions
+	config               *restclient.Config
+	// credentialsDir holds the credential files written for the run. It is only accessible by the owner
+	// and it is removed when the run ends.
+	credentialsDir string
+	// encryption encrypts the archives stored in the interim data dir. It is nil when --encryption-secret-name is not set.
+	encryption       *archiveEncryption
+	encryptionSecret kmapi.ObjectReference
+	encryptionKeyID  string
+	snapshotLayout   string
+	// invokerKind and invokerName identify the RestoreSession or RestoreBatch whose hooks are executed around the restore
+	invokerKind  string
+	invokerName  string
+	hookTimeout  time.Duration
+	restoreHooks *restoreHooks
+	// pushgatewayURL is the endpoint the metrics of the run are pushed to at the end of the run
+	pushgatewayURL string
+	metricsJob     string
+	// the TLS and authentication settings of the Pushgateway
+	pushgatewayCAFile             string
+	pushgatewayCertFile           string
+	pushgatewayKeyFile            string
+	pushgatewayInsecureSkipVerify bool
+	pushgatewayUsername           string
+	pushgatewayPasswordFile       string
+	pushgatewayBearerTokenFile    string
+	// events reports the progress of the run on the app binding and the session. It is nil until the app binding has been read.
+	events *runEvents
+	// chainRestored is set when the verified snapshot has been restored along with the snapshots of its incremental chain
+	chainRestored bool
 }
 
+// sessionWrapper holds the connection to the NATS server.
+// The connection parameters are kept as environment variables of sh, so that the
+// helper commands run by restic can connect to the same server.
 type sessionWrapper struct {
+	ctx context.Context
 	sh  *shell.Session
-	cmd *restic.Command
+	nc  *nats.Conn
+	js  jetstream.JetStream
 }
 
-func (opt *natsOptions) newSessionWrapper(cmd string) *sessionWrapper {
+func (opt *natsOptions) newSessionWrapper() *sessionWrapper {
 	return &sessionWrapper{
-		sh: shell.NewSession(),
-		cmd: &restic.Command{
-			Name: cmd,
-		},
+		ctx: opt.ctx,
+		sh:  shell.NewSession(),
 	}
 }
 
-func (opt *natsOptions) setNATSCredentials(sh *shell.Session, appBinding *appcatalog.AppBinding) error {
-	// if credential secret is not provided in AppBinding, then nothing to do.
-	if appBinding.Spec.Secret == nil {
-		return nil
+// newRunContext returns the context of a command run. It is cancelled on SIGINT or SIGTERM,
+// i.e. when Kubernetes terminates the pod.
+func newRunContext(cmd *cobra.Command) (context.Context, context.CancelFunc) {
+	ctx := cmd.Context()
+	if ctx == nil {
+		ctx = context.Background()
 	}
+	return signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+}
+
+// newResticWrapper creates a restic wrapper whose commands are terminated when the run is cancelled
+func (opt *natsOptions) newResticWrapper() (*restic.ResticWrapper, error) {
+	return opt.newResticWrapperFromShell(shell.NewSession())
+}
 
-	appBindingSecret, err := opt.kubeClient.CoreV1().Secrets(appBinding.Namespace).Get(context.TODO(), appBinding.Spec.Secret.Name, metav1.GetOptions{})
+// newResticWrapperFromShell creates a restic wrapper running its commands in sh.
+// The commands are terminated as soon as the run is cancelled, so that no restic process outlives it.
+func (opt *natsOptions) newResticWrapperFromShell(sh *shell.Session) (*restic.ResticWrapper, error) {
+	w, err := restic.NewResticWrapperFromShell(opt.setupOptions, sh)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	context.AfterFunc(opt.ctx, func() {
+		sh.Kill(syscall.SIGTERM)
+	})
+	return w, nil
+}
 
-	err = appBinding.TransformSecret(opt.kubeClient, appBindingSecret.Data)
-	if err != nil {
+func (opt *natsOptions) setNATSCredentials(sh *shell.Session, appBinding *appcatalog.AppBinding) error {
+	credentials, err := opt.getNATSCredentials(appBinding)
+	if err != nil || credentials == nil {
 		return err
 	}
+	return credentials.apply(sh, opt.credentialsDir)
+}
 
-	// Token authentication
-	if token, ok := appBindingSecret.Data[NATSToken]; ok {
-		sh.SetEnv(EnvNATSUser, string(token))
+// setNATSClientCertificate sets only the TLS client certificate of the app binding, leaving its authentication
+// settings out. It is used when the connection authenticates with other credentials, i.e. the ones of an account.
+func (opt *natsOptions) setNATSClientCertificate(sh *shell.Session, appBinding *appcatalog.AppBinding) error {
+	credentials, err := opt.getNATSCredentials(appBinding)
+	if err != nil || credentials == nil {
+		return err
 	}
+	return credentials.clientCertificate().apply(sh, opt.credentialsDir)
+}
 
-	// Basic authentication
-	user, userExist := appBindingSecret.Data[NATSUser]
-	password, passwordExist := appBindingSecret.Data[NATSPassword]
-
-	if userExist && passwordExist {
-		sh.SetEnv(EnvNATSUser, string(user))
-		sh.SetEnv(EnvNATSPassword, string(password))
+// getNATSCredentials reads the credentials from the secret of the app binding. It returns nil if there is no secret.
+func (opt *natsOptions) getNATSCredentials(appBinding *appcatalog.AppBinding) (*natsCredentials, error) {
+	// if credential secret is not provided in AppBinding, then nothing to do.
+	if appBinding.Spec.Secret == nil {
+		return nil, nil
 	}
 
-	// Nkey Authentication
-	if nkey, ok := appBindingSecret.Data[NATSNkey]; ok {
-		if err := os.WriteFile(filepath.Join(opt.setupOptions.ScratchDir, NATSNkeyFile), nkey, os.ModePerm); err != nil {
-			return err
-		}
-		sh.SetEnv(EnvNATSNkey, filepath.Join(opt.setupOptions.ScratchDir, NATSNkeyFile))
+	appBindingSecret, err := opt.kubeClient.CoreV1().Secrets(appBinding.Namespace).Get(opt.ctx, appBinding.Spec.Secret.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
 	}
 
-	// TLS Authentication
-	cert, certExist := appBindingSecret.Data[NATSCert]
-	key, keyExist := appBindingSecret.Data[NATSKey]
-
-	if certExist && keyExist {
-		if err := os.WriteFile(filepath.Join(opt.setupOptions.ScratchDir, NATSCertFile), cert, os.ModePerm); err != nil {
-			return err
-		}
-		sh.SetEnv(EnvNATSCert, filepath.Join(opt.setupOptions.ScratchDir, NATSCertFile))
-		if err := os.WriteFile(filepath.Join(opt.setupOptions.ScratchDir, NATSKeyFile), key, os.ModePerm); err != nil {
-			return err
-		}
-		sh.SetEnv(EnvNATSKey, filepath.Join(opt.setupOptions.ScratchDir, NATSKeyFile))
+	err = appBinding.TransformSecret(opt.kubeClient, appBindingSecret.Data)
+	if err != nil {
+		return nil, err
 	}
 
-	// JWT Authentication
-	if creds, ok := appBindingSecret.Data[NATSCreds]; ok {
-		if err := os.WriteFile(filepath.Join(opt.setupOptions.ScratchDir, NATSCredsFile), creds, os.ModePerm); err != nil {
-			return err
-		}
-		sh.SetEnv(EnvNATSCreds, filepath.Join(opt.setupOptions.ScratchDir, NATSCredsFile))
+	credentials, err := resolveNATSCredentials(appBindingSecret.Data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials in secret %s/%s: %w", appBinding.Namespace, appBinding.Spec.Secret.Name, err)
 	}
-	return nil
+	return credentials, nil
 }
 
-func (session *sessionWrapper) setTLSParameters(appBinding *appcatalog.AppBinding, scratchDir string) error {
+// setTLSParameters sets the CA bundle and the server name of the app binding.
+// They take precedence over the ones of a nats context file.
+func (session *sessionWrapper) setTLSParameters(appBinding *appcatalog.AppBinding, dir string) error {
+	if appBinding.Spec.ClientConfig.ServerName != "" {
+		session.sh.SetEnv(EnvNATSTLSServerName, appBinding.Spec.ClientConfig.ServerName)
+	}
 	if appBinding.Spec.ClientConfig.CABundle == nil {
 		return nil
 	}
 
-	if err := os.WriteFile(filepath.Join(scratchDir, NATSCACertFile), appBinding.Spec.ClientConfig.CABundle, os.ModePerm); err != nil {
+	if err := writeCredentialFile(filepath.Join(dir, NATSCACertFile), appBinding.Spec.ClientConfig.CABundle); err != nil {
 		return err
 	}
 
-	session.sh.SetEnv(EnvNATSCA, filepath.Join(scratchDir, NATSCACertFile))
+	session.sh.SetEnv(EnvNATSCA, filepath.Join(dir, NATSCACertFile))
 	return nil
 }
 
@@ -185,10 +298,86 @@ func (session *sessionWrapper) setNATSConnectionParameters(appBinding *appcatalo
 	return nil
 }
 
-func (session *sessionWrapper) setUserArgs(args string) {
-	for _, arg := range strings.Fields(args) {
-		session.cmd.Args = append(session.cmd.Args, arg)
+func (session *sessionWrapper) getStreamInfo(stream string) (*jetstream.StreamInfo, error) {
+	s, err := session.js.Stream(session.ctx, stream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stream %s: %w", stream, err)
+	}
+	return s.CachedInfo(), nil
+}
+
+func (session *sessionWrapper) listStreams() ([]string, error) {
+	lister := session.js.StreamNames(session.ctx)
+	var streams []string
+	for name := range lister.Name() {
+		streams = append(streams, name)
+	}
+	if err := lister.Err(); err != nil {
+		return nil, err
+	}
+	return streams, nil
+}
+
+// createCredentialsDir creates a directory for the credential files of the run inside the scratch dir.
+// The directory is only accessible by the owner, so the credentials are not exposed on a shared scratch volume.
+func (opt *natsOptions) createCredentialsDir() error {
+	if err := os.MkdirAll(opt.setupOptions.ScratchDir, os.ModePerm); err != nil {
+		return err
+	}
+	// os.MkdirTemp creates the directory with 0700 permission
+	dir, err := os.MkdirTemp(opt.setupOptions.ScratchDir, NATSCredentialsDirPattern)
+	if err != nil {
+		return fmt.Errorf("failed to create credentials directory: %w", err)
+	}
+	opt.credentialsDir = dir
+	return nil
+}
+
+// removeCredentialsDir removes the credential files of the run. It is safe to call it more than once.
+func (opt *natsOptions) removeCredentialsDir() {
+	if opt.credentialsDir == "" {
+		return
+	}
+	if err := os.RemoveAll(opt.credentialsDir); err != nil {
+		klog.Errorf("Failed to remove credentials directory %s. Reason: %v", opt.credentialsDir, err)
+		return
+	}
+	opt.credentialsDir = ""
+}
+
+// withCredentialsDir runs fn with a directory for the credential files of the run.
+// The credential files must not outlive the run, so the directory is removed once fn returns,
+// whether it succeeds, fails, panics or the run gets cancelled.
+func (opt *natsOptions) withCredentialsDir(fn func() error) error {
+	if err := opt.createCredentialsDir(); err != nil {
+		return err
+	}
+	defer opt.removeCredentialsDir()
+	return fn()
+}
+
+// connectAppBinding opens a session to the server of the app binding once it is ready to accept connections.
+// The credential files are written into the credentials directory of the run.
+func (opt *natsOptions) connectAppBinding(appBinding *appcatalog.AppBinding) (*sessionWrapper, error) {
+	session := opt.newSessionWrapper()
+	if err := opt.setNATSCredentials(session.sh, appBinding); err != nil {
+		return nil, err
+	}
+	if err := session.setNATSConnectionParameters(appBinding); err != nil {
+		return nil, err
 	}
+	if err := session.setTLSParameters(appBinding, opt.credentialsDir); err != nil {
+		return nil, err
+	}
+	if err := session.waitForNATSReady(opt.warningThreshold, opt.waitDuration()); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// writeCredentialFile writes credential material that only the owner can read
+func writeCredentialFile(file string, data []byte) error {
+	return os.WriteFile(file, data, 0o600)
 }
 
 func clearDir(dir string) error {
@@ -198,23 +387,44 @@ func clearDir(dir string) error {
 	return os.MkdirAll(dir, os.ModePerm)
 }
 
-func (session sessionWrapper) waitForNATSReady(warningThreshold string) error {
+// waitForNATSReady connects to the server once it is ready to accept connections. It gives up after timeout.
+func (session *sessionWrapper) waitForNATSReady(warningThreshold string, timeout time.Duration) error {
 	klog.Infoln("Waiting for the nats server to be ready...")
 
-	args := []any{
-		"server",
-		"check",
-		"connection",
-		"--connect-warn", warningThreshold,
+	threshold, err := time.ParseDuration(warningThreshold)
+	if err != nil {
+		return fmt.Errorf("invalid warning threshold %q. Reason: %v", warningThreshold, err)
 	}
 
-	args = append(session.cmd.Args, args...)
-
-	return wait.PollUntilContextTimeout(context.Background(), time.Second*5, time.Minute*5, true, func(ctx context.Context) (bool, error) {
-		err := session.sh.Command(NATSCMD, args...).Run()
+	return wait.PollUntilContextTimeout(session.ctx, time.Second*5, timeout, true, func(ctx context.Context) (bool, error) {
+		start := time.Now()
+		nc, err := connect(func(key string) string {
+			return session.sh.Env[key]
+		})
 		if err != nil {
+			klog.Infoln("NATS server is not ready yet. Reason: ", err)
 			return false, nil
 		}
+		if d := time.Since(start); d > threshold {
+			klog.Warningf("Connecting to the NATS server took %s which is longer than %s", d, threshold)
+		}
+		js, err := jetstream.New(nc)
+		if err != nil {
+			nc.Close()
+			return false, err
+		}
+		session.nc, session.js = nc, js
 		return true, nil
 	})
 }
+
+// waitDuration returns --wait-timeout as a duration
+func (opt *natsOptions) waitDuration() time.Duration {
+	return time.Duration(opt.waitTimeout) * time.Second
+}
+
+func (session *sessionWrapper) close() {
+	if session.nc != nil {
+		session.nc.Close()
+	}
+}
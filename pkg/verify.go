@@ -0,0 +1,612 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/spf13/cobra"
+	license "go.bytebuilders.dev/license-verifier/kubernetes"
+	"gomodules.xyz/flags"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+	appcatalog "kmodules.xyz/custom-resources/apis/appcatalog/v1alpha1"
+	v1 "kmodules.xyz/offshoot-api/api/v1"
+)
+
+func NewCmdVerify() *cobra.Command {
+	var (
+		masterURL      string
+		kubeconfigPath string
+		opt            = natsOptions{
+			setupOptions: restic.SetupOptions{
+				ScratchDir:  restic.DefaultScratchDir,
+				EnableCache: false,
+			},
+			streamResults: &streamResults{},
+			restoreOptions: restic.RestoreOptions{
+				Host: restic.DefaultHost,
+			},
+		}
+	)
+
+	cmd := &cobra.Command{
+		Use:               "verify-nats",
+		Short:             "Verifies that a NATS backup can be restored without connecting to NATS",
+		DisableAutoGenTag: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags.EnsureRequiredFlags(cmd, "provider", "storage-secret-name", "storage-secret-namespace", "interim-data-dir")
+
+			// cancelled when the pod is terminated, so that a partial run still reports its failure
+			ctx, cancel := newRunContext(cmd)
+			defer cancel()
+			opt.ctx = ctx
+
+			// prepare client
+			config, err := clientcmd.BuildConfigFromFlags(masterURL, kubeconfigPath)
+			if err != nil {
+				return err
+			}
+			opt.config = config
+
+			opt.kubeClient, err = kubernetes.NewForConfig(config)
+			if err != nil {
+				return err
+			}
+
+			targetRef := api_v1beta1.TargetRef{
+				APIVersion: appcatalog.SchemeGroupVersion.String(),
+				Kind:       appcatalog.ResourceKindApp,
+				Name:       opt.appBindingName,
+				Namespace:  opt.appBindingNamespace,
+			}
+			var verifyOutput *restic.RestoreOutput
+			verifyOutput, err = opt.verifyNATS(targetRef)
+			if err != nil {
+				verifyOutput = &restic.RestoreOutput{
+					RestoreTargetStatus: api_v1beta1.RestoreMemberStatus{
+						Ref: targetRef,
+						Stats: []api_v1beta1.HostRestoreStats{
+							{
+								Hostname: opt.restoreOptions.Host,
+								Phase:    api_v1beta1.HostRestoreFailed,
+								Error:    err.Error(),
+							},
+						},
+					},
+				}
+			}
+			if err != nil {
+				klog.Errorf("Verification of the backup has failed. Reason: %v", err)
+			}
+			// If output directory specified, then write the output in "output.json" file in the specified directory
+			if opt.outputDir != "" {
+				return opt.writeOutput(natsRestoreOutput{
+					RestoreOutput: *verifyOutput,
+					Phase:         opt.streamResults.overallPhase(err),
+					Streams:       opt.resolvedStreams,
+					StreamResults: opt.streamResults.list(),
+				})
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&masterURL, "master", masterURL, "The address of the Kubernetes API server (overrides any value in kubeconfig)")
+	cmd.Flags().StringVar(&kubeconfigPath, "kubeconfig", kubeconfigPath, "Path to kubeconfig file with authorization information (the master location is set by the master flag).")
+	cmd.Flags().StringVar(&opt.namespace, "namespace", "default", "Namespace of Backup/Restore Session")
+	cmd.Flags().StringVar(&opt.appBindingName, "appbinding", opt.appBindingName, "Name of the app binding the backup has been taken from. It is only used to fill the output")
+	cmd.Flags().StringVar(&opt.appBindingNamespace, "appbinding-namespace", opt.appBindingNamespace, "Namespace of the app binding")
+	cmd.Flags().StringVar(&opt.storageSecret.Name, "storage-secret-name", opt.storageSecret.Name, "Name of the storage secret")
+	cmd.Flags().StringVar(&opt.storageSecret.Namespace, "storage-secret-namespace", opt.storageSecret.Namespace, "Namespace of the storage secret")
+	cmd.Flags().StringVar(&opt.encryptionSecret.Name, "encryption-secret-name", opt.encryptionSecret.Name, "Name of the secret holding the keys the stream archives have been encrypted with. The key recorded in each archive is used to decrypt it")
+	cmd.Flags().StringVar(&opt.encryptionSecret.Namespace, "encryption-secret-namespace", opt.encryptionSecret.Namespace, "Namespace of the encryption secret")
+
+	cmd.Flags().StringVar(&opt.setupOptions.Provider, "provider", opt.setupOptions.Provider, "Backend provider (i.e. gcs, s3, azure etc)")
+	cmd.Flags().StringVar(&opt.setupOptions.Bucket, "bucket", opt.setupOptions.Bucket, "Name of the cloud bucket/container (keep empty for local backend)")
+	cmd.Flags().StringVar(&opt.setupOptions.Endpoint, "endpoint", opt.setupOptions.Endpoint, "Endpoint for s3/s3 compatible backend or REST backend URL")
+	cmd.Flags().BoolVar(&opt.setupOptions.InsecureTLS, "insecure-tls", opt.setupOptions.InsecureTLS, "InsecureTLS for TLS secure s3/s3 compatible backend")
+	cmd.Flags().StringVar(&opt.setupOptions.Region, "region", opt.setupOptions.Region, "Region for s3/s3 compatible backend")
+	cmd.Flags().StringVar(&opt.setupOptions.Path, "path", opt.setupOptions.Path, "Directory inside the bucket where backup will be stored")
+	cmd.Flags().StringVar(&opt.setupOptions.ScratchDir, "scratch-dir", opt.setupOptions.ScratchDir, "Temporary directory")
+	cmd.Flags().BoolVar(&opt.setupOptions.EnableCache, "enable-cache", opt.setupOptions.EnableCache, "Specify whether to enable caching for restic")
+	cmd.Flags().Int64Var(&opt.setupOptions.MaxConnections, "max-connections", opt.setupOptions.MaxConnections, "Specify maximum concurrent connections for GCS, Azure and B2 backend")
+
+	cmd.Flags().StringVar(&opt.restoreOptions.Host, "hostname", opt.restoreOptions.Host, "Name of the host machine")
+	cmd.Flags().StringVar(&opt.restoreOptions.SourceHost, "source-hostname", opt.restoreOptions.SourceHost, "Name of the host from where the backup has been taken")
+	cmd.Flags().StringSliceVar(&opt.restoreOptions.Snapshots, "snapshot", opt.restoreOptions.Snapshots, "Snapshot to verify. Keep empty to verify the latest snapshot. The snapshots taken with --stream-to-restic are not supported")
+
+	cmd.Flags().StringVar(&opt.interimDataDir, "interim-data-dir", opt.interimDataDir, "Scratch directory where the snapshot is restored for verification. It must be the interim data dir the backup has been taken from")
+	cmd.Flags().StringVar(&opt.outputDir, "output-dir", opt.outputDir, "Directory where output.json file will be written (keep empty if you don't need to write output in file)")
+	return cmd
+}
+
+func (opt *natsOptions) verifyNATS(targetRef api_v1beta1.TargetRef) (*restic.RestoreOutput, error) {
+	var err error
+	err = license.CheckLicenseEndpoint(opt.config, licenseApiService, SupportedProducts)
+	if err != nil {
+		return nil, err
+	}
+
+	opt.setupOptions.StorageSecret, err = opt.kubeClient.CoreV1().Secrets(opt.storageSecret.Namespace).Get(opt.ctx, opt.storageSecret.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := opt.loadEncryption(); err != nil {
+		return nil, err
+	}
+
+	// apply nice, ionice settings from env
+	opt.setupOptions.Nice, err = v1.NiceSettingsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	opt.setupOptions.IONice, err = v1.IONiceSettingsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	klog.Infoln("Cleaning up temporary data directory: ", opt.interimDataDir)
+	if err := clearDir(opt.interimDataDir); err != nil {
+		return nil, err
+	}
+
+	opt.restoreOptions.RestorePaths = []string{opt.interimDataDir}
+	resticWrapper, err := opt.newResticWrapper()
+	if err != nil {
+		return nil, err
+	}
+	if err := opt.checkVerifiable(resticWrapper); err != nil {
+		return nil, err
+	}
+	// an incremental backup has to be verified along with the snapshots it has been taken on top of
+	chain, err := opt.resolveSnapshotChain(resticWrapper)
+	if err != nil {
+		return nil, err
+	}
+	if len(chain) != 0 {
+		opt.restoreOptions.Snapshots = chain
+	}
+	// the snapshots of a chain are restored on top of each other, so the interim data dir may hold
+	// the data of the streams that are no longer part of the verified snapshot
+	opt.chainRestored = len(opt.restoreOptions.Snapshots) > 1
+
+	startTime := time.Now()
+	if opt.chainRestored {
+		_, err = opt.restoreSnapshotChain(resticWrapper, opt.restoreOptions.Snapshots, targetRef)
+	} else {
+		_, err = resticWrapper.RunRestore(opt.restoreOptions, targetRef)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := opt.verifyInterimData(); err != nil {
+		return nil, err
+	}
+	return &restic.RestoreOutput{
+		RestoreTargetStatus: api_v1beta1.RestoreMemberStatus{
+			Ref: targetRef,
+			Stats: []api_v1beta1.HostRestoreStats{
+				{
+					Hostname: opt.restoreOptions.Host,
+					Phase:    api_v1beta1.HostRestoreSucceeded,
+					Duration: time.Since(startTime).String(),
+				},
+			},
+		},
+	}, nil
+}
+
+// checkVerifiable makes sure that the snapshots to verify hold the interim data dir. The backups taken with
+// --stream-to-restic store every stream as a file of its own instead, so they can not be verified.
+func (opt *natsOptions) checkVerifiable(w *restic.ResticWrapper) error {
+	if len(opt.restoreOptions.Snapshots) != 0 {
+		snapshots, err := w.ListSnapshots(opt.restoreOptions.Snapshots)
+		if err != nil {
+			return err
+		}
+		return unverifiableSnapshots(snapshots, opt.interimDataDir)
+	}
+
+	host := opt.restoreOptions.SourceHost
+	if host == "" {
+		host = opt.restoreOptions.Host
+	}
+	latest, err := opt.latestSnapshot(w, host)
+	if err != nil {
+		return err
+	}
+	if latest == nil {
+		return fmt.Errorf("no snapshot of %s has been taken from host %s. The backups taken with --stream-to-restic are not supported by verify-nats", opt.interimDataDir, host)
+	}
+	return nil
+}
+
+// unverifiableSnapshots returns an error naming the snapshots that do not hold the interim data dir
+func unverifiableSnapshots(snapshots []restic.Snapshot, interimDataDir string) error {
+	var ids []string
+	for i := range snapshots {
+		if !slices.Contains(snapshots[i].Paths, interimDataDir) {
+			ids = append(ids, snapshots[i].ID)
+		}
+	}
+	if len(ids) != 0 {
+		return fmt.Errorf("snapshots %s do not hold %s, as they have been taken with --stream-to-restic, which verify-nats does not support. Restore them with --stream-from-restic to check them",
+			strings.Join(ids, ", "), interimDataDir)
+	}
+	return nil
+}
+
+// verifyInterimData verifies the data of the snapshot restored into the interim data dir,
+// including the data of every account of a multi-account backup
+func (opt *natsOptions) verifyInterimData() error {
+	roots := map[string]string{"": opt.interimDataDir}
+	if entries, err := os.ReadDir(filepath.Join(opt.interimDataDir, NATSAccountsDir)); err == nil {
+		for _, entry := range entries {
+			if entry.IsDir() {
+				roots[entry.Name()+"/"] = filepath.Join(opt.interimDataDir, NATSAccountsDir, entry.Name())
+			}
+		}
+	}
+
+	var errs []error
+	for prefix, root := range roots {
+		if prefix == "" && len(roots) > 1 {
+			if _, err := os.Stat(filepath.Join(root, NATSStreamsFile)); errors.Is(err, os.ErrNotExist) {
+				// the streams of a multi-account backup are stored under the account directories only
+				continue
+			}
+		}
+		manifest, err := readManifest(root)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s%s: %w", prefix, NATSManifestFile, err))
+			continue
+		}
+		streams, err := verifyStreamList(root, manifest, opt.chainRestored)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s%s: %w", prefix, NATSStreamsFile, err))
+			continue
+		}
+		state, err := readBackupStateFrom(root)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s%s: %w", prefix, NATSBackupStateFile, err))
+			continue
+		}
+		for _, stream := range streams {
+			result := streamResult{
+				Stream:  stream,
+				Account: strings.TrimSuffix(prefix, "/"),
+				Phase:   StreamPhaseSucceeded,
+			}
+			if err := verifyStreamSnapshot(root, stream, manifest, state.find(stream), opt.encryption); err != nil {
+				klog.Errorf("Stream %s%s failed verification. Reason: %v", prefix, stream, err)
+				errs = append(errs, fmt.Errorf("stream %s%s: %w", prefix, stream, err))
+				result.Phase, result.Error = StreamPhaseFailed, err.Error()
+			} else {
+				klog.Infof("Stream %s%s verified", prefix, stream)
+				opt.resolvedStreams = append(opt.resolvedStreams, prefix+stream)
+			}
+			if opt.streamResults != nil {
+				opt.streamResults.add(result)
+			}
+		}
+		if err := verifyKVBuckets(root, manifest, opt.encryption); err != nil {
+			errs = append(errs, fmt.Errorf("%s%s: %w", prefix, NATSKVFile, err))
+		}
+		if err := verifyObjectBuckets(root, manifest); err != nil {
+			errs = append(errs, fmt.Errorf("%s%s: %w", prefix, NATSObjectBucketsFile, err))
+		}
+	}
+	sort.Strings(opt.resolvedStreams)
+	return utilerrors.NewAggregate(errs)
+}
+
+// verifyStreamList checks that streams.json lists exactly the streams of the backup. The list is compared with
+// the manifest when there is one. Otherwise it is compared with the stream directories found in root, unless
+// the data of a snapshot chain has been restored, as the older snapshots may hold streams deleted since then.
+func verifyStreamList(root string, manifest *backupManifest, chained bool) ([]string, error) {
+	byteStreams, err := os.ReadFile(filepath.Join(root, NATSStreamsFile))
+	if err != nil {
+		return nil, err
+	}
+	var streams []string
+	if err := json.Unmarshal(byteStreams, &streams); err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	switch {
+	case manifest != nil:
+		for _, m := range manifest.Streams {
+			if !streamExists(m.Name, streams) {
+				errs = append(errs, fmt.Errorf("stream %s of the manifest is not listed", m.Name))
+			}
+		}
+	case !chained:
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(root, entry.Name(), NATSSnapshotMetaFile)); err != nil {
+				continue
+			}
+			if !streamExists(entry.Name(), streams) {
+				errs = append(errs, fmt.Errorf("stream directory %s is not listed", entry.Name()))
+			}
+		}
+	}
+	for _, stream := range streams {
+		if _, err := os.Stat(filepath.Join(root, stream)); err != nil {
+			errs = append(errs, fmt.Errorf("listed stream %s has no data", stream))
+		}
+	}
+	return streams, utilerrors.NewAggregate(errs)
+}
+
+// verifyStreamSnapshot decodes the whole snapshot of a stream and compares the stored messages with the stream
+// state recorded at backup time. The files and the message counts are checked against the manifest, if there is one.
+// The messages of the increments of an incrementally backed up stream are counted along with the ones of the snapshot.
+// An encrypted snapshot is only checked against the manifest when no encryption key is provided.
+func verifyStreamSnapshot(root, stream string, manifest *backupManifest, state *streamBackupState, encryption *archiveEncryption) error {
+	var entry *streamManifest
+	if manifest != nil {
+		i := slices.IndexFunc(manifest.Streams, func(m streamManifest) bool {
+			return m.Name == stream
+		})
+		if i < 0 {
+			return fmt.Errorf("stream is not recorded in the manifest")
+		}
+		entry = &manifest.Streams[i]
+		if err := entry.verifyChecksums(root); err != nil {
+			return err
+		}
+	}
+
+	dir := filepath.Join(root, stream)
+	info, err := readSnapshotInfo(dir)
+	if err != nil {
+		return fmt.Errorf("invalid snapshot metadata: %w", err)
+	}
+
+	msgs, parseable, err := countSnapshotMessages(dir, info, encryption)
+	if errors.Is(err, errArchiveEncrypted) && manifest != nil {
+		klog.Infof("Snapshot in %s is encrypted and no key has been provided. Skipping the archive decoding", dir)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// the manifest records the stream as it has been backed up, including the messages of the increments
+	expected, lastSeq := info.State.Msgs, info.State.LastSeq
+	if state != nil && len(state.Increments) != 0 {
+		incremented, err := countIncrementMessages(root, state, encryption)
+		if err != nil {
+			return err
+		}
+		expected += incremented
+		lastSeq = state.LastSeq
+		if parseable {
+			msgs += incremented
+		}
+	}
+	if entry != nil && (entry.Messages != expected || entry.LastSeq != lastSeq) {
+		return fmt.Errorf("%d messages up to sequence %d have been recorded in the manifest, but the backup holds %d messages up to sequence %d",
+			entry.Messages, entry.LastSeq, expected, lastSeq)
+	}
+
+	if !parseable {
+		klog.Infof("Messages of the snapshot in %s are compressed or encrypted. Skipping the message count check", dir)
+		return nil
+	}
+	return verifyMessageCount(msgs, expected, info.State.NumDeleted)
+}
+
+// verifyMessageCount compares the number of messages found in a snapshot with the number recorded at backup time.
+// The deleted messages may still be stored in the blocks, so the count is exact only when nothing has been deleted.
+func verifyMessageCount(found, recorded uint64, deleted int) error {
+	if found < recorded || found > recorded+uint64(deleted) {
+		return fmt.Errorf("found %d messages in the archive, but %d messages have been recorded at backup time (%d deleted)", found, recorded, deleted)
+	}
+	return nil
+}
+
+// countSnapshotMessages counts the messages stored in the blocks of the snapshot in dir within the sequence range
+// of the stream. It reports false if the blocks can not be read, as they are compressed or encrypted by the server.
+func countSnapshotMessages(dir string, info *jetstream.StreamInfo, encryption *archiveEncryption) (uint64, bool, error) {
+	var (
+		msgs      uint64
+		parseable = info.Config.Compression == jetstream.NoCompression
+		parseErr  error
+	)
+	err := forEachSnapshotEntry(dir, encryption, func(name string, r io.Reader) error {
+		if filepath.Ext(name) == ".key" {
+			// the blocks of an encrypted stream can not be read without the server key
+			parseable = false
+		}
+		buf, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("failed to decode archive entry %s: %w", name, err)
+		}
+		if _, ok := msgBlockIndex(name); !ok || !parseable {
+			return nil
+		}
+		for offset := 0; offset < len(buf); {
+			rec, err := parseMsgRecord(buf[offset:])
+			if err != nil {
+				// the key file of an encrypted stream may come after the blocks
+				if parseErr == nil {
+					parseErr = fmt.Errorf("failed to parse message block %s: invalid record at offset %d: %w", name, offset, err)
+				}
+				return nil
+			}
+			if !rec.erased && !rec.tombstone && rec.seq >= info.State.FirstSeq && rec.seq <= info.State.LastSeq {
+				msgs++
+			}
+			offset += rec.size
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	if parseable && parseErr != nil {
+		return 0, false, parseErr
+	}
+	return msgs, parseable, nil
+}
+
+// countIncrementMessages counts the messages exported by the increments of the stream
+func countIncrementMessages(root string, state *streamBackupState, encryption *archiveEncryption) (uint64, error) {
+	var msgs uint64
+	for _, segment := range state.Increments {
+		var count uint64
+		err := forEachStoredMsg(filepath.Join(root, segment.File), encryption, func(msg *storedMsg) error {
+			if msg.Sequence < segment.FromSeq || msg.Sequence > segment.ToSeq {
+				return fmt.Errorf("message %d is out of the range of increment %d-%d", msg.Sequence, segment.FromSeq, segment.ToSeq)
+			}
+			count++
+			return nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("invalid increment %s: %w", segment.File, err)
+		}
+		// the increments exported before the messages were counted do not record their count
+		if segment.Messages != 0 && count != segment.Messages {
+			return 0, fmt.Errorf("found %d messages in increment %s, but %d messages have been exported", count, segment.File, segment.Messages)
+		}
+		msgs += count
+	}
+	return msgs, nil
+}
+
+// verifyKVBuckets verifies the snapshot of every backed up KV bucket against the state recorded in it
+// and against the manifest, if there is one
+func verifyKVBuckets(root string, manifest *backupManifest, encryption *archiveEncryption) error {
+	byteBuckets, err := os.ReadFile(filepath.Join(root, NATSKVFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var buckets []kvBucket
+	if err := json.Unmarshal(byteBuckets, &buckets); err != nil {
+		return err
+	}
+
+	var errs []error
+	for i := range buckets {
+		dir := filepath.Join(root, NATSKVDir, buckets[i].Bucket)
+		if err := verifyBucketManifest(root, manifest, manifest.findKVBucket(buckets[i].Bucket)); err != nil {
+			errs = append(errs, fmt.Errorf("KV bucket %s: %w", buckets[i].Bucket, err))
+			continue
+		}
+		info, err := readSnapshotInfo(dir)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("KV bucket %s: invalid snapshot metadata: %w", buckets[i].Bucket, err))
+			continue
+		}
+		msgs, parseable, err := countSnapshotMessages(dir, info, encryption)
+		if err == nil && parseable {
+			err = verifyMessageCount(msgs, info.State.Msgs, info.State.NumDeleted)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("KV bucket %s: %w", buckets[i].Bucket, err))
+			continue
+		}
+		klog.Infof("KV bucket %s verified", buckets[i].Bucket)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// verifyObjectBuckets verifies the data of every backed up object against the digest recorded along with it
+// and against the manifest, if there is one
+func verifyObjectBuckets(root string, manifest *backupManifest) error {
+	byteBuckets, err := os.ReadFile(filepath.Join(root, NATSObjectBucketsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var buckets []objectBucket
+	if err := json.Unmarshal(byteBuckets, &buckets); err != nil {
+		return err
+	}
+
+	var errs []error
+	for i := range buckets {
+		dir := filepath.Join(root, NATSObjectDir, buckets[i].Bucket)
+		if err := verifyBucketManifest(root, manifest, manifest.findObjectBucket(buckets[i].Bucket)); err != nil {
+			errs = append(errs, fmt.Errorf("object store bucket %s: %w", buckets[i].Bucket, err))
+			continue
+		}
+		metaFiles, err := filepath.Glob(filepath.Join(dir, "*"+NATSObjectMetaSuffix))
+		if err != nil {
+			return err
+		}
+		for _, metaFile := range metaFiles {
+			object, err := readObjectInfo(metaFile)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("object store bucket %s: %w", buckets[i].Bucket, err))
+				continue
+			}
+			if object.Opts != nil && object.Opts.Link != nil {
+				continue
+			}
+			if err := verifyObjectDigest(filepath.Join(dir, objectFileName(object.Name)), object); err != nil {
+				errs = append(errs, fmt.Errorf("object store bucket %s: %w", buckets[i].Bucket, err))
+			}
+		}
+		klog.Infof("Object store bucket %s verified", buckets[i].Bucket)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// verifyBucketManifest checks the files of a bucket against its entry in the manifest
+func verifyBucketManifest(root string, manifest *backupManifest, entry *bucketManifest) error {
+	if manifest == nil {
+		return nil
+	}
+	if entry == nil {
+		return fmt.Errorf("bucket is not recorded in the manifest")
+	}
+	return verifyFileChecksums(root, entry.Files)
+}
@@ -0,0 +1,165 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+)
+
+func TestVerifyStreamList(t *testing.T) {
+	cases := []struct {
+		name     string
+		listed   []string
+		dirs     []string
+		manifest *backupManifest
+		chained  bool
+		wantErr  string
+	}{
+		{
+			name:   "listed streams",
+			listed: []string{"orders", "events"},
+			dirs:   []string{"orders", "events"},
+		},
+		{
+			name:    "unlisted stream directory",
+			listed:  []string{"orders"},
+			dirs:    []string{"orders", "events"},
+			wantErr: "stream directory events is not listed",
+		},
+		{
+			name:    "leftover of a snapshot chain",
+			listed:  []string{"orders"},
+			dirs:    []string{"orders", "events"},
+			chained: true,
+		},
+		{
+			name:     "leftover ignored along with a manifest",
+			listed:   []string{"orders"},
+			dirs:     []string{"orders", "events"},
+			manifest: &backupManifest{Streams: []streamManifest{{Name: "orders"}}},
+		},
+		{
+			name:     "stream of the manifest not listed",
+			listed:   []string{"orders"},
+			dirs:     []string{"orders", "events"},
+			manifest: &backupManifest{Streams: []streamManifest{{Name: "orders"}, {Name: "events"}}},
+			chained:  true,
+			wantErr:  "stream events of the manifest is not listed",
+		},
+		{
+			name:    "listed stream without data",
+			listed:  []string{"orders", "events"},
+			dirs:    []string{"orders"},
+			chained: true,
+			wantErr: "listed stream events has no data",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			for _, dir := range tc.dirs {
+				if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(root, dir, NATSSnapshotMetaFile), []byte("{}"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			byteStreams, err := json.Marshal(tc.listed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(root, NATSStreamsFile), byteStreams, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = verifyStreamList(root, tc.manifest, tc.chained)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestVerifyMessageCount(t *testing.T) {
+	cases := []struct {
+		name     string
+		found    uint64
+		recorded uint64
+		deleted  int
+		valid    bool
+	}{
+		{name: "exact", found: 10, recorded: 10, valid: true},
+		{name: "missing messages", found: 9, recorded: 10},
+		{name: "extra messages", found: 11, recorded: 10},
+		{name: "deleted messages still stored", found: 12, recorded: 10, deleted: 2, valid: true},
+		{name: "more than the deleted messages", found: 13, recorded: 10, deleted: 2},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := verifyMessageCount(tc.found, tc.recorded, tc.deleted); (err == nil) != tc.valid {
+				t.Errorf("expected valid %v, got %v", tc.valid, err)
+			}
+		})
+	}
+}
+
+func TestUnverifiableSnapshots(t *testing.T) {
+	const interimDataDir = "/tmp/nats"
+	cases := []struct {
+		name      string
+		snapshots []restic.Snapshot
+		wantErr   string
+	}{
+		{
+			name: "interim data dir",
+			snapshots: []restic.Snapshot{
+				{ID: "a1", Paths: []string{interimDataDir}},
+				{ID: "b2", Paths: []string{interimDataDir}},
+			},
+		},
+		{
+			name: "streamed to restic",
+			snapshots: []restic.Snapshot{
+				{ID: "a1", Paths: []string{interimDataDir}},
+				{ID: "b2", Paths: []string{"/orders" + NATSStreamSnapshotSuffix}},
+				{ID: "c3", Paths: []string{"/" + NATSManifestFile}},
+			},
+			wantErr: "snapshots b2, c3 do not hold /tmp/nats, as they have been taken with --stream-to-restic",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := unverifiableSnapshots(tc.snapshots, interimDataDir)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}